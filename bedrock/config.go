@@ -1,12 +1,16 @@
 package bedrock
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/haveachin/bedprox"
+	"github.com/haveachin/bedprox/bedrock/protocol"
 	"github.com/haveachin/bedprox/webhook"
 	"github.com/sandertv/go-raknet"
 	"github.com/spf13/viper"
@@ -38,20 +42,153 @@ func newPingStatus(cfg pingStatusConfig) PingStatus {
 	}
 }
 
+type queryConfig struct {
+	Bind string `mapstructure:"bind"`
+}
+
+type realIPConfig struct {
+	PublicKey string        `mapstructure:"public_key"`
+	MaxAge    time.Duration `mapstructure:"max_age"`
+}
+
+// defaultRealIPMaxAge is the max age of real IP timestamps of configs without one.
+const defaultRealIPMaxAge = 5 * time.Second
+
+func newRealIP(cfg realIPConfig) (RealIP, error) {
+	if cfg.PublicKey == "" {
+		return RealIP{}, errors.New("receiving real IPs needs a public key")
+	}
+
+	key, err := ParseRealIPPublicKey(cfg.PublicKey)
+	if err != nil {
+		return RealIP{}, fmt.Errorf("invalid real IP public key: %w", err)
+	}
+
+	if cfg.MaxAge < 0 {
+		return RealIP{}, fmt.Errorf("invalid real IP max age %s", cfg.MaxAge)
+	}
+	// A max age of zero would reject every timestamp
+	maxAge := cfg.MaxAge
+	if maxAge == 0 {
+		maxAge = defaultRealIPMaxAge
+	}
+
+	return RealIP{
+		PublicKey: key,
+		MaxAge:    maxAge,
+	}, nil
+}
+
+type ipLimitConfig struct {
+	ConnectionsPerWindow int           `mapstructure:"connections_per_window"`
+	Window               time.Duration `mapstructure:"window"`
+	MaxSessions          int           `mapstructure:"max_sessions"`
+	IPv4Prefix           int           `mapstructure:"ipv4_prefix"`
+	IPv6Prefix           int           `mapstructure:"ipv6_prefix"`
+	Exempt               []string      `mapstructure:"exempt"`
+}
+
+func newIPLimit(cfg ipLimitConfig) (IPLimit, error) {
+	if cfg.ConnectionsPerWindow > 0 && cfg.Window <= 0 {
+		return IPLimit{}, errors.New("IP limit of connections per window needs a window")
+	}
+
+	if cfg.IPv4Prefix < 0 || cfg.IPv4Prefix > 8*net.IPv4len {
+		return IPLimit{}, fmt.Errorf("invalid IPv4 prefix length %d", cfg.IPv4Prefix)
+	}
+
+	if cfg.IPv6Prefix < 0 || cfg.IPv6Prefix > 8*net.IPv6len {
+		return IPLimit{}, fmt.Errorf("invalid IPv6 prefix length %d", cfg.IPv6Prefix)
+	}
+
+	exempt, err := parseCIDRs(cfg.Exempt)
+	if err != nil {
+		return IPLimit{}, err
+	}
+
+	return IPLimit{
+		ConnectionsPerWindow: cfg.ConnectionsPerWindow,
+		Window:               cfg.Window,
+		MaxSessions:          cfg.MaxSessions,
+		IPv4Prefix:           cfg.IPv4Prefix,
+		IPv6Prefix:           cfg.IPv6Prefix,
+		Exempt:               exempt,
+	}, nil
+}
+
 type listenerConfig struct {
-	Bind                 string           `mapstructure:"bind"`
-	PingStatus           pingStatusConfig `mapstructure:"ping_status"`
-	ReceiveProxyProtocol bool             `mapstructure:"receive_proxy_protocol"`
-	ReceiveRealIP        bool             `mapstructure:"receive_real_ip"`
+	Bind                     string           `mapstructure:"bind"`
+	PingStatus               pingStatusConfig `mapstructure:"ping_status"`
+	ReceiveProxyProtocol     bool             `mapstructure:"receive_proxy_protocol"`
+	TrustedProxies           []string         `mapstructure:"trusted_proxies"`
+	ProxyProtocolMaxSessions int              `mapstructure:"proxy_protocol_max_sessions"`
+	ReceiveRealIP            bool             `mapstructure:"receive_real_ip"`
+	RealIP                   realIPConfig     `mapstructure:"real_ip"`
+	Query                    queryConfig      `mapstructure:"query"`
+	IPLimit                  ipLimitConfig    `mapstructure:"ip_limit"`
 }
 
-func newListener(cfg listenerConfig) Listener {
-	return Listener{
-		Bind:                 cfg.Bind,
-		PingStatus:           newPingStatus(cfg.PingStatus),
-		ReceiveProxyProtocol: cfg.ReceiveProxyProtocol,
-		ReceiveRealIP:        cfg.ReceiveRealIP,
+// parseCIDRs parses networks in CIDR notation. Single IPs are
+// parsed as networks that only contain the IP itself.
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	ipNets := make([]*net.IPNet, len(cidrs))
+	for n, cidr := range cidrs {
+		if ip := net.ParseIP(cidr); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			ipNets[n] = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		ipNets[n] = ipNet
+	}
+	return ipNets, nil
+}
+
+func newListener(cfg listenerConfig) (Listener, error) {
+	if cfg.ReceiveProxyProtocol && len(cfg.TrustedProxies) == 0 {
+		return Listener{}, fmt.Errorf("listener %q: receiving the PROXY protocol needs trusted proxies", cfg.Bind)
+	}
+
+	trustedProxies, err := parseCIDRs(cfg.TrustedProxies)
+	if err != nil {
+		return Listener{}, fmt.Errorf("listener %q: %w", cfg.Bind, err)
+	}
+
+	if cfg.ProxyProtocolMaxSessions < 0 {
+		return Listener{}, fmt.Errorf("listener %q: invalid PROXY protocol max sessions %d", cfg.Bind, cfg.ProxyProtocolMaxSessions)
+	}
+
+	var realIP RealIP
+	if cfg.ReceiveRealIP {
+		realIP, err = newRealIP(cfg.RealIP)
+		if err != nil {
+			return Listener{}, fmt.Errorf("listener %q: %w", cfg.Bind, err)
+		}
+	}
+
+	ipLimit, err := newIPLimit(cfg.IPLimit)
+	if err != nil {
+		return Listener{}, fmt.Errorf("listener %q: %w", cfg.Bind, err)
 	}
+
+	return Listener{
+		Bind:                     cfg.Bind,
+		PingStatus:               newPingStatus(cfg.PingStatus),
+		ReceiveProxyProtocol:     cfg.ReceiveProxyProtocol,
+		TrustedProxies:           trustedProxies,
+		ProxyProtocolMaxSessions: cfg.ProxyProtocolMaxSessions,
+		ReceiveRealIP:            cfg.ReceiveRealIP,
+		RealIP:                   realIP,
+		QueryBind:                cfg.Query.Bind,
+		IPLimit:                  ipLimit,
+	}, nil
 }
 
 func loadListeners(gatewayID string) ([]Listener, error) {
@@ -73,33 +210,315 @@ func loadListeners(gatewayID string) ([]Listener, error) {
 		if err := vpr.Unmarshal(&cfg); err != nil {
 			return nil, err
 		}
-		listeners[n] = newListener(cfg)
+		listener, err := newListener(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("gateway %q: %w", gatewayID, err)
+		}
+		listeners[n] = listener
 	}
 	return listeners, nil
 }
 
+type unauthenticatedConfig struct {
+	Action  string `mapstructure:"action"`
+	Server  string `mapstructure:"server"`
+	Message string `mapstructure:"message"`
+}
+
+type rejectionConfig struct {
+	Action  string `mapstructure:"action"`
+	Message string `mapstructure:"message"`
+}
+
+type trafficRateConfig struct {
+	BytesPerSecond   uint64 `mapstructure:"bytes_per_second"`
+	PacketsPerSecond uint64 `mapstructure:"packets_per_second"`
+}
+
+type trafficLimitConfig struct {
+	Action          string            `mapstructure:"action"`
+	DisconnectAfter time.Duration     `mapstructure:"disconnect_after"`
+	ClientToServer  trafficRateConfig `mapstructure:"client_to_server"`
+	ServerToClient  trafficRateConfig `mapstructure:"server_to_client"`
+}
+
+func newTrafficLimit(cfg trafficLimitConfig) (bedprox.TrafficLimit, error) {
+	action := bedprox.TrafficLimitAction(cfg.Action)
+	switch action {
+	case "", bedprox.TrafficLimitActionThrottle, bedprox.TrafficLimitActionDisconnect:
+	default:
+		return bedprox.TrafficLimit{}, fmt.Errorf("invalid traffic limit action %q", cfg.Action)
+	}
+
+	return bedprox.TrafficLimit{
+		ClientToServer: bedprox.TrafficRate{
+			BytesPerSecond:   cfg.ClientToServer.BytesPerSecond,
+			PacketsPerSecond: cfg.ClientToServer.PacketsPerSecond,
+		},
+		ServerToClient: bedprox.TrafficRate{
+			BytesPerSecond:   cfg.ServerToClient.BytesPerSecond,
+			PacketsPerSecond: cfg.ServerToClient.PacketsPerSecond,
+		},
+		Action:          action,
+		DisconnectAfter: cfg.DisconnectAfter,
+	}, nil
+}
+
+type playerGroupConfig struct {
+	XUIDs     []string `mapstructure:"xuids"`
+	Usernames []string `mapstructure:"usernames"`
+}
+
+// loadPlayerGroups loads the groups of players that reserved
+// slots can refer to by their name.
+func loadPlayerGroups() (map[string]playerGroupConfig, error) {
+	groups := map[string]playerGroupConfig{}
+	if err := viper.UnmarshalKey("player_groups", &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+type playerSetConfig struct {
+	XUIDs     []string `mapstructure:"xuids"`
+	Usernames []string `mapstructure:"usernames"`
+	Groups    []string `mapstructure:"groups"`
+}
+
+// newPlayerSet returns the set of the players of the config
+// together with the players of its groups.
+func newPlayerSet(cfg playerSetConfig, groups map[string]playerGroupConfig) (bedprox.PlayerSet, error) {
+	set := bedprox.PlayerSet{
+		XUIDs:     append([]string(nil), cfg.XUIDs...),
+		Usernames: append([]string(nil), cfg.Usernames...),
+	}
+	for _, name := range cfg.Groups {
+		group, ok := groups[name]
+		if !ok {
+			return bedprox.PlayerSet{}, fmt.Errorf("player group %q doesn't exist", name)
+		}
+		set.XUIDs = append(set.XUIDs, group.XUIDs...)
+		set.Usernames = append(set.Usernames, group.Usernames...)
+	}
+	return set, nil
+}
+
+type reservedSlotsConfig struct {
+	HardCap   int             `mapstructure:"hard_cap"`
+	PlayerSet playerSetConfig `mapstructure:",squash"`
+}
+
+func newCapacity(maxPlayers int, cfg reservedSlotsConfig, groups map[string]playerGroupConfig) (bedprox.Capacity, error) {
+	if maxPlayers < 0 {
+		return bedprox.Capacity{}, fmt.Errorf("invalid max players %d", maxPlayers)
+	}
+
+	reserved, err := newPlayerSet(cfg.PlayerSet, groups)
+	if err != nil {
+		return bedprox.Capacity{}, err
+	}
+
+	hasReserved := len(reserved.XUIDs) > 0 || len(reserved.Usernames) > 0
+	if hasReserved && cfg.HardCap <= maxPlayers {
+		return bedprox.Capacity{}, fmt.Errorf("reserved slots need a hard cap above max players %d", maxPlayers)
+	}
+
+	return bedprox.Capacity{
+		MaxPlayers: maxPlayers,
+		HardCap:    cfg.HardCap,
+		Reserved:   reserved,
+	}, nil
+}
+
+type queueConfig struct {
+	MaxWait        time.Duration     `mapstructure:"max_wait"`
+	RetryInterval  time.Duration     `mapstructure:"retry_interval"`
+	TimeoutMessage string            `mapstructure:"timeout_message"`
+	Tiers          []playerSetConfig `mapstructure:"tiers"`
+}
+
+func newQueuePolicy(cfg queueConfig, groups map[string]playerGroupConfig) (bedprox.QueuePolicy, error) {
+	if cfg.MaxWait > 0 && cfg.RetryInterval <= 0 {
+		return bedprox.QueuePolicy{}, errors.New("queue needs a retry interval")
+	}
+
+	tiers := make([]bedprox.PlayerSet, len(cfg.Tiers))
+	for n, tierCfg := range cfg.Tiers {
+		tier, err := newPlayerSet(tierCfg, groups)
+		if err != nil {
+			return bedprox.QueuePolicy{}, fmt.Errorf("queue tier %d: %w", n, err)
+		}
+		tiers[n] = tier
+	}
+
+	return bedprox.QueuePolicy{
+		MaxWait:        cfg.MaxWait,
+		RetryInterval:  cfg.RetryInterval,
+		Tiers:          tiers,
+		TimeoutMessage: cfg.TimeoutMessage,
+	}, nil
+}
+
 type gatewayConfig struct {
-	ClientTimeout         time.Duration `mapstructure:"client_timeout"`
-	Servers               []string      `mapstructure:"servers"`
-	ServerNotFoundMessage string        `mapstructure:"server_not_found_message"`
+	ClientTimeout          time.Duration              `mapstructure:"client_timeout"`
+	IdleTimeout            time.Duration              `mapstructure:"idle_timeout"`
+	TrafficLimit           trafficLimitConfig         `mapstructure:"traffic_limit"`
+	SharedTrafficLimit     trafficLimitConfig         `mapstructure:"shared_traffic_limit"`
+	MaxPlayers             int                        `mapstructure:"max_players"`
+	ReservedSlots          reservedSlotsConfig        `mapstructure:"reserved_slots"`
+	Servers                []string                   `mapstructure:"servers"`
+	ServerNotFoundMessage  string                     `mapstructure:"server_not_found_message"`
+	ServerNotFoundTransfer string                     `mapstructure:"server_not_found_transfer"`
+	Unauthenticated        unauthenticatedConfig      `mapstructure:"unauthenticated"`
+	Rejections             map[string]rejectionConfig `mapstructure:"rejections"`
+}
+
+func newUnauthenticatedPolicy(cfg unauthenticatedConfig) (bedprox.UnauthenticatedPolicy, error) {
+	switch cfg.Action {
+	case "", bedprox.UnauthenticatedActionAccept, bedprox.UnauthenticatedActionReject:
+	case bedprox.UnauthenticatedActionRoute:
+		if cfg.Server == "" {
+			return bedprox.UnauthenticatedPolicy{}, fmt.Errorf("unauthenticated action %q needs a server", cfg.Action)
+		}
+	default:
+		return bedprox.UnauthenticatedPolicy{}, fmt.Errorf("invalid unauthenticated action %q", cfg.Action)
+	}
+
+	return bedprox.UnauthenticatedPolicy{
+		Action:   cfg.Action,
+		ServerID: cfg.Server,
+		Message:  cfg.Message,
+	}, nil
 }
 
-func newGateway(id string, cfg gatewayConfig) (bedprox.Gateway, error) {
+func newRejectionPolicies(cfgs map[string]rejectionConfig) (map[bedprox.RejectReason]bedprox.RejectionPolicy, error) {
+	policies := map[bedprox.RejectReason]bedprox.RejectionPolicy{}
+	for reason, cfg := range cfgs {
+		if !isRejectReason(bedprox.RejectReason(reason)) {
+			return nil, fmt.Errorf("invalid reject reason %q", reason)
+		}
+
+		switch cfg.Action {
+		case "", bedprox.RejectionActionPlayStatus:
+			if cfg.Message != "" {
+				return nil, fmt.Errorf("rejection action %q of reason %q has no message", bedprox.RejectionActionPlayStatus, reason)
+			}
+		case bedprox.RejectionActionDisconnect:
+		default:
+			return nil, fmt.Errorf("invalid rejection action %q of reason %q", cfg.Action, reason)
+		}
+
+		policies[bedprox.RejectReason(reason)] = bedprox.RejectionPolicy{
+			Action:  cfg.Action,
+			Message: cfg.Message,
+		}
+	}
+	return policies, nil
+}
+
+func isRejectReason(reason bedprox.RejectReason) bool {
+	for _, r := range bedprox.RejectReasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultTransferPort is the port of a transfer address without one.
+const defaultTransferPort = 19132
+
+// parseTransferTarget parses a transfer address in the form of host[:port].
+func parseTransferTarget(addr string) (bedprox.TransferTarget, error) {
+	if addr == "" {
+		return bedprox.TransferTarget{}, errors.New("transfer address is empty")
+	}
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		// The address has no port
+		return bedprox.TransferTarget{
+			Host: strings.Trim(addr, "[]"),
+			Port: defaultTransferPort,
+		}, nil
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return bedprox.TransferTarget{}, fmt.Errorf("invalid transfer port %q", portStr)
+	}
+
+	if host == "" {
+		return bedprox.TransferTarget{}, fmt.Errorf("transfer address %q has no host", addr)
+	}
+
+	return bedprox.TransferTarget{
+		Host: host,
+		Port: uint16(port),
+	}, nil
+}
+
+func newGateway(id string, cfg gatewayConfig, groups map[string]playerGroupConfig) (bedprox.Gateway, error) {
 	listeners, err := loadListeners(id)
 	if err != nil {
 		return nil, err
 	}
 
+	unauthPolicy, err := newUnauthenticatedPolicy(cfg.Unauthenticated)
+	if err != nil {
+		return nil, fmt.Errorf("gateway %q: %w", id, err)
+	}
+
+	rejectPolicies, err := newRejectionPolicies(cfg.Rejections)
+	if err != nil {
+		return nil, fmt.Errorf("gateway %q: %w", id, err)
+	}
+
+	trafficLimit, err := newTrafficLimit(cfg.TrafficLimit)
+	if err != nil {
+		return nil, fmt.Errorf("gateway %q: %w", id, err)
+	}
+
+	sharedTrafficLimit, err := newTrafficLimit(cfg.SharedTrafficLimit)
+	if err != nil {
+		return nil, fmt.Errorf("gateway %q: shared %w", id, err)
+	}
+
+	capacity, err := newCapacity(cfg.MaxPlayers, cfg.ReservedSlots, groups)
+	if err != nil {
+		return nil, fmt.Errorf("gateway %q: %w", id, err)
+	}
+
+	var srvNotFoundTransfer bedprox.TransferTarget
+	if cfg.ServerNotFoundTransfer != "" {
+		srvNotFoundTransfer, err = parseTransferTarget(cfg.ServerNotFoundTransfer)
+		if err != nil {
+			return nil, fmt.Errorf("gateway %q: %w", id, err)
+		}
+	}
+
 	return &Gateway{
-		ID:                    id,
-		Listeners:             listeners,
-		ClientTimeout:         cfg.ClientTimeout,
-		ServerIDs:             cfg.Servers,
-		ServerNotFoundMessage: cfg.ServerNotFoundMessage,
+		ID:                     id,
+		Listeners:              listeners,
+		ClientTimeout:          cfg.ClientTimeout,
+		IdleTimeout:            cfg.IdleTimeout,
+		TrafficLimit:           trafficLimit,
+		SharedTrafficLimit:     sharedTrafficLimit,
+		Capacity:               capacity,
+		ServerIDs:              cfg.Servers,
+		ServerNotFoundMessage:  cfg.ServerNotFoundMessage,
+		UnauthenticatedPolicy:  unauthPolicy,
+		ServerNotFoundTransfer: srvNotFoundTransfer,
+		RejectionPolicies:      rejectPolicies,
 	}, nil
 }
 
 func (cfg Config) LoadGateways() ([]bedprox.Gateway, error) {
+	groups, err := loadPlayerGroups()
+	if err != nil {
+		return nil, err
+	}
+
 	var gateways []bedprox.Gateway
 	for id, v := range viper.GetStringMap("gateways") {
 		vpr := viper.Sub("defaults.gateway")
@@ -111,7 +530,7 @@ func (cfg Config) LoadGateways() ([]bedprox.Gateway, error) {
 		if err := vpr.Unmarshal(&cfg); err != nil {
 			return nil, err
 		}
-		gateway, err := newGateway(id, cfg)
+		gateway, err := newGateway(id, cfg, groups)
 		if err != nil {
 			return nil, err
 		}
@@ -122,15 +541,86 @@ func (cfg Config) LoadGateways() ([]bedprox.Gateway, error) {
 }
 
 type serverConfig struct {
-	Domains            []string      `mapstructure:"domains"`
-	Address            string        `mapstructure:"address"`
-	ProxyBind          string        `mapstructure:"proxy_bind"`
-	DialTimeout        time.Duration `mapstructure:"dial_timeout"`
-	SendProxyProtocol  bool          `mapstructure:"send_proxy_protocol"`
-	DialTimeoutMessage string        `mapstructure:"dial_timeout_message"`
+	Domains            []string            `mapstructure:"domains"`
+	Address            string              `mapstructure:"address"`
+	ProxyBind          string              `mapstructure:"proxy_bind"`
+	DialTimeout        time.Duration       `mapstructure:"dial_timeout"`
+	DialConcurrency    int                 `mapstructure:"dial_concurrency"`
+	SendProxyProtocol  bool                `mapstructure:"send_proxy_protocol"`
+	DialTimeoutMessage string              `mapstructure:"dial_timeout_message"`
+	Mode               string              `mapstructure:"mode"`
+	SwitchServers      []string            `mapstructure:"switch_servers"`
+	Webhooks           []string            `mapstructure:"webhooks"`
+	IdleTimeout        time.Duration       `mapstructure:"idle_timeout"`
+	TrafficLimit       trafficLimitConfig  `mapstructure:"traffic_limit"`
+	SharedTrafficLimit trafficLimitConfig  `mapstructure:"shared_traffic_limit"`
+	MaxPlayers         int                 `mapstructure:"max_players"`
+	ReservedSlots      reservedSlotsConfig `mapstructure:"reserved_slots"`
+	Queue              queueConfig         `mapstructure:"queue"`
+	TransferAddress    string              `mapstructure:"transfer_address"`
+	MinProtocolVersion int32               `mapstructure:"min_protocol_version"`
+	MaxProtocolVersion int32               `mapstructure:"max_protocol_version"`
 }
 
-func newServer(id string, cfg serverConfig) bedprox.Server {
+func newServer(id string, cfg serverConfig, groups map[string]playerGroupConfig) (bedprox.Server, error) {
+	mode := ServerMode(cfg.Mode)
+	switch mode {
+	case "", ServerModeProxy, ServerModeTerminate, ServerModeTransfer:
+	default:
+		return nil, fmt.Errorf("server %q: invalid mode %q", id, cfg.Mode)
+	}
+
+	if len(cfg.SwitchServers) > 0 && mode != ServerModeTerminate {
+		return nil, fmt.Errorf("server %q: switch servers need mode %q", id, ServerModeTerminate)
+	}
+
+	if cfg.MaxProtocolVersion > 0 && cfg.MinProtocolVersion > cfg.MaxProtocolVersion {
+		return nil, fmt.Errorf("server %q: min protocol version %d exceeds max protocol version %d",
+			id, cfg.MinProtocolVersion, cfg.MaxProtocolVersion)
+	}
+
+	trafficLimit, err := newTrafficLimit(cfg.TrafficLimit)
+	if err != nil {
+		return nil, fmt.Errorf("server %q: %w", id, err)
+	}
+
+	sharedTrafficLimit, err := newTrafficLimit(cfg.SharedTrafficLimit)
+	if err != nil {
+		return nil, fmt.Errorf("server %q: shared %w", id, err)
+	}
+
+	capacity, err := newCapacity(cfg.MaxPlayers, cfg.ReservedSlots, groups)
+	if err != nil {
+		return nil, fmt.Errorf("server %q: %w", id, err)
+	}
+
+	queue, err := newQueuePolicy(cfg.Queue, groups)
+	if err != nil {
+		return nil, fmt.Errorf("server %q: %w", id, err)
+	}
+
+	if cfg.DialConcurrency < 0 {
+		return nil, fmt.Errorf("server %q: invalid dial concurrency %d", id, cfg.DialConcurrency)
+	}
+	// Configs without a dial concurrency dial one client at a time
+	dialConcurrency := cfg.DialConcurrency
+	if dialConcurrency == 0 {
+		dialConcurrency = 1
+	}
+
+	var transferTarget bedprox.TransferTarget
+	if mode == ServerModeTransfer {
+		addr := cfg.TransferAddress
+		if addr == "" {
+			addr = cfg.Address
+		}
+
+		transferTarget, err = parseTransferTarget(addr)
+		if err != nil {
+			return nil, fmt.Errorf("server %q: %w", id, err)
+		}
+	}
+
 	return &Server{
 		ID:      id,
 		Domains: cfg.Domains,
@@ -142,14 +632,52 @@ func newServer(id string, cfg serverConfig) bedprox.Server {
 			},
 		},
 		DialTimeout:        cfg.DialTimeout,
+		DialConcurrency:    dialConcurrency,
 		Address:            cfg.Address,
 		SendProxyProtocol:  cfg.SendProxyProtocol,
 		DialTimeoutMessage: cfg.DialTimeoutMessage,
+		WebhookIDs:         cfg.Webhooks,
+		IdleTimeout:        cfg.IdleTimeout,
+		TrafficLimit:       trafficLimit,
+		SharedTrafficLimit: sharedTrafficLimit,
+		Capacity:           capacity,
+		Queue:              queue,
+		Mode:               mode,
+		TransferTarget:     transferTarget,
+		MinProtocolVersion: cfg.MinProtocolVersion,
+		MaxProtocolVersion: cfg.MaxProtocolVersion,
+	}, nil
+}
+
+// linkSwitchServers sets the switch servers of each server by their IDs.
+func linkSwitchServers(servers map[string]*Server, cfgs map[string]serverConfig) error {
+	for id, cfg := range cfgs {
+		if len(cfg.SwitchServers) == 0 {
+			continue
+		}
+
+		srv := servers[id]
+		srv.SwitchServers = make(map[string]*Server, len(cfg.SwitchServers))
+		for _, switchID := range cfg.SwitchServers {
+			switchSrv, ok := servers[switchID]
+			if !ok {
+				return fmt.Errorf("server %q: switch server %q not found", id, switchID)
+			}
+			srv.SwitchServers[switchID] = switchSrv
+		}
 	}
+	return nil
 }
 
 func (cfg Config) LoadServers() ([]bedprox.Server, error) {
+	groups, err := loadPlayerGroups()
+	if err != nil {
+		return nil, err
+	}
+
 	var servers []bedprox.Server
+	srvs := map[string]*Server{}
+	cfgs := map[string]serverConfig{}
 	for id, v := range viper.GetStringMap("servers") {
 		vpr := viper.Sub("defaults.server")
 		vMap := v.(map[string]interface{})
@@ -160,14 +688,31 @@ func (cfg Config) LoadServers() ([]bedprox.Server, error) {
 		if err := vpr.Unmarshal(&cfg); err != nil {
 			return nil, err
 		}
-		servers = append(servers, newServer(id, cfg))
+		server, err := newServer(id, cfg, groups)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+		srvs[id] = server.(*Server)
+		cfgs[id] = cfg
+	}
+
+	if err := linkSwitchServers(srvs, cfgs); err != nil {
+		return nil, err
 	}
 
 	return servers, nil
 }
 
+type networkSettingsConfig struct {
+	CompressionThreshold uint16 `mapstructure:"compression_threshold"`
+}
+
 type cpnConfig struct {
-	Count int `mapstructure:"count"`
+	Count           int                   `mapstructure:"count"`
+	NetworkSettings networkSettingsConfig `mapstructure:"network_settings"`
+	ReadTimeout     time.Duration         `mapstructure:"read_timeout"`
+	MaxLoginSize    int                   `mapstructure:"max_login_size"`
 }
 
 func (cfg Config) LoadCPNs() ([]bedprox.CPN, error) {
@@ -178,12 +723,69 @@ func (cfg Config) LoadCPNs() ([]bedprox.CPN, error) {
 
 	cpns := make([]bedprox.CPN, cpnCfg.Count)
 	for n := range cpns {
-		cpns[n].ConnProcessor = ConnProcessor{}
+		cpns[n].ConnProcessor = ConnProcessor{
+			NetworkSettings: protocol.NetworkSettings{
+				CompressionThreshold: cpnCfg.NetworkSettings.CompressionThreshold,
+				CompressionAlgorithm: protocol.CompressionAlgorithmFlate,
+			},
+			ReadTimeout:  cpnCfg.ReadTimeout,
+			MaxLoginSize: cpnCfg.MaxLoginSize,
+		}
 	}
 
 	return cpns, nil
 }
 
+type overloadConfig struct {
+	MaxQueueDepth int           `mapstructure:"max_queue_depth"`
+	MaxQueueAge   time.Duration `mapstructure:"max_queue_age"`
+	BusyMessage   string        `mapstructure:"busy_message"`
+}
+
+type pipelineConfig struct {
+	CPNQueueSize    int            `mapstructure:"cpn_queue_size"`
+	ServerQueueSize int            `mapstructure:"server_queue_size"`
+	PoolQueueSize   int            `mapstructure:"pool_queue_size"`
+	Overload        overloadConfig `mapstructure:"overload"`
+}
+
+func (cfg Config) LoadPipeline() (bedprox.Pipeline, error) {
+	var pipelineCfg pipelineConfig
+	if err := viper.UnmarshalKey("pipeline", &pipelineCfg); err != nil {
+		return bedprox.Pipeline{}, err
+	}
+
+	for _, size := range []int{
+		pipelineCfg.CPNQueueSize,
+		pipelineCfg.ServerQueueSize,
+		pipelineCfg.PoolQueueSize,
+	} {
+		// Zero keeps the default size of configs without a pipeline
+		if size < 0 {
+			return bedprox.Pipeline{}, fmt.Errorf("invalid pipeline queue size %d", size)
+		}
+	}
+
+	overload := pipelineCfg.Overload
+	if overload.MaxQueueDepth < 0 {
+		return bedprox.Pipeline{}, fmt.Errorf("invalid max queue depth %d", overload.MaxQueueDepth)
+	}
+	if overload.MaxQueueAge < 0 {
+		return bedprox.Pipeline{}, fmt.Errorf("invalid max queue age %s", overload.MaxQueueAge)
+	}
+
+	return bedprox.Pipeline{
+		CPNQueueSize:    pipelineCfg.CPNQueueSize,
+		ServerQueueSize: pipelineCfg.ServerQueueSize,
+		PoolQueueSize:   pipelineCfg.PoolQueueSize,
+		Overload: bedprox.OverloadPolicy{
+			MaxQueueDepth: overload.MaxQueueDepth,
+			MaxQueueAge:   overload.MaxQueueAge,
+			BusyMessage:   overload.BusyMessage,
+		},
+	}, nil
+}
+
 type webhookConfig struct {
 	ClientTimeout time.Duration `mapstructure:"client_timeout"`
 	URL           string        `mapstructure:"url"`
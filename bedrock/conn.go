@@ -1,9 +1,16 @@
 package bedrock
 
 import (
+	"crypto/ecdsa"
+	"fmt"
 	"net"
+	"os"
+	"sync"
+	"time"
 
+	"github.com/haveachin/bedprox"
 	"github.com/haveachin/bedprox/bedrock/protocol"
+	"github.com/haveachin/bedprox/bedrock/protocol/login"
 	"github.com/sandertv/go-raknet"
 )
 
@@ -11,18 +18,254 @@ import (
 type Conn struct {
 	*raknet.Conn
 
-	gatewayID     string
-	proxyProtocol bool
-	realIP        bool
+	gatewayID string
+	// realIP verifies the signed server address of the client
+	// if the listener receives real IPs
+	realIP *RealIP
+	// ipLimiter limits the client by its real IP once it is known. It is
+	// only set if the listener receives real IPs, since the address of
+	// the connection is that of the front proxy then.
+	ipLimiter *ipLimiter
+	// loginDeadline is the time that the client has to log in until
+	loginDeadline time.Time
+	// remoteAddr is the address of the client that a trusted proxy
+	// sent in its PROXY protocol header
+	remoteAddr net.Addr
+	// localAddr is the address that the client connected to. It is set on
+	// listeners behind a relay, whose own address is only internal.
+	localAddr net.Addr
+	// onClose is called once the connection is closed, like to release
+	// the session of the client in the IP limit of the listener
+	onClose   func()
+	closeOnce sync.Once
+	// closed is closed once the connection was closed by the proxy
+	closed     chan struct{}
+	closedOnce sync.Once
+
+	// watcher is the only reader of a connection that is watched
+	watchOnce sync.Once
+	watcher   *connWatcher
+}
+
+// connWatcher reads the packets of a connection for all other readers,
+// so that it notices once the client closes the connection, even while
+// nobody else reads from it.
+type connWatcher struct {
+	packets chan []byte
+	// done is closed once the connection was closed and err is set
+	done chan struct{}
+	err  error
+
+	mu sync.Mutex
+	// deadline is the read deadline of the connection. Each read waits
+	// for it with its own timer, since a timer only fires once.
+	deadline time.Time
+}
+
+func (c *Conn) closedChan() chan struct{} {
+	c.closedOnce.Do(func() {
+		c.closed = make(chan struct{})
+	})
+	return c.closed
+}
+
+// Close closes the connection and calls onClose the first time.
+func (c *Conn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() {
+		close(c.closedChan())
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return err
+}
+
+// limit reports if the IP limit allows the client at addr. Allowed
+// clients release their session once the connection is closed.
+func (c *Conn) limit(limiter *ipLimiter, addr net.Addr) bool {
+	if !limiter.acquire(addr, time.Now()) {
+		return false
+	}
+
+	c.onClose = func() {
+		limiter.release(addr)
+	}
+	return true
+}
+
+// Watch starts to read the connection in the background and returns a
+// channel that is closed once the connection was closed by either side.
+// The packets that are read in the background are returned by the next
+// reads.
+func (c *Conn) Watch() <-chan struct{} {
+	c.watchOnce.Do(func() {
+		w := &connWatcher{
+			packets: make(chan []byte),
+			done:    make(chan struct{}),
+		}
+		c.watcher = w
+		go c.watch(w)
+	})
+	return c.watcher.done
+}
+
+func (c *Conn) watch(w *connWatcher) {
+	defer close(w.done)
+	closed := c.closedChan()
+	for {
+		b, err := c.Conn.ReadPacket()
+		if err != nil {
+			w.err = err
+			return
+		}
+
+		select {
+		case w.packets <- b:
+		case <-closed:
+			w.err = net.ErrClosed
+			return
+		}
+	}
+}
+
+// ReadPacket reads the next packet of the client.
+func (c *Conn) ReadPacket() ([]byte, error) {
+	w := c.watcher
+	if w == nil {
+		return c.Conn.ReadPacket()
+	}
+
+	w.mu.Lock()
+	deadline := w.deadline
+	w.mu.Unlock()
+
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return nil, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	select {
+	case b := <-w.packets:
+		return b, nil
+	case <-w.done:
+		return nil, w.err
+	case <-expired:
+		return nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if c.watcher == nil {
+		return c.Conn.Read(b)
+	}
+	return readInto(b, c.ReadPacket)
+}
+
+// SetReadDeadline sets the deadline of the reads of the connection.
+// The zero time means no deadline.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	w := c.watcher
+	if w == nil {
+		return c.Conn.SetReadDeadline(t)
+	}
+
+	w.mu.Lock()
+	w.deadline = t
+	w.mu.Unlock()
+	return nil
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// RemoteAddr returns the address of the client, which is the address
+// that a trusted proxy sent in its PROXY protocol header, if any.
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address that the client connected to, which is
+// the destination in the PROXY protocol header of a trusted proxy, if any.
+func (c *Conn) LocalAddr() net.Addr {
+	if c.localAddr != nil {
+		return c.localAddr
+	}
+	return c.Conn.LocalAddr()
 }
 
 type ProcessedConn struct {
 	*Conn
-	readBytes     []byte
-	remoteAddr    net.Addr
-	serverAddr    string
-	username      string
-	proxyProtocol bool
+	readBytes  []byte
+	remoteAddr net.Addr
+	serverAddr string
+	username   string
+
+	// networkSettingsRequest is the uncompressed batch that the client
+	// sent to request the network settings. It is nil for clients that
+	// do not negotiate network settings.
+	networkSettingsRequest []byte
+	compression            protocol.Compression
+	authenticated          bool
+	identityData           login.IdentityData
+	clientData             login.ClientData
+
+	// clientProtocol and connectionRequest are taken from the login
+	// of the client to log in to servers with a resigned request
+	clientProtocol    int32
+	connectionRequest []byte
+	// publicKey is the verified identity public key of the client
+	publicKey *ecdsa.PublicKey
+	// encryption is set once the proxy terminated the encryption
+	// of the session with the client
+	encryption *encryption
+}
+
+// ReadPacket reads the next batch of the client and decrypts it, if
+// the proxy terminated the encryption of the session.
+func (c ProcessedConn) ReadPacket() ([]byte, error) {
+	if c.encryption == nil {
+		return c.Conn.ReadPacket()
+	}
+	return c.encryption.readPacket(c.Conn)
+}
+
+func (c ProcessedConn) Read(b []byte) (int, error) {
+	if c.encryption == nil {
+		return c.Conn.Read(b)
+	}
+	return readInto(b, c.ReadPacket)
+}
+
+// Write writes the batch to the client and encrypts it, if the proxy
+// terminated the encryption of the session.
+func (c ProcessedConn) Write(b []byte) (int, error) {
+	if c.encryption == nil {
+		return c.Conn.Write(b)
+	}
+	return c.encryption.writePacket(c.Conn.Conn, b)
+}
+
+// writePacket marshals the packet for the protocol version of the client
+// with the compression of the session and writes it to the client.
+func (c ProcessedConn) writePacket(pk protocol.Packet) error {
+	b, err := protocol.MarshalPacketFor(pk, c.compression, c.clientProtocol)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Write(b)
+	return err
 }
 
 func (c ProcessedConn) RemoteAddr() net.Addr {
@@ -37,25 +280,90 @@ func (c ProcessedConn) Username() string {
 	return c.username
 }
 
+func (c ProcessedConn) XUID() string {
+	return c.identityData.XUID
+}
+
+func (c ProcessedConn) UUID() string {
+	return c.identityData.Identity
+}
+
+func (c ProcessedConn) TitleID() string {
+	return c.identityData.TitleID
+}
+
+func (c ProcessedConn) DeviceOS() int {
+	return c.clientData.DeviceOS
+}
+
+func (c ProcessedConn) DeviceModel() string {
+	return c.clientData.DeviceModel
+}
+
+func (c ProcessedConn) GameVersion() string {
+	return c.clientData.GameVersion
+}
+
+func (c ProcessedConn) LanguageCode() string {
+	return c.clientData.LanguageCode
+}
+
+func (c ProcessedConn) InputMode() int {
+	return c.clientData.CurrentInputMode
+}
+
+func (c ProcessedConn) ClientRandomID() int64 {
+	return c.clientData.ClientRandomID
+}
+
 func (c ProcessedConn) ServerAddr() string {
 	return c.serverAddr
 }
 
+func (c ProcessedConn) Authenticated() bool {
+	return c.authenticated
+}
+
 func (c ProcessedConn) Disconnect(msg string) error {
 	defer c.Close()
 	pk := protocol.Disconnect{
 		HideDisconnectionScreen: msg == "",
 		Message:                 msg,
+		FilteredMessage:         msg,
 	}
+	return c.writePacket(&pk)
+}
 
-	b, err := protocol.MarshalPacket(&pk)
-	if err != nil {
-		return err
+// rejectPlayStatuses maps the reasons that clients are rejected
+// for to the play status of their native login failure
+var rejectPlayStatuses = map[bedprox.RejectReason]int32{
+	bedprox.RejectReasonOutdatedClient: protocol.PlayStatusLoginFailedClient,
+	bedprox.RejectReasonOutdatedServer: protocol.PlayStatusLoginFailedServer,
+	bedprox.RejectReasonServerFull:     protocol.PlayStatusLoginFailedServerFull,
+	bedprox.RejectReasonInvalidTenant:  protocol.PlayStatusLoginFailedInvalidTenant,
+	// The proxy serves servers of the vanilla edition, so a mismatched
+	// client is one of the Education Edition
+	bedprox.RejectReasonEditionMismatch: protocol.PlayStatusLoginFailedEduVanilla,
+}
+
+func (c ProcessedConn) Reject(reason bedprox.RejectReason) error {
+	defer c.Close()
+	status, ok := rejectPlayStatuses[reason]
+	if !ok {
+		return fmt.Errorf("no play status for reject reason %q", reason)
 	}
 
-	if _, err := c.Write(b); err != nil {
-		return err
+	pk := protocol.PlayStatus{
+		Status: status,
 	}
+	return c.writePacket(&pk)
+}
 
-	return nil
+func (c ProcessedConn) Transfer(host string, port uint16) error {
+	defer c.Close()
+	pk := protocol.Transfer{
+		Address: host,
+		Port:    port,
+	}
+	return c.writePacket(&pk)
 }
@@ -1,43 +1,80 @@
 package bedrock
 
 import (
-	"bufio"
-	"bytes"
 	"errors"
+	"fmt"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/haveachin/bedprox"
 	"github.com/haveachin/bedprox/bedrock/protocol"
 	"github.com/haveachin/bedprox/bedrock/protocol/login"
-	"github.com/pires/go-proxyproto"
 )
 
 // Processing Node
-type ConnProcessor struct{}
+type ConnProcessor struct {
+	// NetworkSettings are sent to clients that request them
+	// before they log in
+	NetworkSettings protocol.NetworkSettings
+	// ReadTimeout is the time that a client has to send its login
+	// after connecting. Zero means no timeout.
+	ReadTimeout time.Duration
+	// MaxLoginSize is the maximum size of the packets that a client
+	// sends before it is logged in, compressed and decompressed.
+	// Zero means no limit.
+	MaxLoginSize int
+}
 
 func (cp ConnProcessor) ProcessConn(c net.Conn) (bedprox.ProcessedConn, error) {
 	pc := ProcessedConn{
-		Conn:       c.(*Conn),
-		remoteAddr: c.RemoteAddr(),
+		Conn:        c.(*Conn),
+		remoteAddr:  c.RemoteAddr(),
+		compression: protocol.DefaultCompression,
 	}
 
-	if pc.proxyProtocol {
-		header, err := proxyproto.Read(bufio.NewReader(c))
-		if err != nil {
-			return nil, err
+	// The client has to log in before the earlier of the login deadline
+	// of the gateway and the read timeout of processing
+	deadline := pc.loginDeadline
+	if cp.ReadTimeout > 0 {
+		readDeadline := time.Now().Add(cp.ReadTimeout)
+		if deadline.IsZero() || readDeadline.Before(deadline) {
+			deadline = readDeadline
 		}
-		pc.remoteAddr = header.SourceAddr
+	}
+	if !deadline.IsZero() {
+		_ = pc.SetReadDeadline(deadline)
+		// The deadline only applies to processing and must not
+		// affect the tunnel that the connection is used in later
+		defer pc.SetReadDeadline(time.Time{})
 	}
 
-	b, err := pc.ReadPacket()
+	b, err := cp.readPacket(&pc)
 	if err != nil {
 		return nil, err
 	}
+
+	// Clients of protocol 554 and newer request the network settings
+	// with an uncompressed packet before they send the login
+	if req, ok := parseRequestNetworkSettings(b); ok {
+		if err := cp.negotiateNetworkSettings(&pc, req); err != nil {
+			return nil, err
+		}
+		pc.networkSettingsRequest = b
+
+		b, err = cp.readPacket(&pc)
+		if err != nil {
+			return nil, err
+		}
+	}
 	pc.readBytes = b
 
-	decoder := protocol.NewDecoder(bytes.NewReader(b))
-	pks, err := decoder.Decode()
+	decoder := protocol.NewDecoder(nil)
+	decoder.SetCompression(pc.compression)
+	if cp.MaxLoginSize > 0 {
+		decoder.SetMaxDecompressedSize(cp.MaxLoginSize)
+	}
+	pks, err := decoder.DecodeBatch(b)
 	if err != nil {
 		return nil, err
 	}
@@ -51,13 +88,38 @@ func (cp ConnProcessor) ProcessConn(c net.Conn) (bedprox.ProcessedConn, error) {
 		return nil, err
 	}
 
-	iData, cData, err := login.Parse(loginPk.ConnectionRequest)
+	iData, cData, authResult, err := login.Parse(loginPk.ConnectionRequest)
 	if err != nil {
 		return nil, err
 	}
+	if !authResult.XBOXLiveAuthenticated {
+		// The client signed its identity itself, so it could claim any of these
+		iData.XUID = ""
+		iData.Identity = ""
+		iData.TitleID = ""
+	}
 	pc.username = iData.DisplayName
+	pc.authenticated = authResult.XBOXLiveAuthenticated
+	pc.identityData = iData
+	pc.clientData = cData
+	pc.clientProtocol = loginPk.ClientProtocol
+	pc.connectionRequest = loginPk.ConnectionRequest
+	pc.publicKey = authResult.PublicKey
 	pc.serverAddr = cData.ServerAddress
 
+	if pc.realIP != nil {
+		host, addr, err := pc.realIP.Parse(pc.serverAddr, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		pc.serverAddr = host
+		pc.remoteAddr = addr
+
+		if pc.ipLimiter != nil && !pc.Conn.limit(pc.ipLimiter, addr) {
+			return nil, errIPLimitExceeded
+		}
+	}
+
 	if strings.Contains(pc.serverAddr, ":") {
 		pc.serverAddr, _, err = net.SplitHostPort(pc.serverAddr)
 		if err != nil {
@@ -67,3 +129,48 @@ func (cp ConnProcessor) ProcessConn(c net.Conn) (bedprox.ProcessedConn, error) {
 
 	return &pc, nil
 }
+
+// readPacket reads the next packet of a client that is not logged in yet
+func (cp ConnProcessor) readPacket(pc *ProcessedConn) ([]byte, error) {
+	b, err := pc.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	if cp.MaxLoginSize > 0 && len(b) > cp.MaxLoginSize {
+		return nil, fmt.Errorf("packet size %d exceeds the maximum login size of %d", len(b), cp.MaxLoginSize)
+	}
+	return b, nil
+}
+
+// parseRequestNetworkSettings reports if the batch b is an uncompressed
+// batch that holds only a RequestNetworkSettings packet
+func parseRequestNetworkSettings(b []byte) (protocol.RequestNetworkSettings, bool) {
+	var pk protocol.RequestNetworkSettings
+	decoder := protocol.NewDecoder(nil)
+	decoder.SetCompression(protocol.NoCompression)
+	pks, err := decoder.DecodeBatch(b)
+	if err != nil || len(pks) != 1 {
+		return pk, false
+	}
+
+	if err := protocol.UnmarshalPacket(pks[0], &pk); err != nil {
+		return pk, false
+	}
+	return pk, true
+}
+
+func (cp ConnProcessor) negotiateNetworkSettings(pc *ProcessedConn, req protocol.RequestNetworkSettings) error {
+	pk := cp.NetworkSettings
+	b, err := protocol.MarshalPacketWith(&pk, protocol.NoCompression)
+	if err != nil {
+		return err
+	}
+
+	if _, err := pc.Write(b); err != nil {
+		return err
+	}
+
+	pc.compression = protocol.NegotiatedCompression(req.ClientProtocol)
+	return nil
+}
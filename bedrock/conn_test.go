@@ -0,0 +1,354 @@
+package bedrock_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/haveachin/bedprox"
+	"github.com/haveachin/bedprox/bedrock"
+	"github.com/haveachin/bedprox/bedrock/protocol"
+	"github.com/sandertv/go-raknet"
+)
+
+// processConn connects a fake client of the protocol version to a listener
+// and returns the processed connection of the client and the client itself.
+func processConn(t *testing.T, clientProtocol int32) (bedprox.ProcessedConn, *peer) {
+	l, err := raknet.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	pcs := make(chan bedprox.ProcessedConn, 1)
+	errs := make(chan error, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			errs <- err
+			return
+		}
+
+		pc, err := bedrock.ConnProcessor{}.ProcessConn(&bedrock.Conn{Conn: c.(*raknet.Conn)})
+		if err != nil {
+			errs <- err
+			return
+		}
+		pcs <- pc
+	}()
+
+	rc, err := raknet.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rc.Close() })
+	client := logIn(t, rc, clientProtocol, newLoginRequest(t, newKey(t)))
+
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+		return nil, nil
+	case pc := <-pcs:
+		return pc, client
+	}
+}
+
+// logIn logs the fake client of the protocol version in over rc with the
+// connection request. Clients of protocol 554 and newer negotiate the
+// network settings first.
+func logIn(t *testing.T, rc *raknet.Conn, clientProtocol int32, connReq []byte) *peer {
+	client := peer{conn: rc, protocol: clientProtocol}
+	if clientProtocol >= 554 {
+		uncompressed := protocol.NoCompression
+		client.compression = &uncompressed
+		if err := client.writePacket(&protocol.RequestNetworkSettings{ClientProtocol: clientProtocol}); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.readPacket(&protocol.NetworkSettings{}); err != nil {
+			t.Fatal(err)
+		}
+		negotiated := protocol.NegotiatedCompression(clientProtocol)
+		client.compression = &negotiated
+	}
+
+	if err := client.writePacket(&protocol.Login{
+		ClientProtocol:    clientProtocol,
+		ConnectionRequest: connReq,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return &client
+}
+
+func TestProcessedConn_Transfer(t *testing.T) {
+	srv := bedrock.Server{
+		Mode: bedrock.ServerModeTransfer,
+		TransferTarget: bedprox.TransferTarget{
+			Host: "play.example.com",
+			Port: 19133,
+		},
+	}
+
+	for _, clientProtocol := range []int32{471, protocol.TransferReloadWorldProtocol} {
+		t.Run(fmt.Sprint(clientProtocol), func(t *testing.T) {
+			pc, client := processConn(t, clientProtocol)
+
+			target, ok := srv.GetTransferTarget()
+			if !ok {
+				t.Fatal("expected the server to transfer clients")
+			}
+			if err := pc.Transfer(target.Host, target.Port); err != nil {
+				t.Fatal(err)
+			}
+
+			var transfer protocol.Transfer
+			if err := client.readPacket(&transfer); err != nil {
+				t.Fatal(err)
+			}
+			if transfer.Address != "play.example.com" || transfer.Port != 19133 {
+				t.Errorf("expected transfer to play.example.com:19133; got %s:%d", transfer.Address, transfer.Port)
+			}
+		})
+	}
+}
+
+func TestProcessedConn_Disconnect(t *testing.T) {
+	tt := []struct {
+		clientProtocol  int32
+		filteredMessage string
+	}{
+		{
+			clientProtocol: 560,
+		},
+		{
+			clientProtocol: protocol.DisconnectReasonProtocol,
+		},
+		{
+			clientProtocol:  protocol.DisconnectFilteredMessageProtocol,
+			filteredMessage: "Goodbye",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(fmt.Sprint(tc.clientProtocol), func(t *testing.T) {
+			pc, client := processConn(t, tc.clientProtocol)
+			if err := pc.Disconnect("Goodbye"); err != nil {
+				t.Fatal(err)
+			}
+
+			var disconnect protocol.Disconnect
+			if err := client.readPacket(&disconnect); err != nil {
+				t.Fatal(err)
+			}
+			if disconnect.Message != "Goodbye" || disconnect.FilteredMessage != tc.filteredMessage {
+				t.Errorf("expected message %q filtered as %q; got %q filtered as %q",
+					"Goodbye", tc.filteredMessage, disconnect.Message, disconnect.FilteredMessage)
+			}
+		})
+	}
+}
+
+func TestProcessedConn_Reject(t *testing.T) {
+	tt := []struct {
+		reason bedprox.RejectReason
+		status int32
+	}{
+		{
+			reason: bedprox.RejectReasonOutdatedClient,
+			status: protocol.PlayStatusLoginFailedClient,
+		},
+		{
+			reason: bedprox.RejectReasonOutdatedServer,
+			status: protocol.PlayStatusLoginFailedServer,
+		},
+		{
+			reason: bedprox.RejectReasonServerFull,
+			status: protocol.PlayStatusLoginFailedServerFull,
+		},
+		{
+			reason: bedprox.RejectReasonInvalidTenant,
+			status: protocol.PlayStatusLoginFailedInvalidTenant,
+		},
+		{
+			reason: bedprox.RejectReasonEditionMismatch,
+			status: protocol.PlayStatusLoginFailedEduVanilla,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(string(tc.reason), func(t *testing.T) {
+			pc, client := processConn(t, 471)
+			if err := pc.Reject(tc.reason); err != nil {
+				t.Fatal(err)
+			}
+
+			var status protocol.PlayStatus
+			if err := client.readPacket(&status); err != nil {
+				t.Fatal(err)
+			}
+			if status.Status != tc.status {
+				t.Errorf("expected play status %d; got %d", tc.status, status.Status)
+			}
+		})
+	}
+}
+
+// silentBackend returns the address of a server that accepts connections,
+// but never answers them.
+func silentBackend(t *testing.T) string {
+	l, err := raknet.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The listener must only be closed once the connection was accepted,
+	// since go-raknet closes the channel of accepted connections unguarded
+	accepted := make(chan struct{})
+	go func() {
+		defer close(accepted)
+		if c, err := l.Accept(); err == nil {
+			go func() {
+				defer c.Close()
+				_, _ = c.Read(make([]byte, 1500))
+			}()
+		}
+	}()
+	t.Cleanup(func() {
+		select {
+		case <-accepted:
+		case <-time.After(time.Second):
+		}
+		l.Close()
+	})
+	return l.Addr().String()
+}
+
+func TestServer_ProcessConn_ProtocolVersion(t *testing.T) {
+	tt := []struct {
+		name           string
+		clientProtocol int32
+		reason         bedprox.RejectReason
+	}{
+		{
+			name:           "outdated client",
+			clientProtocol: 471,
+			reason:         bedprox.RejectReasonOutdatedClient,
+		},
+		{
+			name:           "outdated server",
+			clientProtocol: 712,
+			reason:         bedprox.RejectReasonOutdatedServer,
+		},
+	}
+
+	srv := bedrock.Server{
+		// The server is never dialed for clients that it rejects
+		Address:            "127.0.0.1:1",
+		MinProtocolVersion: 503,
+		MaxProtocolVersion: 594,
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			pc, _ := processConn(t, tc.clientProtocol)
+
+			_, err := srv.ProcessConn(pc, nil)
+			var rejectErr bedprox.RejectError
+			if !errors.As(err, &rejectErr) {
+				t.Fatalf("expected a reject error; got %v", err)
+			}
+			if rejectErr.Reason != tc.reason {
+				t.Errorf("expected reason %q; got %q", tc.reason, rejectErr.Reason)
+			}
+		})
+	}
+}
+
+func TestConnProcessor_ProcessConn_Unauthenticated(t *testing.T) {
+	// The login request of the client is signed by the client itself
+	pc, _ := processConn(t, 471)
+
+	if pc.Authenticated() {
+		t.Fatal("expected the player to be unauthenticated")
+	}
+	if pc.Username() != "Steve" {
+		t.Errorf("expected username Steve; got %q", pc.Username())
+	}
+	if pc.XUID() != "" || pc.UUID() != "" || pc.TitleID() != "" {
+		t.Errorf("expected no claimed XUID, UUID or title ID; got %q, %q and %q",
+			pc.XUID(), pc.UUID(), pc.TitleID())
+	}
+}
+
+func TestServer_ProcessConn_NetworkSettingsUnanswered(t *testing.T) {
+	srv := bedrock.Server{
+		// The backend never answers the network settings request
+		Address:            silentBackend(t),
+		DialTimeout:        100 * time.Millisecond,
+		DialTimeoutMessage: "Sorry {{username}}, but the server is currently unreachable",
+		Dialer:             raknet.Dialer{ErrorLog: log.New(ioutil.Discard, "", 0)},
+		Log:                logr.Discard(),
+	}
+
+	pc, client := processConn(t, 560)
+	if _, err := srv.ProcessConn(pc, nil); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	var pk protocol.Disconnect
+	if err := client.readPacket(&pk); err != nil {
+		t.Fatal(err)
+	}
+	if want := "Sorry Steve, but the server is currently unreachable"; pk.Message != want {
+		t.Errorf("expected message %q; got %q", want, pk.Message)
+	}
+}
+
+func TestConn_Watch(t *testing.T) {
+	c, client := processConn(t, 560)
+	pc := c.(*bedrock.ProcessedConn)
+	left := pc.Watch()
+
+	if err := client.writePacket(&protocol.SetLocalPlayerAsInitialised{}); err != nil {
+		t.Fatal(err)
+	}
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := pc.ReadPacket(); err != nil {
+		t.Fatalf("expected the packet that was read while watched; got %v", err)
+	}
+
+	select {
+	case <-left:
+		t.Fatal("expected the connection to be open")
+	default:
+	}
+
+	// Every read fails once the deadline passed, not only the first one
+	pc.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	for n := 0; n < 2; n++ {
+		if _, err := pc.ReadPacket(); !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expected read %d to exceed the deadline; got %v", n+1, err)
+		}
+	}
+
+	// Reads succeed again once the deadline was extended
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	if err := client.writePacket(&protocol.SetLocalPlayerAsInitialised{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.ReadPacket(); err != nil {
+		t.Fatalf("expected the packet that was sent after the deadline was reset; got %v", err)
+	}
+
+	client.conn.Close()
+	select {
+	case <-left:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the closed connection to be noticed")
+	}
+}
@@ -0,0 +1,81 @@
+package bedrock
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"io"
+	"sync"
+
+	"github.com/haveachin/bedprox/bedrock/protocol"
+	"github.com/sandertv/go-raknet"
+)
+
+// saltSize is the size of the salt that the proxy sends in its handshake.
+const saltSize = 16
+
+// encryption encrypts the batches that are written to and decrypts the
+// batches that are read from a raknet connection.
+type encryption struct {
+	// mu serializes encrypting and writing, so that the batches are
+	// sent in the order of their counters
+	mu  sync.Mutex
+	enc *protocol.Encryption
+}
+
+// packetReader reads whole packets of a connection
+type packetReader interface {
+	ReadPacket() ([]byte, error)
+}
+
+func newEncryption(key []byte) (*encryption, error) {
+	enc, err := protocol.NewEncryption(key)
+	if err != nil {
+		return nil, err
+	}
+	return &encryption{enc: enc}, nil
+}
+
+func (e *encryption) readPacket(c packetReader) ([]byte, error) {
+	b, err := c.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	return e.enc.Decrypt(b)
+}
+
+func (e *encryption) writePacket(c *raknet.Conn, b []byte) (int, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, err := c.Write(e.enc.Encrypt(b)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// readInto reads a batch with readPacket and copies it into b.
+func readInto(b []byte, readPacket func() ([]byte, error)) (int, error) {
+	pk, err := readPacket()
+	if err != nil {
+		return 0, err
+	}
+	if len(b) < len(pk) {
+		return 0, io.ErrShortBuffer
+	}
+	return copy(b, pk), nil
+}
+
+// newSessionKey generates the key that the proxy uses for the handshakes
+// of a session with the client and the server.
+func newSessionKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+}
+
+// newSalt returns a random salt for a handshake.
+func newSalt() ([]byte, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return salt, nil
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/go-logr/logr"
+	"github.com/haveachin/bedprox"
 	"github.com/sandertv/go-raknet"
 )
 
@@ -22,7 +23,7 @@ type PingStatus struct {
 	MOTD            string
 }
 
-func (p PingStatus) marshal(l *raknet.Listener) []byte {
+func (p PingStatus) marshal(l *raknet.Listener, port int) []byte {
 	motd := strings.Split(p.MOTD, "\n")
 	motd1 := motd[0]
 	motd2 := ""
@@ -30,28 +31,136 @@ func (p PingStatus) marshal(l *raknet.Listener) []byte {
 		motd2 = motd[1]
 	}
 
-	port := l.Addr().(*net.UDPAddr).Port
 	return []byte(fmt.Sprintf("%v;%v;%v;%v;%v;%v;%v;%v;%v;%v;%v;%v;",
 		p.Edition, motd1, p.ProtocolVersion, p.VersionName, p.PlayerCount, p.MaxPlayerCount,
 		l.ID(), motd2, p.GameMode, p.GameModeNumeric, port, port))
 }
 
+// relayIdleTimeout is the time after which the PROXY protocol relay
+// forgets clients that did not send or receive datagrams
+const relayIdleTimeout = time.Minute
+
 type Listener struct {
 	Bind                 string
 	ReceiveProxyProtocol bool
-	ReceiveRealIP        bool
-	PingStatus           PingStatus
+	// TrustedProxies are the networks that PROXY protocol headers
+	// are accepted from if ReceiveProxyProtocol is set
+	TrustedProxies []*net.IPNet
+	// ProxyProtocolMaxSessions is the number of clients that the relay of
+	// the PROXY protocol relays at once. Zero means no limit.
+	ProxyProtocolMaxSessions int
+	ReceiveRealIP            bool
+	// RealIP verifies the signed server addresses of the clients
+	// if ReceiveRealIP is set
+	RealIP     RealIP
+	PingStatus PingStatus
+	// QueryBind is the address that the query server of the
+	// listener binds to. The query server is disabled if empty.
+	QueryBind string
+	// IPLimit limits the connections of clients by their IP
+	IPLimit IPLimit
 
 	*raknet.Listener
+	// relay relays the datagrams of the Bind address to the RakNet
+	// listener if ReceiveProxyProtocol is set
+	relay *ProxyProtocolRelay
+	// addr is the public address that the listener is bound to
+	addr *net.UDPAddr
+	// ipLimiter enforces the IPLimit if it is enabled
+	ipLimiter *ipLimiter
+}
+
+// Rejections returns the number of connections that the IPLimit of
+// the listener rejected by the reason that they were rejected for.
+func (l *Listener) Rejections() map[string]uint64 {
+	if l.ipLimiter == nil {
+		return map[string]uint64{}
+	}
+	return l.ipLimiter.rejectionCounts()
+}
+
+// listen binds the listener. With the PROXY protocol, the RakNet listener only
+// listens on the loopback interface and a relay strips the headers of the
+// datagrams that are sent to the Bind address.
+func (l *Listener) listen(log logr.Logger) error {
+	if l.IPLimit.enabled() {
+		l.ipLimiter = newIPLimiter(l.IPLimit, log.WithValues("bind", l.Bind))
+	}
+
+	if !l.ReceiveProxyProtocol {
+		rl, err := raknet.Listen(l.Bind)
+		if err != nil {
+			return err
+		}
+		l.Listener = rl
+		l.addr = rl.Addr().(*net.UDPAddr)
+		return nil
+	}
+
+	conn, err := net.ListenPacket("udp", l.Bind)
+	if err != nil {
+		return err
+	}
+
+	rl, err := raknet.Listen("127.0.0.1:0")
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	l.Listener = rl
+	l.addr = conn.LocalAddr().(*net.UDPAddr)
+	l.relay = &ProxyProtocolRelay{
+		TrustedProxies: l.TrustedProxies,
+		Target:         rl.Addr().(*net.UDPAddr),
+		IdleTimeout:    relayIdleTimeout,
+		MaxSessions:    l.ProxyProtocolMaxSessions,
+		Log:            log,
+	}
+
+	go func() {
+		if err := l.relay.Serve(conn); err != nil {
+			log.Error(err, "PROXY protocol relay stopped",
+				"bind", l.Bind,
+			)
+		}
+		rl.Close()
+	}()
+	return nil
 }
 
 type Gateway struct {
-	ID                    string
-	Listeners             []Listener
-	ClientTimeout         time.Duration
+	ID        string
+	Listeners []Listener
+	// ClientTimeout is the time that a client has to log in after
+	// connecting, including the time it waits to be processed.
+	// Zero means no timeout.
+	ClientTimeout time.Duration
+	// IdleTimeout is the time after which tunnels without traffic
+	// in either direction are closed. Zero means no timeout.
+	IdleTimeout time.Duration
+	// TrafficLimit limits the traffic of each tunnel of the players
+	// of the gateway
+	TrafficLimit bedprox.TrafficLimit
+	// SharedTrafficLimit limits the traffic of all tunnels of the
+	// players of the gateway together
+	SharedTrafficLimit bedprox.TrafficLimit
+	// Capacity is the number of players that the gateway has room for
+	Capacity              bedprox.Capacity
 	ServerIDs             []string
 	Log                   logr.Logger
 	ServerNotFoundMessage string
+	UnauthenticatedPolicy bedprox.UnauthenticatedPolicy
+	// ServerNotFoundTransfer is the target that clients are transferred to
+	// if no server matches their address. They are disconnected with the
+	// ServerNotFoundMessage if its Host is empty.
+	ServerNotFoundTransfer bedprox.TransferTarget
+	// RejectionPolicies are how players are told the reason that they
+	// were rejected for. Reasons without a policy use the native
+	// login failure of the game.
+	RejectionPolicies map[bedprox.RejectReason]bedprox.RejectionPolicy
+
+	players bedprox.PlayerLister
 }
 
 func (gw Gateway) GetID() string {
@@ -66,36 +175,133 @@ func (gw Gateway) GetServerNotFoundMessage() string {
 	return gw.ServerNotFoundMessage
 }
 
+func (gw Gateway) GetServerNotFoundTransfer() (bedprox.TransferTarget, bool) {
+	return gw.ServerNotFoundTransfer, gw.ServerNotFoundTransfer.Host != ""
+}
+
+func (gw Gateway) GetRejectionPolicies() map[bedprox.RejectReason]bedprox.RejectionPolicy {
+	return gw.RejectionPolicies
+}
+
+func (gw Gateway) GetIdleTimeout() time.Duration {
+	return gw.IdleTimeout
+}
+
+func (gw Gateway) GetTrafficLimit() bedprox.TrafficLimit {
+	return gw.TrafficLimit
+}
+
+func (gw Gateway) GetSharedTrafficLimit() bedprox.TrafficLimit {
+	return gw.SharedTrafficLimit
+}
+
+func (gw Gateway) GetCapacity() bedprox.Capacity {
+	return gw.Capacity
+}
+
+func (gw Gateway) GetUnauthenticatedPolicy() bedprox.UnauthenticatedPolicy {
+	return gw.UnauthenticatedPolicy
+}
+
 func (gw *Gateway) SetLogger(log logr.Logger) {
 	gw.Log = log
 }
 
+func (gw *Gateway) SetPlayerLister(pl bedprox.PlayerLister) {
+	gw.players = pl
+}
+
 func (gw *Gateway) ListenAndServe(cpnChan chan<- net.Conn) error {
 	for n, listener := range gw.Listeners {
 		gw.Log.Info("start listener",
 			"bind", listener.Bind,
 		)
 
-		l, err := raknet.Listen(listener.Bind)
-		if err != nil {
+		l := &gw.Listeners[n]
+		if err := l.listen(gw.Log); err != nil {
 			return err
 		}
-		l.PongData(listener.PingStatus.marshal(l))
+		l.PongData(l.PingStatus.marshal(l.Listener, l.addr.Port))
 
-		gw.Listeners[n].Listener = l
+		if listener.QueryBind != "" {
+			go gw.serveQuery(gw.Listeners[n])
+		}
 	}
 
 	gw.listenAndServe(cpnChan)
 	return nil
 }
 
+func (gw *Gateway) serveQuery(l Listener) {
+	addr := l.addr
+	qs := QueryServer{
+		Bind:       l.QueryBind,
+		GatewayID:  gw.ID,
+		HostIP:     addr.IP.String(),
+		HostPort:   addr.Port,
+		PingStatus: l.PingStatus,
+		Players:    gw.players,
+		Log:        gw.Log,
+	}
+
+	gw.Log.Info("start query server",
+		"bind", l.QueryBind,
+	)
+
+	if err := qs.ListenAndServe(); err != nil {
+		gw.Log.Error(err, "query server stopped",
+			"bind", l.QueryBind,
+		)
+	}
+}
+
 func (gw Gateway) wrapConn(c net.Conn, l Listener) *Conn {
-	return &Conn{
-		Conn:          c.(*raknet.Conn),
-		gatewayID:     gw.ID,
-		proxyProtocol: l.ReceiveProxyProtocol,
-		realIP:        l.ReceiveRealIP,
+	conn := &Conn{
+		Conn:      c.(*raknet.Conn),
+		gatewayID: gw.ID,
+	}
+
+	if gw.ClientTimeout > 0 {
+		conn.loginDeadline = time.Now().Add(gw.ClientTimeout)
+	}
+
+	if l.ReceiveRealIP {
+		realIP := l.RealIP
+		conn.realIP = &realIP
+	}
+
+	if l.relay != nil {
+		if addr, ok := l.relay.ClientAddr(c.RemoteAddr()); ok {
+			conn.remoteAddr = addr
+		}
+		// The RakNet listener behind the relay is only internal
+		conn.localAddr = l.addr
+		if addr, ok := l.relay.DestinationAddr(c.RemoteAddr()); ok {
+			conn.localAddr = addr
+		}
+	}
+	return conn
+}
+
+// limit reports if the IP limit of the listener allows the connection and
+// closes it if not. Allowed connections release their session once closed.
+// Listeners that receive real IPs limit their clients once the real IP is
+// known instead.
+func (gw Gateway) limit(conn *Conn, l Listener) bool {
+	if l.ipLimiter == nil {
+		return true
+	}
+
+	if l.ReceiveRealIP {
+		conn.ipLimiter = l.ipLimiter
+		return true
 	}
+
+	if !conn.limit(l.ipLimiter, conn.RemoteAddr()) {
+		_ = conn.Conn.Close()
+		return false
+	}
+	return true
 }
 
 func (gw *Gateway) listenAndServe(cpnChan chan<- net.Conn) {
@@ -111,11 +317,16 @@ func (gw *Gateway) listenAndServe(cpnChan chan<- net.Conn) {
 					break
 				}
 
+				conn := gw.wrapConn(c, l)
+				if !gw.limit(conn, l) {
+					continue
+				}
+
 				gw.Log.Info("new connection",
-					"remoteAddress", c.RemoteAddr(),
+					"remoteAddress", conn.RemoteAddr(),
 				)
 
-				cpnChan <- gw.wrapConn(c, l)
+				cpnChan <- conn
 			}
 			wg.Done()
 		}()
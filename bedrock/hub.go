@@ -0,0 +1,796 @@
+package bedrock
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/haveachin/bedprox/bedrock/protocol"
+)
+
+const (
+	// SwitchCommand is the chat command that players use to switch to
+	// one of the switch servers of their server.
+	SwitchCommand = "/server"
+	// SwitchMessageIdentifier is the identifier of the script messages that servers
+	// send to switch a player to one of their switch servers. The data of the
+	// message is the ID of the server.
+	SwitchMessageIdentifier = "bedprox:transfer"
+
+	// dimensionChangeTimeout is the time that the client has to complete
+	// a dimension change while it switches servers
+	dimensionChangeTimeout = 5 * time.Second
+	// playerActionDimensionChangeDone is the action of the PlayerAction packet
+	// that the client sends once it completed a dimension change
+	playerActionDimensionChangeDone = 14
+	// protocolInt64WorldSeed is the first protocol with an int64 world seed
+	// in the StartGame packet
+	protocolInt64WorldSeed = 503
+	// protocolLoadingScreenID is the first protocol with an optional loading
+	// screen ID in the ChangeDimension packet
+	protocolLoadingScreenID = 712
+	// protocolAbilityData is the first protocol whose AddPlayer packet holds
+	// the unique ID of the player in its ability data instead of after the username
+	protocolAbilityData = 534
+	// protocolEntityProperties is the first protocol with entity properties
+	// in the AddPlayer packet
+	protocolEntityProperties = 557
+)
+
+// ErrSwitchInProgress is returned by Session.Switch if the session already switches servers.
+var ErrSwitchInProgress = errors.New("session is already switching servers")
+
+// runtimeIDPackets are the packets that start with the runtime ID of an entity. The
+// runtime ID of the player differs between servers, so it is translated in these
+// packets once the player switched servers. The client keeps the runtime ID that
+// the first server assigned.
+var runtimeIDPackets = map[uint32]bool{
+	protocol.IDMoveActorAbsolute:           true,
+	protocol.IDMovePlayer:                  true,
+	protocol.IDActorEvent:                  true,
+	protocol.IDMobEffect:                   true,
+	protocol.IDUpdateAttributes:            true,
+	protocol.IDMobEquipment:                true,
+	protocol.IDMobArmourEquipment:          true,
+	protocol.IDPlayerAction:                true,
+	protocol.IDSetActorData:                true,
+	protocol.IDSetActorMotion:              true,
+	protocol.IDMoveActorDelta:              true,
+	protocol.IDSetLocalPlayerAsInitialised: true,
+}
+
+// entityPackets are the packets that add an entity and start with its unique ID.
+// The entities are removed from the client when the player switches servers, like
+// the players that AddPlayer packets add.
+var entityPackets = map[uint32]bool{
+	protocol.IDAddActor:     true,
+	protocol.IDAddItemActor: true,
+	protocol.IDAddPainting:  true,
+}
+
+// playerState is the state of the player in a Session that is needed to
+// switch servers.
+type playerState struct {
+	// spawned is true once the first server started the game
+	spawned bool
+	// runtimeID is the runtime ID that the first server assigned to the
+	// player, which the client keeps
+	runtimeID uint64
+	// serverRuntimeID is the runtime ID of the player on the current server
+	serverRuntimeID uint64
+	// chunkRadius is the last RequestChunkRadius packet of the client, which
+	// is replayed to the servers that the player switches to
+	chunkRadius []byte
+	// entities holds the unique IDs of the entities that the client knows of
+	entities map[int64]struct{}
+	// awaitSpawn is true until the server that the player switched to spawned it
+	awaitSpawn bool
+	// dimensionChanges is the number of completed dimension changes of the
+	// client that the proxy caused and that are not relayed to the server
+	dimensionChanges int
+	// dimensionChangeDone receives when the client completed a dimension change
+	dimensionChangeDone chan struct{}
+}
+
+// startGame holds the fields of a StartGame packet that are needed to
+// spawn a player that switched servers.
+type startGame struct {
+	runtimeID uint64
+	gameMode  int32
+	position  [3]float32
+	dimension int32
+}
+
+// parseStartGame reads the leading fields of the StartGame packet, which is
+// otherwise too large and too version dependent to be decoded as a whole.
+func parseStartGame(pk []byte, clientProtocol int32) (startGame, error) {
+	var sg startGame
+	r := protocol.NewReader(bytes.NewBuffer(pk))
+
+	var header protocol.Header
+	if err := header.Read(r); err != nil {
+		return sg, err
+	}
+	if header.PacketID != protocol.IDStartGame {
+		return sg, fmt.Errorf("invalid id: 0x%x", header.PacketID)
+	}
+
+	var uniqueID int64
+	var rotation [2]float32
+	var biomeType int16
+	var biomeName string
+	if err := r.Varint64(&uniqueID); err != nil {
+		return sg, err
+	}
+	if err := r.Varuint64(&sg.runtimeID); err != nil {
+		return sg, err
+	}
+	if err := r.Varint32(&sg.gameMode); err != nil {
+		return sg, err
+	}
+	if err := r.Vec3(&sg.position); err != nil {
+		return sg, err
+	}
+	if err := r.Float32(&rotation[0]); err != nil {
+		return sg, err
+	}
+	if err := r.Float32(&rotation[1]); err != nil {
+		return sg, err
+	}
+	if clientProtocol >= protocolInt64WorldSeed {
+		var seed int64
+		if err := r.Int64(&seed); err != nil {
+			return sg, err
+		}
+	} else {
+		var seed int32
+		if err := r.Varint32(&seed); err != nil {
+			return sg, err
+		}
+	}
+	if err := r.Int16(&biomeType); err != nil {
+		return sg, err
+	}
+	if err := r.String(&biomeName); err != nil {
+		return sg, err
+	}
+	if err := r.Varint32(&sg.dimension); err != nil {
+		return sg, err
+	}
+	return sg, nil
+}
+
+// packetHeader reads the ID of the packet and returns the size of its header.
+func packetHeader(pk []byte) (uint32, int, error) {
+	buf := bytes.NewBuffer(pk)
+	var header protocol.Header
+	if err := header.Read(buf); err != nil {
+		return 0, 0, err
+	}
+	return header.PacketID, len(pk) - buf.Len(), nil
+}
+
+// translateRuntimeID replaces the leading runtime ID of the packet if it is from.
+func translateRuntimeID(pk []byte, headerSize int, from, to uint64) ([]byte, bool) {
+	buf := bytes.NewBuffer(pk[headerSize:])
+	var id uint64
+	if err := protocol.NewReader(buf).Varuint64(&id); err != nil || id != from {
+		return pk, false
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(pk)))
+	out.Write(pk[:headerSize])
+	w := protocol.NewWriter(out)
+	w.Varuint64(to)
+	w.Bytes(buf.Bytes())
+	return out.Bytes(), true
+}
+
+// readLeadingVarint64 reads the zigzag encoded int64 that follows the header of the packet.
+func readLeadingVarint64(pk []byte, headerSize int) (int64, error) {
+	var x int64
+	err := protocol.NewReader(bytes.NewBuffer(pk[headerSize:])).Varint64(&x)
+	return x, err
+}
+
+// readAddPlayer reads the unique ID of the player that an AddPlayer packet adds. Since
+// protocolAbilityData, it follows the held item and the metadata of the player, which
+// are skipped without being decoded.
+func readAddPlayer(pk []byte, headerSize int, clientProtocol int32) (int64, error) {
+	r := protocol.NewReader(bytes.NewBuffer(pk[headerSize:]))
+	var uuid protocol.UUID
+	var username string
+	var uniqueID int64
+	if err := r.UUID(&uuid); err != nil {
+		return 0, err
+	}
+	if err := r.String(&username); err != nil {
+		return 0, err
+	}
+	if clientProtocol < protocolAbilityData {
+		err := r.Varint64(&uniqueID)
+		return uniqueID, err
+	}
+
+	var runtimeID uint64
+	var platformChatID string
+	var position, velocity [3]float32
+	// The pitch, yaw and head yaw of the player
+	var rotation [3]float32
+	var gameType int32
+	if err := r.Varuint64(&runtimeID); err != nil {
+		return 0, err
+	}
+	if err := r.String(&platformChatID); err != nil {
+		return 0, err
+	}
+	if err := r.Vec3(&position); err != nil {
+		return 0, err
+	}
+	if err := r.Vec3(&velocity); err != nil {
+		return 0, err
+	}
+	if err := r.Vec3(&rotation); err != nil {
+		return 0, err
+	}
+	if err := skipItemInstance(r); err != nil {
+		return 0, err
+	}
+	if err := r.Varint32(&gameType); err != nil {
+		return 0, err
+	}
+	if err := skipEntityMetadata(r); err != nil {
+		return 0, err
+	}
+	if clientProtocol >= protocolEntityProperties {
+		if err := skipEntityProperties(r); err != nil {
+			return 0, err
+		}
+	}
+	err := r.Int64(&uniqueID)
+	return uniqueID, err
+}
+
+// skipItemInstance reads an item instance, like the held item of a player.
+func skipItemInstance(r *protocol.Reader) error {
+	var networkID int32
+	if err := r.Varint32(&networkID); err != nil {
+		return err
+	}
+	// Air has no further fields
+	if networkID == 0 {
+		return nil
+	}
+
+	var count uint16
+	var metadata uint32
+	var hasStackID bool
+	var stackID, blockRuntimeID int32
+	var extraData []byte
+	if err := r.Uint16(&count); err != nil {
+		return err
+	}
+	if err := r.Varuint32(&metadata); err != nil {
+		return err
+	}
+	if err := r.Bool(&hasStackID); err != nil {
+		return err
+	}
+	if hasStackID {
+		if err := r.Varint32(&stackID); err != nil {
+			return err
+		}
+	}
+	if err := r.Varint32(&blockRuntimeID); err != nil {
+		return err
+	}
+	return r.ByteSlice(&extraData)
+}
+
+// skipEntityMetadata reads the metadata of an entity. Metadata with NBT values
+// can not be skipped without decoding the NBT, so it fails.
+func skipEntityMetadata(r *protocol.Reader) error {
+	var count uint32
+	if err := r.Varuint32(&count); err != nil {
+		return err
+	}
+
+	for n := uint32(0); n < count; n++ {
+		var key, valueType uint32
+		if err := r.Varuint32(&key); err != nil {
+			return err
+		}
+		if err := r.Varuint32(&valueType); err != nil {
+			return err
+		}
+
+		var err error
+		switch valueType {
+		case 0:
+			var x uint8
+			err = r.Uint8(&x)
+		case 1:
+			var x int16
+			err = r.Int16(&x)
+		case 2:
+			var x int32
+			err = r.Varint32(&x)
+		case 3:
+			var x float32
+			err = r.Float32(&x)
+		case 4:
+			var x string
+			err = r.String(&x)
+		case 6:
+			var x [3]int32
+			for i := range x {
+				if err = r.Varint32(&x[i]); err != nil {
+					break
+				}
+			}
+		case 7:
+			var x int64
+			err = r.Varint64(&x)
+		case 8:
+			var x [3]float32
+			err = r.Vec3(&x)
+		default:
+			err = fmt.Errorf("unsupported entity metadata type %d", valueType)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipEntityProperties reads the integer and float properties of an entity.
+func skipEntityProperties(r *protocol.Reader) error {
+	var count uint32
+	if err := r.Varuint32(&count); err != nil {
+		return err
+	}
+	for n := uint32(0); n < count; n++ {
+		var index uint32
+		var value int32
+		if err := r.Varuint32(&index); err != nil {
+			return err
+		}
+		if err := r.Varint32(&value); err != nil {
+			return err
+		}
+	}
+
+	if err := r.Varuint32(&count); err != nil {
+		return err
+	}
+	for n := uint32(0); n < count; n++ {
+		var index uint32
+		var value float32
+		if err := r.Varuint32(&index); err != nil {
+			return err
+		}
+		if err := r.Float32(&value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readPlayerAction reads the action of a PlayerAction packet.
+func readPlayerAction(pk []byte, headerSize int) (int32, error) {
+	r := protocol.NewReader(bytes.NewBuffer(pk[headerSize:]))
+	var runtimeID uint64
+	var action int32
+	if err := r.Varuint64(&runtimeID); err != nil {
+		return 0, err
+	}
+	err := r.Varint32(&action)
+	return action, err
+}
+
+// readCommandLine reads the command line of a CommandRequest packet.
+func readCommandLine(pk []byte, headerSize int) (string, error) {
+	var line string
+	err := protocol.NewReader(bytes.NewBuffer(pk[headerSize:])).String(&line)
+	return line, err
+}
+
+// handleServerPacket handles a packet that the server of sc sent to the client.
+func (s *Session) handleServerPacket(sc *serverConn, pk []byte) ([]byte, bool) {
+	id, headerSize, err := packetHeader(pk)
+	if err != nil {
+		// Packets that can not be read are relayed as they are
+		return pk, false
+	}
+
+	switch {
+	case id == protocol.IDStartGame:
+		s.startGame(sc, pk)
+	case id == protocol.IDPlayStatus:
+		s.playStatus(sc, pk)
+	case id == protocol.IDRemoveActor:
+		if uniqueID, err := readLeadingVarint64(pk, headerSize); err == nil {
+			s.mu.Lock()
+			delete(s.player.entities, uniqueID)
+			s.mu.Unlock()
+		}
+	case entityPackets[id]:
+		if uniqueID, err := readLeadingVarint64(pk, headerSize); err == nil {
+			s.addEntity(uniqueID)
+		}
+	case id == protocol.IDAddPlayer:
+		if uniqueID, err := readAddPlayer(pk, headerSize, s.client.clientProtocol); err == nil {
+			s.addEntity(uniqueID)
+		}
+	case id == protocol.IDScriptMessage:
+		var msg protocol.ScriptMessage
+		if err := protocol.UnmarshalPacket(pk, &msg); err == nil && msg.Identifier == SwitchMessageIdentifier {
+			go s.switchTo(sc, string(msg.Data))
+			return nil, true
+		}
+	}
+
+	var changed bool
+	if runtimeIDPackets[id] {
+		s.mu.Lock()
+		from, to := s.player.serverRuntimeID, s.player.runtimeID
+		s.mu.Unlock()
+		if from != to {
+			pk, changed = translateRuntimeID(pk, headerSize, from, to)
+		}
+	}
+
+	if !s.runHandlers(id, pk, sc.server.ServerPacketHandlers) {
+		return nil, true
+	}
+	return pk, changed
+}
+
+// handleClientPacket handles a packet that the client sent to the server of sc.
+func (s *Session) handleClientPacket(sc *serverConn, pk []byte) ([]byte, bool) {
+	id, headerSize, err := packetHeader(pk)
+	if err != nil {
+		return pk, false
+	}
+
+	switch id {
+	case protocol.IDRequestChunkRadius:
+		s.mu.Lock()
+		s.player.chunkRadius = append([]byte(nil), pk...)
+		s.mu.Unlock()
+	case protocol.IDPlayerAction:
+		action, err := readPlayerAction(pk, headerSize)
+		if err == nil && action == playerActionDimensionChangeDone && s.dimensionChangeDone() {
+			return nil, true
+		}
+	case protocol.IDCommandRequest:
+		line, err := readCommandLine(pk, headerSize)
+		if err == nil && len(sc.server.SwitchServers) > 0 && strings.HasPrefix(line, SwitchCommand+" ") {
+			go s.switchTo(sc, strings.TrimSpace(strings.TrimPrefix(line, SwitchCommand)))
+			return nil, true
+		}
+	}
+
+	var changed bool
+	if runtimeIDPackets[id] {
+		s.mu.Lock()
+		from, to := s.player.runtimeID, s.player.serverRuntimeID
+		s.mu.Unlock()
+		if from != to {
+			pk, changed = translateRuntimeID(pk, headerSize, from, to)
+		}
+	}
+
+	if !s.runHandlers(id, pk, sc.server.ClientPacketHandlers) {
+		return nil, true
+	}
+	return pk, changed
+}
+
+// addEntity records an entity that the server of the session added to the client.
+func (s *Session) addEntity(uniqueID int64) {
+	s.mu.Lock()
+	s.player.entities[uniqueID] = struct{}{}
+	s.mu.Unlock()
+}
+
+// startGame keeps the runtime ID of the player that the first server assigned.
+func (s *Session) startGame(sc *serverConn, pk []byte) {
+	sg, err := parseStartGame(pk, s.client.clientProtocol)
+	if err != nil {
+		sc.server.Log.Error(err, "failed to parse start game")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.player.spawned {
+		return
+	}
+	s.player.spawned = true
+	s.player.runtimeID = sg.runtimeID
+	s.player.serverRuntimeID = sg.runtimeID
+}
+
+// playStatus completes the spawn of a player that switched to the server of sc,
+// in place of the client that is already initialised.
+func (s *Session) playStatus(sc *serverConn, pk []byte) {
+	var status protocol.PlayStatus
+	if err := protocol.UnmarshalPacket(pk, &status); err != nil || status.Status != protocol.PlayStatusPlayerSpawn {
+		return
+	}
+
+	s.mu.Lock()
+	awaitSpawn := s.player.awaitSpawn
+	s.player.awaitSpawn = false
+	runtimeID := s.player.serverRuntimeID
+	s.mu.Unlock()
+
+	if !awaitSpawn {
+		return
+	}
+	if err := writePacketTo(sc, &protocol.SetLocalPlayerAsInitialised{EntityRuntimeID: runtimeID}, s.client.compression); err != nil {
+		sc.server.Log.Error(err, "failed to initialise player")
+	}
+}
+
+// dimensionChangeDone reports if the completed dimension change of the client
+// was caused by the proxy.
+func (s *Session) dimensionChangeDone() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.player.dimensionChanges == 0 {
+		return false
+	}
+	s.player.dimensionChanges--
+
+	select {
+	case s.player.dimensionChangeDone <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// switchTo switches the session to the switch server with the ID passed, as
+// requested by the player or the server of sc.
+func (s *Session) switchTo(sc *serverConn, id string) {
+	log := sc.server.Log.WithValues("username", s.client.username, "serverID", id)
+	srv, ok := sc.server.SwitchServers[id]
+	if !ok {
+		log.Info("switch server not found")
+		return
+	}
+
+	log.Info("switching server")
+	if err := s.Switch(srv); err != nil {
+		log.Error(err, "failed to switch server")
+	}
+}
+
+// SwitchServer switches the session to the switch server of its current server
+// with the ID passed. It implements bedprox.ServerSwitcher, so that sessions can
+// be switched through the bedprox.ConnPool.
+func (s *Session) SwitchServer(id string) error {
+	srv, ok := s.Server().SwitchServers[id]
+	if !ok {
+		return fmt.Errorf("switch server %q not found", id)
+	}
+	return s.Switch(srv)
+}
+
+// Switch moves the player to the server passed without disconnecting the client. The proxy
+// logs in to the server with the session of the player and completes the spawn in place of
+// the client. The world of the client is then reset with two dimension changes, before the
+// packets of the new server are relayed. The player stays on the current server if the
+// login to the new server fails.
+//
+// The new server has to accept players that are not signed in to XBOX Live, like every
+// server of a terminated session.
+func (s *Session) Switch(srv *Server) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errors.New("session is closed")
+	}
+	if s.switching {
+		s.mu.Unlock()
+		return ErrSwitchInProgress
+	}
+	if !s.player.spawned {
+		s.mu.Unlock()
+		return errors.New("player has not spawned yet")
+	}
+	s.switching = true
+	chunkRadius := s.player.chunkRadius
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.switching = false
+		s.mu.Unlock()
+	}()
+
+	sc, sg, err := s.connect(srv, chunkRadius)
+	if err != nil {
+		return err
+	}
+
+	paused := make(chan struct{})
+	done := make(chan struct{}, 1)
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		sc.Close()
+		return errors.New("session is closed")
+	}
+	old := s.server
+	s.server = sc
+	s.paused = paused
+	entities := s.player.entities
+	s.player.entities = map[int64]struct{}{}
+	s.player.dimensionChanges = 2
+	s.player.dimensionChangeDone = done
+	s.mu.Unlock()
+	old.Close()
+
+	err = s.resetClient(sg, entities, done)
+
+	s.mu.Lock()
+	s.player.serverRuntimeID = sg.runtimeID
+	s.player.awaitSpawn = true
+	s.paused = nil
+	s.mu.Unlock()
+	close(paused)
+	return err
+}
+
+// connect logs in to the server and completes the login sequence up to the
+// StartGame packet in place of the client.
+func (s *Session) connect(srv *Server, chunkRadius []byte) (*serverConn, startGame, error) {
+	rc, err := srv.Dial(s.client)
+	if err != nil {
+		return nil, startGame{}, err
+	}
+
+	if s.client.networkSettingsRequest != nil {
+		if err := srv.requestNetworkSettings(rc, s.client.networkSettingsRequest); err != nil {
+			rc.Close()
+			return nil, startGame{}, err
+		}
+	}
+
+	sc, err := srv.login(rc, s.client, s.key)
+	if err != nil {
+		rc.Close()
+		return nil, startGame{}, err
+	}
+
+	sg, err := srv.startGame(sc, s.client, chunkRadius)
+	if err != nil {
+		rc.Close()
+		return nil, startGame{}, err
+	}
+	return sc, sg, nil
+}
+
+// startGame completes the login sequence with the server up to the StartGame packet.
+// The resource packs of the server are accepted, since the client is already in game.
+func (s *Server) startGame(sc *serverConn, pc *ProcessedConn, chunkRadius []byte) (startGame, error) {
+	for {
+		_, pks, err := readLoginBatch(sc.readPacket, sc.Conn, pc.compression, s.DialTimeout)
+		if err != nil {
+			return startGame{}, err
+		}
+
+		for n, pk := range pks {
+			id, _, err := packetHeader(pk)
+			if err != nil {
+				return startGame{}, err
+			}
+
+			switch id {
+			case protocol.IDResourcePacksInfo:
+				err = writePacketTo(sc, &protocol.ResourcePackClientResponse{
+					Response: protocol.PackResponseAllPacksDownloaded,
+				}, pc.compression)
+			case protocol.IDResourcePackStack:
+				err = writePacketTo(sc, &protocol.ResourcePackClientResponse{
+					Response: protocol.PackResponseCompleted,
+				}, pc.compression)
+			case protocol.IDPlayStatus:
+				var status protocol.PlayStatus
+				if err = protocol.UnmarshalPacket(pk, &status); err == nil && status.Status != protocol.PlayStatusLoginSuccess {
+					err = fmt.Errorf("login failed with play status %d", status.Status)
+				}
+			case protocol.IDDisconnect:
+				var disconnect protocol.Disconnect
+				if err = protocol.UnmarshalPacketFor(pk, &disconnect, pc.clientProtocol); err == nil {
+					err = fmt.Errorf("disconnected by server: %s", disconnect.Message)
+				}
+			case protocol.IDStartGame:
+				return s.started(sc, pc, pks[n+1:], pk, chunkRadius)
+			}
+			if err != nil {
+				return startGame{}, err
+			}
+		}
+	}
+}
+
+// started handles the StartGame packet of a server that the player switches to.
+// The packets that followed it in its batch are kept to be relayed.
+func (s *Server) started(sc *serverConn, pc *ProcessedConn, rest [][]byte, pk, chunkRadius []byte) (startGame, error) {
+	sg, err := parseStartGame(pk, pc.clientProtocol)
+	if err != nil {
+		return startGame{}, err
+	}
+
+	if len(rest) > 0 {
+		b, err := encodeBatch(pc.compression, rest...)
+		if err != nil {
+			return startGame{}, err
+		}
+		sc.pending = append(sc.pending, b)
+	}
+
+	if chunkRadius != nil {
+		b, err := encodeBatch(pc.compression, chunkRadius)
+		if err != nil {
+			return startGame{}, err
+		}
+		if _, err := sc.writePacket(b); err != nil {
+			return startGame{}, err
+		}
+	}
+	return sg, nil
+}
+
+// resetClient removes the entities of the previous server from the client and moves it
+// through a temporary dimension into the dimension of the new server, so that the client
+// drops the world of the previous server.
+func (s *Session) resetClient(sg startGame, entities map[int64]struct{}, done <-chan struct{}) error {
+	for id := range entities {
+		if err := s.WritePacketToClient(&protocol.RemoveActor{EntityUniqueID: id}); err != nil {
+			return err
+		}
+	}
+
+	if err := s.WritePacketToClient(&protocol.SetPlayerGameType{GameType: sg.gameMode}); err != nil {
+		return err
+	}
+
+	tmp := protocol.DimensionNether
+	if sg.dimension == protocol.DimensionNether {
+		tmp = protocol.DimensionOverworld
+	}
+	if err := s.changeDimension(tmp, sg.position); err != nil {
+		return err
+	}
+	if err := s.WritePacketToClient(&protocol.PlayStatus{Status: protocol.PlayStatusPlayerSpawn}); err != nil {
+		return err
+	}
+
+	select {
+	case <-done:
+	case <-s.done:
+		return errors.New("session is closed")
+	case <-time.After(dimensionChangeTimeout):
+	}
+
+	return s.changeDimension(sg.dimension, sg.position)
+}
+
+func (s *Session) changeDimension(dimension int32, position [3]float32) error {
+	pk := protocol.ChangeDimension{
+		Dimension: dimension,
+		Position:  position,
+	}
+	if s.client.clientProtocol >= protocolLoadingScreenID {
+		var id uint32
+		pk.LoadingScreenID = &id
+	}
+	return s.WritePacketToClient(&pk)
+}
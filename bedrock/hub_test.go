@@ -0,0 +1,545 @@
+package bedrock_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/haveachin/bedprox"
+	"github.com/haveachin/bedprox/bedrock"
+	"github.com/haveachin/bedprox/bedrock/protocol"
+	"github.com/sandertv/go-raknet"
+)
+
+const (
+	lobbyRuntimeID    = 1
+	survivalRuntimeID = 7
+	entityID          = 42
+	// playerUniqueID is the unique ID of the other player on the lobby, which
+	// differs from its runtime ID like on vanilla servers
+	playerUniqueID  = -12884901887
+	playerRuntimeID = 9
+)
+
+var survivalSpawn = [3]float32{1, 2, 3}
+
+// packet returns a packet with the ID passed, whose payload is written by write.
+func packet(id uint32, write func(w *protocol.Writer)) []byte {
+	buf := bytes.Buffer{}
+	w := protocol.NewWriter(&buf)
+	header := protocol.Header{PacketID: id}
+	_ = header.Write(w)
+	write(w)
+	return buf.Bytes()
+}
+
+// startGamePacket returns a StartGame packet of the protocol passed, of which the
+// proxy only reads the leading fields.
+func startGamePacket(clientProtocol int32, runtimeID uint64, position [3]float32) []byte {
+	return packet(protocol.IDStartGame, func(w *protocol.Writer) {
+		w.Varint64(int64(runtimeID))
+		w.Varuint64(runtimeID)
+		w.Varint32(1)
+		w.Vec3(position)
+		w.Float32(0)
+		w.Float32(0)
+		if clientProtocol >= 503 {
+			w.Int64(1234)
+		} else {
+			w.Varint32(1234)
+		}
+		w.Int16(0)
+		w.String("")
+		w.Varint32(protocol.DimensionOverworld)
+		w.Bytes([]byte("world settings"))
+	})
+}
+
+// addPlayerPacket returns an AddPlayer packet of the protocol passed for the other
+// player on the lobby. Since protocol 534, its unique ID follows the held item and
+// the metadata of the player.
+func addPlayerPacket(clientProtocol int32) []byte {
+	return packet(protocol.IDAddPlayer, func(w *protocol.Writer) {
+		w.UUID(protocol.UUID{1, 2, 3})
+		w.String("Alex")
+		if clientProtocol < 534 {
+			w.Varint64(playerUniqueID)
+			w.Varuint64(playerRuntimeID)
+			w.Bytes([]byte("player"))
+			return
+		}
+
+		w.Varuint64(playerRuntimeID)
+		w.String("")
+		w.Vec3([3]float32{4, 5, 6})
+		w.Vec3([3]float32{})
+		w.Float32(0)
+		w.Float32(90)
+		w.Float32(90)
+		// A held item with a stack network ID
+		w.Varint32(5)
+		w.Uint16(1)
+		w.Varuint32(0)
+		w.Bool(true)
+		w.Varint32(1)
+		w.Varint32(0)
+		w.ByteSlice([]byte("nbt"))
+		w.Varint32(0)
+		// The flags, name tag and scale of the player
+		w.Varuint32(3)
+		w.Varuint32(0)
+		w.Varuint32(7)
+		w.Varint64(1 << 48)
+		w.Varuint32(4)
+		w.Varuint32(4)
+		w.String("Alex")
+		w.Varuint32(38)
+		w.Varuint32(3)
+		w.Float32(1)
+		if clientProtocol >= 557 {
+			w.Varuint32(1)
+			w.Varuint32(0)
+			w.Varint32(1)
+			w.Varuint32(0)
+		}
+		w.Int64(playerUniqueID)
+		w.Bytes([]byte("abilities and links"))
+	})
+}
+
+func runtimeIDPacket(id uint32, runtimeID uint64, payload string) []byte {
+	return packet(id, func(w *protocol.Writer) {
+		w.Varuint64(runtimeID)
+		w.Bytes([]byte(payload))
+	})
+}
+
+func playerAction(runtimeID uint64, action int32) []byte {
+	return packet(protocol.IDPlayerAction, func(w *protocol.Writer) {
+		w.Varuint64(runtimeID)
+		w.Varint32(action)
+		w.Bytes([]byte("block position and face"))
+	})
+}
+
+var chunkRadius = packet(protocol.IDRequestChunkRadius, func(w *protocol.Writer) {
+	w.Varint32(8)
+})
+
+// lobby spawns the player and calls onChunkRadius, if it is set, for each chunk
+// radius request of the player.
+func lobby(l *raknet.Listener, onChunkRadius func(p *peer) error) error {
+	p, err := acceptPlayer(l)
+	if err != nil {
+		return err
+	}
+	defer p.conn.Close()
+
+	if err := p.writePacket(&protocol.PlayStatus{Status: protocol.PlayStatusLoginSuccess}); err != nil {
+		return err
+	}
+	if err := p.write(startGamePacket(p.protocol, lobbyRuntimeID, [3]float32{})); err != nil {
+		return err
+	}
+	if err := p.write(packet(protocol.IDAddActor, func(w *protocol.Writer) {
+		w.Varint64(entityID)
+		w.Varuint64(entityID)
+	})); err != nil {
+		return err
+	}
+	if err := p.write(addPlayerPacket(p.protocol)); err != nil {
+		return err
+	}
+
+	for {
+		pks, err := p.read()
+		if err != nil {
+			// The proxy closes the connection once the player switched
+			return nil
+		}
+		if !bytes.Equal(pks[0], chunkRadius) || onChunkRadius == nil {
+			continue
+		}
+		if err := onChunkRadius(p); err != nil {
+			return err
+		}
+	}
+}
+
+// sendSwitchMessage switches the player to the survival server with a script message.
+func sendSwitchMessage(p *peer) error {
+	return p.writePacket(&protocol.ScriptMessage{
+		Identifier: bedrock.SwitchMessageIdentifier,
+		Data:       []byte("survival"),
+	})
+}
+
+// survival logs the player in without the client, like the proxy does when switching
+// servers, and sends the batches that it receives after the spawn to received.
+func survival(l *raknet.Listener, received chan<- [][]byte) error {
+	p, err := acceptPlayer(l)
+	if err != nil {
+		return err
+	}
+	defer p.conn.Close()
+
+	if err := p.writePacket(&protocol.PlayStatus{Status: protocol.PlayStatusLoginSuccess}); err != nil {
+		return err
+	}
+
+	for _, step := range []struct {
+		id       uint32
+		response byte
+	}{
+		{id: protocol.IDResourcePacksInfo, response: protocol.PackResponseAllPacksDownloaded},
+		{id: protocol.IDResourcePackStack, response: protocol.PackResponseCompleted},
+	} {
+		if err := p.write(packet(step.id, func(w *protocol.Writer) {
+			w.Bytes([]byte("packs"))
+		})); err != nil {
+			return err
+		}
+
+		var response protocol.ResourcePackClientResponse
+		if err := p.readPacket(&response); err != nil {
+			return err
+		}
+		if response.Response != step.response {
+			return fmt.Errorf("expected resource pack response %d; got %d", step.response, response.Response)
+		}
+	}
+
+	if err := p.write(startGamePacket(p.protocol, survivalRuntimeID, survivalSpawn)); err != nil {
+		return err
+	}
+
+	pks, err := p.read()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(pks[0], chunkRadius) {
+		return fmt.Errorf("expected the chunk radius of the client; got %x", pks[0])
+	}
+
+	if err := p.writePacket(&protocol.PlayStatus{Status: protocol.PlayStatusPlayerSpawn}); err != nil {
+		return err
+	}
+
+	var initialised protocol.SetLocalPlayerAsInitialised
+	if err := p.readPacket(&initialised); err != nil {
+		return err
+	}
+	if initialised.EntityRuntimeID != survivalRuntimeID {
+		return fmt.Errorf("expected runtime ID %d; got %d", survivalRuntimeID, initialised.EntityRuntimeID)
+	}
+
+	if err := p.write(runtimeIDPacket(protocol.IDSetActorData, survivalRuntimeID, "data")); err != nil {
+		return err
+	}
+
+	for {
+		pks, err := p.read()
+		if err != nil {
+			return nil
+		}
+		received <- pks
+	}
+}
+
+// switchVia is how a player is switched to the survival server
+type switchVia int
+
+const (
+	viaCommand switchVia = iota
+	viaScriptMessage
+	viaServerSwitcher
+)
+
+func TestSession_Switch(t *testing.T) {
+	tt := []struct {
+		name           string
+		via            switchVia
+		clientProtocol int32
+	}{
+		{
+			name:           "Command",
+			via:            viaCommand,
+			clientProtocol: 471,
+		},
+		{
+			name:           "ScriptMessage",
+			via:            viaScriptMessage,
+			clientProtocol: 471,
+		},
+		{
+			name:           "ServerSwitcher",
+			via:            viaServerSwitcher,
+			clientProtocol: 471,
+		},
+		{
+			name:           "AbilityData",
+			via:            viaCommand,
+			clientProtocol: 534,
+		},
+		{
+			name:           "EntityProperties",
+			via:            viaCommand,
+			clientProtocol: 557,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			testSwitch(t, tc.via, tc.clientProtocol)
+		})
+	}
+}
+
+func testSwitch(t *testing.T, via switchVia, clientProtocol int32) {
+	listeners := make([]*raknet.Listener, 3)
+	for n := range listeners {
+		l, err := raknet.Listen("127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		listeners[n] = l
+	}
+	lobbyListener, survivalListener, proxyListener := listeners[0], listeners[1], listeners[2]
+
+	survivalSrv := &bedrock.Server{
+		ID:          "survival",
+		Address:     survivalListener.Addr().String(),
+		DialTimeout: 5 * time.Second,
+		Mode:        bedrock.ServerModeTerminate,
+		Log:         logr.Discard(),
+	}
+	lobbySrv := bedrock.Server{
+		ID:          "lobby",
+		Address:     lobbyListener.Addr().String(),
+		DialTimeout: 5 * time.Second,
+		Mode:        bedrock.ServerModeTerminate,
+		Log:         logr.Discard(),
+		SwitchServers: map[string]*bedrock.Server{
+			"survival": survivalSrv,
+		},
+	}
+
+	var onChunkRadius func(p *peer) error
+	// The session records the chunk radius before the lobby receives it,
+	// which the switch replays to the survival server
+	chunkRadiusReceived := make(chan struct{}, 1)
+	switch via {
+	case viaScriptMessage:
+		onChunkRadius = sendSwitchMessage
+	case viaServerSwitcher:
+		onChunkRadius = func(*peer) error {
+			chunkRadiusReceived <- struct{}{}
+			return nil
+		}
+	}
+
+	errs := make(chan error, 4)
+	received := make(chan [][]byte, 4)
+	sessions := make(chan *bedrock.Session, 1)
+	for _, run := range []func() error{
+		func() error { return lobby(lobbyListener, onChunkRadius) },
+		func() error { return survival(survivalListener, received) },
+		func() error { return proxy(proxyListener, lobbySrv, sessions) },
+	} {
+		run := run
+		go func() {
+			if err := run(); err != nil {
+				errs <- err
+			}
+		}()
+	}
+
+	client := connectClient(t, proxyListener.Addr().String(), clientProtocol)
+	defer client.conn.Close()
+
+	expect := func(want []byte) {
+		t.Helper()
+		pks, err := client.read()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pks) != 1 || !bytes.Equal(pks[0], want) {
+			t.Fatalf("expected %x; got %x", want, pks)
+		}
+	}
+	expectPacket := func(want protocol.Packet) {
+		t.Helper()
+		expect(marshal(want))
+	}
+
+	expectPacket(&protocol.PlayStatus{Status: protocol.PlayStatusLoginSuccess})
+	expect(startGamePacket(clientProtocol, lobbyRuntimeID, [3]float32{}))
+	for _, entity := range []string{"entity", "player"} {
+		if pks, err := client.read(); err != nil || len(pks) != 1 {
+			t.Fatalf("expected the %s of the lobby; got %x, %v", entity, pks, err)
+		}
+	}
+
+	var sess *bedrock.Session
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	case sess = <-sessions:
+	}
+
+	if err := client.write(chunkRadius); err != nil {
+		t.Fatal(err)
+	}
+	switch via {
+	case viaCommand:
+		if err := client.write(packet(protocol.IDCommandRequest, func(w *protocol.Writer) {
+			w.String("/server survival")
+			w.Bytes([]byte("command origin"))
+		})); err != nil {
+			t.Fatal(err)
+		}
+	case viaServerSwitcher:
+		select {
+		case err := <-errs:
+			t.Fatal(err)
+		case <-chunkRadiusReceived:
+		}
+
+		// Switch blocks until the client is reset, which it is below
+		var switcher bedprox.ServerSwitcher = sess
+		go func() {
+			if err := switcher.SwitchServer("survival"); err != nil {
+				errs <- err
+			}
+		}()
+	}
+
+	// The client is reset for the world of the survival server. The entities
+	// of the lobby are removed in any order.
+	removed := map[int64]bool{}
+	for n := 0; n < 2; n++ {
+		var remove protocol.RemoveActor
+		if err := client.readPacket(&remove); err != nil {
+			t.Fatal(err)
+		}
+		removed[remove.EntityUniqueID] = true
+	}
+	if !removed[entityID] || !removed[playerUniqueID] {
+		t.Fatalf("expected the entity and the player of the lobby to be removed; got %v", removed)
+	}
+	expectPacket(&protocol.SetPlayerGameType{GameType: 1})
+	expectPacket(&protocol.ChangeDimension{Dimension: protocol.DimensionNether, Position: survivalSpawn})
+	expectPacket(&protocol.PlayStatus{Status: protocol.PlayStatusPlayerSpawn})
+	if err := client.write(playerAction(lobbyRuntimeID, 14)); err != nil {
+		t.Fatal(err)
+	}
+	expectPacket(&protocol.ChangeDimension{Dimension: protocol.DimensionOverworld, Position: survivalSpawn})
+
+	// The packets of the survival server are relayed once the client is reset
+	expectPacket(&protocol.PlayStatus{Status: protocol.PlayStatusPlayerSpawn})
+	expect(runtimeIDPacket(protocol.IDSetActorData, lobbyRuntimeID, "data"))
+
+	if err := client.write(playerAction(lobbyRuntimeID, 14)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.write(runtimeIDPacket(protocol.IDMovePlayer, lobbyRuntimeID, "move")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	case pks := <-received:
+		want := runtimeIDPacket(protocol.IDMovePlayer, survivalRuntimeID, "move")
+		if len(pks) != 1 || !bytes.Equal(pks[0], want) {
+			t.Errorf("expected %x; got %x", want, pks)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("survival server did not receive the packets of the client")
+	}
+
+	if sess.Server().ID != "survival" {
+		t.Errorf("expected the session to be on the survival server; got %q", sess.Server().ID)
+	}
+}
+
+func TestSession_SwitchFails(t *testing.T) {
+	srvListener, err := raknet.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvListener.Close()
+
+	proxyListener, err := raknet.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyListener.Close()
+
+	srv := bedrock.Server{
+		ID:          "lobby",
+		Address:     srvListener.Addr().String(),
+		DialTimeout: 5 * time.Second,
+		Mode:        bedrock.ServerModeTerminate,
+		Log:         logr.Discard(),
+	}
+
+	errs := make(chan error, 2)
+	sessions := make(chan *bedrock.Session, 1)
+	go func() {
+		if err := lobby(srvListener, nil); err != nil {
+			errs <- err
+		}
+	}()
+	go func() {
+		if err := proxy(proxyListener, srv, sessions); err != nil {
+			errs <- err
+		}
+	}()
+
+	client := connectClient(t, proxyListener.Addr().String(), 471)
+	defer client.conn.Close()
+
+	var sess *bedrock.Session
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	case sess = <-sessions:
+	}
+
+	// Read the login success, start game, entity and player of the lobby
+	for n := 0; n < 4; n++ {
+		if _, err := client.read(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	offline := &bedrock.Server{
+		ID:          "offline",
+		Address:     "127.0.0.1:1",
+		DialTimeout: 100 * time.Millisecond,
+		Log:         logr.Discard(),
+	}
+	if err := sess.Switch(offline); err == nil {
+		t.Fatal("expected switching to an offline server to fail")
+	}
+	if err := sess.SwitchServer("offline"); err == nil {
+		t.Fatal("expected switching to a server that is no switch server to fail")
+	}
+
+	// The player stays on the lobby
+	if sess.Server().ID != "lobby" {
+		t.Errorf("expected the session to stay on the lobby; got %q", sess.Server().ID)
+	}
+	transfer := protocol.Transfer{Address: "play.example.com", Port: 19132}
+	if err := sess.WritePacketToClient(&transfer); err != nil {
+		t.Fatal(err)
+	}
+	var injected protocol.Transfer
+	if err := client.readPacket(&injected); err != nil {
+		t.Fatal(err)
+	}
+}
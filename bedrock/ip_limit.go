@@ -0,0 +1,215 @@
+package bedrock
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// ipLimitLogInterval is the interval that rejections of a listener
+// are logged in at most once
+const ipLimitLogInterval = 10 * time.Second
+
+const (
+	// ipLimitReasonRate rejects clients that opened too many
+	// connections in the window
+	ipLimitReasonRate = "connection_rate"
+	// ipLimitReasonSessions rejects clients whose network has too
+	// many concurrent sessions
+	ipLimitReasonSessions = "concurrent_sessions"
+)
+
+var errIPLimitExceeded = errors.New("IP limit exceeded")
+
+// IPLimit limits the connections of the clients of a listener by their IP.
+// It applies to the address that the listener sees, which is the address
+// in the PROXY protocol header if the listener receives it. Listeners that
+// receive real IPs apply it to the real IP once the client logged in.
+type IPLimit struct {
+	// ConnectionsPerWindow is the number of new connections that an IP
+	// can open per Window. Zero means no limit.
+	ConnectionsPerWindow int
+	Window               time.Duration
+	// MaxSessions is the number of concurrent sessions that an IP, or the
+	// network of the size of IPv4Prefix and IPv6Prefix, can have.
+	// Zero means no limit.
+	MaxSessions int
+	// IPv4Prefix and IPv6Prefix are the prefix lengths of the networks
+	// that MaxSessions counts the sessions of, like 24 and 64.
+	// Zero counts the sessions of each IP on its own.
+	IPv4Prefix int
+	IPv6Prefix int
+	// Exempt are the networks that the limits do not apply to
+	Exempt []*net.IPNet
+}
+
+func (l IPLimit) enabled() bool {
+	return l.ConnectionsPerWindow > 0 || l.MaxSessions > 0
+}
+
+// ipWindow counts the connections of an IP in a fixed window
+type ipWindow struct {
+	start time.Time
+	count int
+}
+
+// ipLimiter enforces the IPLimit of a listener
+type ipLimiter struct {
+	limit IPLimit
+	log   logr.Logger
+
+	mu sync.Mutex
+	// windows maps an IP to the connections that it opened
+	windows   map[string]ipWindow
+	lastSweep time.Time
+	// sessions maps a network to its number of concurrent sessions
+	sessions map[string]int
+
+	// rejections counts the rejected connections by reason
+	rejections map[string]uint64
+	lastLog    time.Time
+	// suppressed is the number of rejections since the last log
+	suppressed int
+}
+
+func newIPLimiter(limit IPLimit, log logr.Logger) *ipLimiter {
+	return &ipLimiter{
+		limit:      limit,
+		log:        log,
+		windows:    map[string]ipWindow{},
+		sessions:   map[string]int{},
+		rejections: map[string]uint64{},
+	}
+}
+
+// acquire reports if the client at addr can open a new session. Clients
+// that are allowed have to release their session once it is closed.
+func (l *ipLimiter) acquire(addr net.Addr, now time.Time) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || l.exempt(udpAddr.IP) {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limit.ConnectionsPerWindow > 0 {
+		l.sweep(now)
+
+		ip := udpAddr.IP.String()
+		w := l.windows[ip]
+		if now.Sub(w.start) >= l.limit.Window {
+			w = ipWindow{start: now}
+		}
+		w.count++
+		l.windows[ip] = w
+
+		if w.count > l.limit.ConnectionsPerWindow {
+			l.reject(addr, ipLimitReasonRate, now)
+			return false
+		}
+	}
+
+	if l.limit.MaxSessions > 0 {
+		network := l.network(udpAddr.IP)
+		if l.sessions[network] >= l.limit.MaxSessions {
+			l.reject(addr, ipLimitReasonSessions, now)
+			return false
+		}
+		l.sessions[network]++
+	}
+	return true
+}
+
+// release releases the session of the client at addr.
+func (l *ipLimiter) release(addr net.Addr) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || l.limit.MaxSessions <= 0 || l.exempt(udpAddr.IP) {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	network := l.network(udpAddr.IP)
+	if l.sessions[network] <= 1 {
+		delete(l.sessions, network)
+		return
+	}
+	l.sessions[network]--
+}
+
+// rejectionCounts returns the number of rejected connections by reason
+func (l *ipLimiter) rejectionCounts() map[string]uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rejections := make(map[string]uint64, len(l.rejections))
+	for reason, n := range l.rejections {
+		rejections[reason] = n
+	}
+	return rejections
+}
+
+func (l *ipLimiter) exempt(ip net.IP) bool {
+	for _, ipNet := range l.limit.Exempt {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// network returns the network that the sessions of ip count towards
+func (l *ipLimiter) network(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		if l.limit.IPv4Prefix <= 0 {
+			return ip4.String()
+		}
+		mask := net.CIDRMask(l.limit.IPv4Prefix, 8*net.IPv4len)
+		return (&net.IPNet{IP: ip4.Mask(mask), Mask: mask}).String()
+	}
+
+	if l.limit.IPv6Prefix <= 0 {
+		return ip.String()
+	}
+	mask := net.CIDRMask(l.limit.IPv6Prefix, 8*net.IPv6len)
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+// sweep forgets the windows that ended, at most once per window.
+func (l *ipLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.limit.Window {
+		return
+	}
+	l.lastSweep = now
+
+	for ip, w := range l.windows {
+		if now.Sub(w.start) >= l.limit.Window {
+			delete(l.windows, ip)
+		}
+	}
+}
+
+// reject counts the rejection and logs it, unless a rejection was already
+// logged in the last ipLimitLogInterval. The next log tells how many
+// rejections were suppressed in between.
+func (l *ipLimiter) reject(addr net.Addr, reason string, now time.Time) {
+	l.rejections[reason]++
+
+	if !l.lastLog.IsZero() && now.Sub(l.lastLog) < ipLimitLogInterval {
+		l.suppressed++
+		return
+	}
+
+	l.log.Info("rejected connection",
+		"reason", reason,
+		"remoteAddress", addr,
+		"suppressed", l.suppressed,
+	)
+	l.lastLog = now
+	l.suppressed = 0
+}
@@ -0,0 +1,218 @@
+package bedrock_test
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/haveachin/bedprox/bedrock"
+	"github.com/sandertv/go-raknet"
+)
+
+// freeUDPAddr returns a loopback address with a port that is free.
+func freeUDPAddr(t *testing.T) string {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return c.LocalAddr().String()
+}
+
+// dialRakNet dials the address until the listener there accepts the
+// connection, since the listener might not be bound yet.
+func dialRakNet(t *testing.T, addr string) *raknet.Conn {
+	return dialRakNetWith(t, raknet.Dialer{}, addr)
+}
+
+// dialRakNetWith dials the address like dialRakNet with the dialer.
+func dialRakNetWith(t *testing.T, dialer raknet.Dialer, addr string) *raknet.Conn {
+	dialer.ErrorLog = log.New(ioutil.Discard, "", 0)
+	deadline := time.Now().Add(time.Second)
+	for {
+		rc, err := dialer.DialTimeout(addr, 100*time.Millisecond)
+		if err == nil {
+			return rc
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("failed to dial %s", addr)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestGateway_ListenAndServe_IPLimit(t *testing.T) {
+	tt := []struct {
+		name  string
+		limit bedrock.IPLimit
+		// closeFirst closes the first connection before the last dial
+		closeFirst bool
+		// allowed is the number of the three dials that are allowed
+		allowed    int
+		rejections map[string]uint64
+	}{
+		{
+			name: "connection rate",
+			limit: bedrock.IPLimit{
+				ConnectionsPerWindow: 2,
+				Window:               time.Minute,
+			},
+			allowed:    2,
+			rejections: map[string]uint64{"connection_rate": 1},
+		},
+		{
+			name: "concurrent sessions",
+			limit: bedrock.IPLimit{
+				MaxSessions: 1,
+				IPv4Prefix:  24,
+			},
+			allowed:    1,
+			rejections: map[string]uint64{"concurrent_sessions": 2},
+		},
+		{
+			name: "released session",
+			limit: bedrock.IPLimit{
+				MaxSessions: 1,
+			},
+			closeFirst: true,
+			allowed:    2,
+			rejections: map[string]uint64{"concurrent_sessions": 1},
+		},
+		{
+			name: "exempt",
+			limit: bedrock.IPLimit{
+				ConnectionsPerWindow: 1,
+				Window:               time.Minute,
+				MaxSessions:          1,
+				Exempt:               []*net.IPNet{mustParseCIDR(t, "127.0.0.0/8")},
+			},
+			allowed:    3,
+			rejections: map[string]uint64{},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := freeUDPAddr(t)
+			gw := &bedrock.Gateway{
+				ID: "gw",
+				Listeners: []bedrock.Listener{
+					{
+						Bind:    addr,
+						IPLimit: tc.limit,
+					},
+				},
+				Log: logr.Discard(),
+			}
+
+			cpnChan := make(chan net.Conn, 3)
+			go gw.ListenAndServe(cpnChan)
+
+			var conns []net.Conn
+			for n := 0; n < 3; n++ {
+				if n == 2 && tc.closeFirst && len(conns) > 0 {
+					conns[0].Close()
+				}
+
+				rc := dialRakNet(t, addr)
+				defer rc.Close()
+
+				select {
+				case c := <-cpnChan:
+					conns = append(conns, c)
+				case <-time.After(200 * time.Millisecond):
+				}
+			}
+			defer gw.Listeners[0].Close()
+
+			if len(conns) != tc.allowed {
+				t.Errorf("expected %d allowed connections; got %d", tc.allowed, len(conns))
+			}
+
+			rejections := gw.Listeners[0].Rejections()
+			if len(rejections) != len(tc.rejections) {
+				t.Fatalf("expected rejections %v; got %v", tc.rejections, rejections)
+			}
+			for reason, n := range tc.rejections {
+				if rejections[reason] != n {
+					t.Errorf("expected %d rejections for %q; got %d", n, reason, rejections[reason])
+				}
+			}
+		})
+	}
+}
+
+func TestGateway_ListenAndServe_IPLimitRealIP(t *testing.T) {
+	key := newKey(t)
+	addr := freeUDPAddr(t)
+	gw := &bedrock.Gateway{
+		ID: "gw",
+		Listeners: []bedrock.Listener{
+			{
+				Bind:          addr,
+				ReceiveRealIP: true,
+				RealIP: bedrock.RealIP{
+					PublicKey: &key.PublicKey,
+					MaxAge:    time.Minute,
+				},
+				IPLimit: bedrock.IPLimit{MaxSessions: 1},
+			},
+		},
+		Log: logr.Discard(),
+	}
+
+	cpnChan := make(chan net.Conn, 1)
+	go gw.ListenAndServe(cpnChan)
+
+	// All clients connect through the same front proxy, so only
+	// their real IPs tell them apart
+	tt := []struct {
+		realIP  string
+		allowed bool
+	}{
+		{realIP: "203.0.113.7:54321", allowed: true},
+		{realIP: "203.0.113.8:54321", allowed: true},
+		{realIP: "203.0.113.7:54322"},
+	}
+
+	for _, tc := range tt {
+		rc := dialRakNet(t, addr)
+		defer rc.Close()
+
+		var c net.Conn
+		select {
+		case c = <-cpnChan:
+		case <-time.After(time.Second):
+			t.Fatalf("connection of %s was not accepted", tc.realIP)
+		}
+		defer c.Close()
+
+		errs := make(chan error, 1)
+		go func() {
+			_, err := bedrock.ConnProcessor{}.ProcessConn(c)
+			errs <- err
+		}()
+		serverAddr := signRealIP(t, key, "play.example.com", tc.realIP, time.Now())
+		logIn(t, rc, 560, newLoginRequestTo(t, newKey(t), serverAddr))
+
+		select {
+		case err := <-errs:
+			if tc.allowed && err != nil {
+				t.Errorf("expected %s to be allowed; got %v", tc.realIP, err)
+			} else if !tc.allowed && err == nil {
+				t.Errorf("expected %s to be limited", tc.realIP)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("connection of %s was not processed", tc.realIP)
+		}
+	}
+	gw.Listeners[0].Close()
+
+	rejections := gw.Listeners[0].Rejections()
+	if rejections["concurrent_sessions"] != 1 {
+		t.Errorf("expected 1 rejection for %q; got %v", "concurrent_sessions", rejections)
+	}
+}
@@ -0,0 +1,69 @@
+package protocol
+
+const (
+	DimensionOverworld int32 = iota
+	DimensionNether
+	DimensionEnd
+)
+
+// ChangeDimension is sent by the server to the client to send a dimension change screen client-side. Once
+// the screen is cleared client-side, the client will send a PlayerAction packet with the dimension change
+// done action.
+type ChangeDimension struct {
+	// Dimension is the dimension that the client should be changed to. It is one of the constants above.
+	Dimension int32
+	// Position is the position in the new dimension that the player is spawned in.
+	Position [3]float32
+	// Respawn specifies if the dimension change was respawn based, meaning that the player died in one
+	// dimension and got respawned into another.
+	Respawn bool
+	// LoadingScreenID is an optional ID of the loading screen, that clients of protocol 712 and newer
+	// expect. If it is nil, the field is omitted entirely, as older clients expect.
+	LoadingScreenID *uint32
+}
+
+// ID ...
+func (*ChangeDimension) ID() uint32 {
+	return IDChangeDimension
+}
+
+// Marshal ...
+func (pk *ChangeDimension) Marshal(w *Writer) {
+	w.Varint32(pk.Dimension)
+	w.Vec3(pk.Position)
+	w.Bool(pk.Respawn)
+	if pk.LoadingScreenID != nil {
+		w.Bool(true)
+		w.Uint32(*pk.LoadingScreenID)
+	}
+}
+
+// Unmarshal ...
+func (pk *ChangeDimension) Unmarshal(r *Reader) error {
+	if err := r.Varint32(&pk.Dimension); err != nil {
+		return err
+	}
+	if err := r.Vec3(&pk.Position); err != nil {
+		return err
+	}
+	if err := r.Bool(&pk.Respawn); err != nil {
+		return err
+	}
+	if !r.Remaining() {
+		return nil
+	}
+
+	var ok bool
+	if err := r.Bool(&ok); err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+	var id uint32
+	if err := r.Uint32(&id); err != nil {
+		return err
+	}
+	pk.LoadingScreenID = &id
+	return nil
+}
@@ -0,0 +1,19 @@
+package protocol
+
+// ClientToServerHandshake is sent by the client in response to a ServerToClientHandshake packet sent by the
+// server. It is the first encrypted packet in the login handshake and serves as a confirmation that
+// encryption is correctly initialised client side. It has no fields.
+type ClientToServerHandshake struct{}
+
+// ID ...
+func (*ClientToServerHandshake) ID() uint32 {
+	return IDClientToServerHandshake
+}
+
+// Marshal ...
+func (*ClientToServerHandshake) Marshal(*Writer) {}
+
+// Unmarshal ...
+func (*ClientToServerHandshake) Unmarshal(*Reader) error {
+	return nil
+}
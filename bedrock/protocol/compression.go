@@ -0,0 +1,39 @@
+package protocol
+
+const (
+	// compressionIDFlate prefixes batches that are compressed with DEFLATE.
+	compressionIDFlate byte = 0x00
+	// compressionIDNone prefixes batches that are not compressed.
+	compressionIDNone byte = 0xff
+
+	// CompressionPrefixProtocol is the first protocol version in which every batch is prefixed with the ID
+	// of the compression algorithm that it was compressed with.
+	CompressionPrefixProtocol = 649
+)
+
+// Compression describes how the batches of a connection are compressed.
+type Compression struct {
+	// Enabled reports if batches are compressed. Batches that are sent before the network settings are
+	// negotiated are not compressed.
+	Enabled bool
+	// Prefixed reports if every batch is prefixed with the ID of the compression algorithm it uses.
+	Prefixed bool
+}
+
+var (
+	// DefaultCompression is the compression of clients that do not negotiate network settings and
+	// compress every batch with DEFLATE.
+	DefaultCompression = Compression{Enabled: true}
+	// NoCompression is the compression of batches that are sent before the network settings were
+	// negotiated.
+	NoCompression = Compression{}
+)
+
+// NegotiatedCompression returns the compression that is used after the network settings were negotiated
+// with a client of the given protocol version.
+func NegotiatedCompression(protocol int32) Compression {
+	return Compression{
+		Enabled:  true,
+		Prefixed: protocol >= CompressionPrefixProtocol,
+	}
+}
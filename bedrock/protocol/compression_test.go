@@ -0,0 +1,71 @@
+package protocol_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/haveachin/bedprox/bedrock/protocol"
+)
+
+func TestCompression(t *testing.T) {
+	tt := []struct {
+		name        string
+		compression protocol.Compression
+		prefix      []byte
+	}{
+		{
+			name:        "Default",
+			compression: protocol.DefaultCompression,
+			prefix:      []byte{0xfe},
+		},
+		{
+			name:        "None",
+			compression: protocol.NoCompression,
+			prefix:      []byte{0xfe, 0x06, 0xc1, 0x01},
+		},
+		{
+			name:        "NegotiatedLegacy",
+			compression: protocol.NegotiatedCompression(560),
+			prefix:      []byte{0xfe},
+		},
+		{
+			name:        "NegotiatedPrefixed",
+			compression: protocol.NegotiatedCompression(649),
+			prefix:      []byte{0xfe, 0x00},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			pk := protocol.RequestNetworkSettings{ClientProtocol: 649}
+			b, err := protocol.MarshalPacketWith(&pk, tc.compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.HasPrefix(b, tc.prefix) {
+				t.Fatalf("batch %x does not start with %x", b, tc.prefix)
+			}
+
+			decoder := protocol.NewDecoder(bytes.NewReader(b))
+			decoder.SetCompression(tc.compression)
+			pks, err := decoder.Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(pks) != 1 {
+				t.Fatalf("expected 1 packet; got %d", len(pks))
+			}
+
+			var decoded protocol.RequestNetworkSettings
+			if err := protocol.UnmarshalPacket(pks[0], &decoded); err != nil {
+				t.Fatal(err)
+			}
+
+			if decoded != pk {
+				t.Errorf("expected %v; got %v", pk, decoded)
+			}
+		})
+	}
+}
@@ -15,33 +15,89 @@ const (
 	// maximumInBatch is the maximum amount of packets that may be found in a batch. If a compressed batch has
 	// more than this amount, decoding will fail.
 	maximumInBatch = 512 + 256
+	// DefaultMaxDecompressedSize is the default maximum size of a batch after decompression.
+	DefaultMaxDecompressedSize = 1024 * 1024 * 16
+	// readBufferSize is the size of the buffers that batches are read into from an io.Reader.
+	readBufferSize = 1024 * 1024 * 3
 )
 
+// ErrDecompressedSizeExceeded is returned if a batch decompresses to more bytes than the Decoder allows.
+var ErrDecompressedSizeExceeded = errors.New("decompressed batch exceeds the maximum size")
+
+// packetReader is used to read packets immediately instead of copying them in a buffer first. This is a
+// specific case made to reduce RAM usage, and is implemented by *raknet.Conn.
+type packetReader interface {
+	ReadPacket() ([]byte, error)
+}
+
 type Decoder struct {
-	// r holds the io.Reader that packets are read from if the reader does not implement packetReader. When
-	// this is the case, the buf field has a non-zero length.
-	r   io.Reader
-	buf []byte
+	// pr holds a packetReader (and io.Reader) that packets are read from if the io.Reader passed to
+	// NewDecoder implements the packetReader interface.
+	pr packetReader
+	// r holds the io.Reader that packets are read from if the reader does not implement packetReader. The
+	// batches are then read into a buffer from the readBufferPool.
+	r           io.Reader
+	compression Compression
+	// maxDecompressedSize is the maximum amount of bytes a batch may decompress to.
+	maxDecompressedSize int
 }
 
 // NewDecoder returns a new decoder decoding data from the io.Reader passed. One read call from the reader is
-// assumed to consume an entire packet.
+// assumed to consume an entire packet. If the reader implements ReadPacket, like *raknet.Conn does, batches
+// are decoded straight from the returned slice without copying them first.
+// The reader may be nil if the Decoder is only used with DecodeBatch.
 func NewDecoder(reader io.Reader) *Decoder {
-	return &Decoder{
-		r:   reader,
-		buf: make([]byte, 1024*1024*3),
+	decoder := &Decoder{
+		r:                   reader,
+		compression:         DefaultCompression,
+		maxDecompressedSize: DefaultMaxDecompressedSize,
 	}
+	if pr, ok := reader.(packetReader); ok {
+		decoder.pr = pr
+	}
+	return decoder
+}
+
+// SetCompression sets the compression that the Decoder expects for all following batches.
+func (decoder *Decoder) SetCompression(c Compression) {
+	decoder.compression = c
+}
+
+// SetMaxDecompressedSize sets the maximum amount of bytes that a batch may decompress to. Batches that
+// decompress to more bytes fail with ErrDecompressedSizeExceeded.
+func (decoder *Decoder) SetMaxDecompressedSize(n int) {
+	decoder.maxDecompressedSize = n
 }
 
 // Decode decodes one 'packet' from the io.Reader passed in NewDecoder(), producing a slice of packets that it
 // held and an error if not successful.
 func (decoder *Decoder) Decode() (packets [][]byte, err error) {
-	n, err := decoder.r.Read(decoder.buf)
+	if decoder.pr != nil {
+		data, err := decoder.pr.ReadPacket()
+		if err != nil {
+			return nil, fmt.Errorf("error reading batch from reader: %v", err)
+		}
+		return decoder.decodeBatch(data, false)
+	}
+
+	buf := readBufferPool.Get().(*[]byte)
+	defer readBufferPool.Put(buf)
+
+	n, err := decoder.r.Read(*buf)
 	if err != nil {
 		return nil, fmt.Errorf("error reading batch from reader: %v", err)
 	}
-	data := decoder.buf[:n]
+	// The buffer goes back into the pool, so the packets must not reference it
+	return decoder.decodeBatch((*buf)[:n], true)
+}
 
+// DecodeBatch decodes the batch data passed, producing a slice of packets that it held and an error if not
+// successful. The packets returned may reference data if the batch is not compressed.
+func (decoder *Decoder) DecodeBatch(data []byte) (packets [][]byte, err error) {
+	return decoder.decodeBatch(data, false)
+}
+
+func (decoder *Decoder) decodeBatch(data []byte, copyData bool) (packets [][]byte, err error) {
 	if len(data) == 0 {
 		return nil, nil
 	}
@@ -50,24 +106,59 @@ func (decoder *Decoder) Decode() (packets [][]byte, err error) {
 	}
 	data = data[1:]
 
-	b, err := decoder.decompress(data)
+	b, err := decoder.uncompress(data, copyData)
 	if err != nil {
 		return nil, err
 	}
 	for b.Len() != 0 {
+		if len(packets) == maximumInBatch {
+			return nil, fmt.Errorf("number of packets in compressed batch exceeds %v", maximumInBatch)
+		}
+
 		var length uint32
 		if err := Varuint32(b, &length); err != nil {
 			return nil, fmt.Errorf("error reading packet length: %v", err)
 		}
+		if int(length) > b.Len() {
+			return nil, fmt.Errorf("packet length %v exceeds %v remaining bytes", length, b.Len())
+		}
 		packets = append(packets, b.Next(int(length)))
 	}
-	if len(packets) > maximumInBatch {
-		return nil, fmt.Errorf("number of packets %v in compressed batch exceeds %v", len(packets), maximumInBatch)
-	}
 	return packets, nil
 }
 
-// decompress decompresses the data passed and returns it as a byte slice.
+// uncompress returns the uncompressed content of the batch data passed, according to the compression
+// of the Decoder. If copyData is true, the content of batches that are not compressed is copied.
+func (decoder *Decoder) uncompress(data []byte, copyData bool) (*bytes.Buffer, error) {
+	raw := func(data []byte) *bytes.Buffer {
+		if copyData {
+			data = append([]byte(nil), data...)
+		}
+		return bytes.NewBuffer(data)
+	}
+
+	if !decoder.compression.Enabled {
+		return raw(data), nil
+	}
+	if decoder.compression.Prefixed {
+		if len(data) == 0 {
+			return nil, errors.New("error reading compression algorithm: batch is empty")
+		}
+		id := data[0]
+		data = data[1:]
+		switch id {
+		case compressionIDNone:
+			return raw(data), nil
+		case compressionIDFlate:
+		default:
+			return nil, fmt.Errorf("unsupported compression algorithm 0x%x", id)
+		}
+	}
+	return decoder.decompress(data)
+}
+
+// decompress decompresses the data passed and returns it as a byte slice. It stops decompressing once the
+// maximum decompressed size of the Decoder is exceeded.
 func (decoder *Decoder) decompress(data []byte) (*bytes.Buffer, error) {
 	buf := bytes.NewBuffer(data)
 	c := DecompressPool.Get().(io.ReadCloser)
@@ -79,9 +170,14 @@ func (decoder *Decoder) decompress(data []byte) (*bytes.Buffer, error) {
 	_ = c.Close()
 
 	raw := bytes.NewBuffer(make([]byte, 0, len(data)*2))
-	if _, err := io.Copy(raw, c); err != nil {
+	limit := int64(decoder.maxDecompressedSize)
+	n, err := io.Copy(raw, io.LimitReader(c, limit+1))
+	if err != nil {
 		return nil, fmt.Errorf("error reading decompressed data: %v", err)
 	}
+	if n > limit {
+		return nil, fmt.Errorf("%w of %v bytes", ErrDecompressedSizeExceeded, limit)
+	}
 	return raw, nil
 }
 
@@ -92,6 +188,15 @@ var DecompressPool = sync.Pool{
 	},
 }
 
+// readBufferPool is a sync.Pool for the buffers that batches are read into, so that connections only hold
+// a buffer while they decode a batch.
+var readBufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, readBufferSize)
+		return &b
+	},
+}
+
 func Varuint32(src io.ByteReader, x *uint32) error {
 	var v uint32
 	for i := uint(0); i < 35; i += 7 {
@@ -0,0 +1,186 @@
+package protocol_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/haveachin/bedprox/bedrock/protocol"
+)
+
+// mockPacketReader returns one batch per ReadPacket call, like *raknet.Conn does.
+type mockPacketReader struct {
+	batch []byte
+}
+
+func (m mockPacketReader) Read([]byte) (int, error) {
+	return 0, errors.New("read should not be called")
+}
+
+func (m mockPacketReader) ReadPacket() ([]byte, error) {
+	return m.batch, nil
+}
+
+func encodeBatch(t testing.TB, packet []byte) []byte {
+	buf := &bytes.Buffer{}
+	if err := protocol.NewEncoder(buf).Encode(packet); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecoder_PacketReader(t *testing.T) {
+	pk := protocol.PlayStatus{Status: protocol.PlayStatusLoginFailedServerFull}
+	batch, err := protocol.MarshalPacket(&pk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pks, err := protocol.NewDecoder(mockPacketReader{batch: batch}).Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(pks) != 1 {
+		t.Fatalf("expected 1 packet; got %d", len(pks))
+	}
+}
+
+func TestDecoder_MaxDecompressedSize(t *testing.T) {
+	bomb := encodeBatch(t, make([]byte, protocol.DefaultMaxDecompressedSize+1))
+	if len(bomb) > 64*1024 {
+		t.Fatalf("expected a small compressed batch; got %d bytes", len(bomb))
+	}
+
+	_, err := protocol.NewDecoder(nil).DecodeBatch(bomb)
+	if !errors.Is(err, protocol.ErrDecompressedSizeExceeded) {
+		t.Errorf("expected ErrDecompressedSizeExceeded; got %v", err)
+	}
+
+	decoder := protocol.NewDecoder(nil)
+	decoder.SetMaxDecompressedSize(512)
+	_, err = decoder.DecodeBatch(encodeBatch(t, make([]byte, 1024)))
+	if !errors.Is(err, protocol.ErrDecompressedSizeExceeded) {
+		t.Errorf("expected ErrDecompressedSizeExceeded; got %v", err)
+	}
+}
+
+func TestDecoder_OversizedPacketLength(t *testing.T) {
+	decoder := protocol.NewDecoder(nil)
+	decoder.SetCompression(protocol.NoCompression)
+	if _, err := decoder.DecodeBatch([]byte{0xfe, 0x10, 0x01}); err == nil {
+		t.Error("expected an error for a packet length that exceeds the batch")
+	}
+}
+
+func TestDecoder_PooledBufferIsNotReferenced(t *testing.T) {
+	pk := protocol.RequestNetworkSettings{ClientProtocol: 560}
+	batch, err := protocol.MarshalPacketWith(&pk, protocol.NoCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := protocol.NewDecoder(bytes.NewReader(batch))
+	decoder.SetCompression(protocol.NoCompression)
+	pks, err := decoder.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Decoding another batch reuses the pooled buffer
+	other := protocol.RequestNetworkSettings{ClientProtocol: 1}
+	otherBatch, _ := protocol.MarshalPacketWith(&other, protocol.NoCompression)
+	decoder = protocol.NewDecoder(bytes.NewReader(otherBatch))
+	decoder.SetCompression(protocol.NoCompression)
+	if _, err := decoder.Decode(); err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded protocol.RequestNetworkSettings
+	if err := protocol.UnmarshalPacket(pks[0], &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded != pk {
+		t.Errorf("expected %v; got %v", pk, decoded)
+	}
+}
+
+// newConnBatch returns a batch with a login packet of a typical size.
+func newConnBatch(b *testing.B) []byte {
+	pk := protocol.Login{
+		ClientProtocol:    560,
+		ConnectionRequest: bytes.Repeat([]byte("eyJhbGciOiJFUzM4NCJ9"), 512),
+	}
+	batch, err := protocol.MarshalPacket(&pk)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return batch
+}
+
+// BenchmarkDecoder_NewConnPacketReader simulates a flood of new connections, that each create a Decoder
+// for their raknet connection and decode their first batch.
+func BenchmarkDecoder_NewConnPacketReader(b *testing.B) {
+	batch := newConnBatch(b)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := protocol.NewDecoder(mockPacketReader{batch: batch}).Decode(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkDecoder_NewConnReader is like BenchmarkDecoder_NewConnPacketReader, but for an io.Reader that
+// does not implement ReadPacket. Before the read buffers were pooled, every Decoder allocated 3 MiB.
+func BenchmarkDecoder_NewConnReader(b *testing.B) {
+	batch := newConnBatch(b)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := protocol.NewDecoder(bytes.NewReader(batch)).Decode(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkDecoder_DecodeBatch(b *testing.B) {
+	batch := newConnBatch(b)
+	decoder := protocol.NewDecoder(nil)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		if _, err := decoder.DecodeBatch(batch); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func FuzzDecoder(f *testing.F) {
+	pk := protocol.RequestNetworkSettings{ClientProtocol: 560}
+	for _, c := range []protocol.Compression{
+		protocol.DefaultCompression,
+		protocol.NoCompression,
+		protocol.NegotiatedCompression(protocol.CompressionPrefixProtocol),
+	} {
+		batch, err := protocol.MarshalPacketWith(&pk, c)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(batch)
+	}
+
+	f.Fuzz(func(t *testing.T, batch []byte) {
+		for _, c := range []protocol.Compression{
+			protocol.DefaultCompression,
+			protocol.NoCompression,
+			protocol.NegotiatedCompression(protocol.CompressionPrefixProtocol),
+		} {
+			decoder := protocol.NewDecoder(bytes.NewReader(batch))
+			decoder.SetCompression(c)
+			decoder.SetMaxDecompressedSize(1024 * 1024)
+			_, _ = decoder.Decode()
+		}
+	})
+}
@@ -1,33 +1,68 @@
 package protocol
 
-import "log"
+const (
+	// DisconnectReasonProtocol is the first protocol version in which Disconnect starts with the reason of
+	// the disconnection.
+	DisconnectReasonProtocol = 622
+	// DisconnectFilteredMessageProtocol is the first protocol version in which Disconnect holds the message
+	// with profanity filtered out after the message.
+	DisconnectFilteredMessageProtocol = 712
+)
 
 // Disconnect may be sent by the server to disconnect the client using an optional message to send as the
 // disconnect screen.
 type Disconnect struct {
+	// Reason is the reason for the disconnection, which the client uses for telemetry. It is only written
+	// for clients of DisconnectReasonProtocol and newer.
+	Reason int32
 	// HideDisconnectionScreen specifies if the disconnection screen should be hidden when the client is
 	// disconnected, meaning it will be sent directly to the main menu.
 	HideDisconnectionScreen bool
 	// Message is an optional message to show when disconnected. This message is only written if the
-	// HideDisconnectionScreen field is set to true.
+	// HideDisconnectionScreen field is set to false.
 	Message string
+	// FilteredMessage is the message shown to players that enabled the profanity filter. It is only
+	// written with the message for clients of DisconnectFilteredMessageProtocol and newer.
+	FilteredMessage string
 }
 
 // ID ...
 func (*Disconnect) ID() uint32 {
-	return 0x05
+	return IDDisconnect
 }
 
 // Marshal ...
 func (pk *Disconnect) Marshal(w *Writer) {
+	if w.Protocol() >= DisconnectReasonProtocol {
+		w.Varint32(pk.Reason)
+	}
 	w.Bool(pk.HideDisconnectionScreen)
 	if !pk.HideDisconnectionScreen {
 		w.String(pk.Message)
+		if w.Protocol() >= DisconnectFilteredMessageProtocol {
+			w.String(pk.FilteredMessage)
+		}
 	}
 }
 
 // Unmarshal ...
-func (pk *Disconnect) Unmarshal(buf *Reader) error {
-	log.Fatal("not implemented yet")
+func (pk *Disconnect) Unmarshal(r *Reader) error {
+	if r.Protocol() >= DisconnectReasonProtocol {
+		if err := r.Varint32(&pk.Reason); err != nil {
+			return err
+		}
+	}
+	if err := r.Bool(&pk.HideDisconnectionScreen); err != nil {
+		return err
+	}
+	if pk.HideDisconnectionScreen {
+		return nil
+	}
+	if err := r.String(&pk.Message); err != nil {
+		return err
+	}
+	if r.Protocol() >= DisconnectFilteredMessageProtocol {
+		return r.String(&pk.FilteredMessage)
+	}
 	return nil
 }
@@ -12,25 +12,32 @@ import (
 // Encoder handles the encoding of Minecraft packets that are sent to an io.Writer. The packets are compressed
 // and optionally encoded before they are sent to the io.Writer.
 type Encoder struct {
-	w io.Writer
+	w           io.Writer
+	compression Compression
 }
 
 // NewEncoder returns a new Encoder for the io.Writer passed. Each final packet produced by the Encoder is
 // sent with a single call to io.Writer.Write().
 func NewEncoder(w io.Writer) *Encoder {
 	return &Encoder{
-		w: w,
+		w:           w,
+		compression: DefaultCompression,
 	}
 }
 
+// SetCompression sets the compression that the Encoder uses for all following packets.
+func (encoder *Encoder) SetCompression(c Compression) {
+	encoder.compression = c
+}
+
 // writeCloseResetter is an interface composed of an io.WriteCloser and a Reset(io.Writer) method.
 type writeCloseResetter interface {
 	io.WriteCloser
 	Reset(w io.Writer)
 }
 
-// Encode encodes the packet passed and compresses it.
-func (encoder *Encoder) Encode(packet []byte) error {
+// Encode encodes the packets passed into one batch and compresses it.
+func (encoder *Encoder) Encode(packets ...[]byte) error {
 	buf := BufferPool.Get().(*bytes.Buffer)
 	defer func() {
 		// Reset the buffer so we can return it to the buffer pool safely.
@@ -40,19 +47,38 @@ func (encoder *Encoder) Encode(packet []byte) error {
 	if err := buf.WriteByte(header); err != nil {
 		return fmt.Errorf("error writing 0xfe header: %v", err)
 	}
+	l := make([]byte, 5)
+
+	if !encoder.compression.Enabled {
+		for _, packet := range packets {
+			if err := writeVaruint32(buf, uint32(len(packet)), l); err != nil {
+				return fmt.Errorf("error writing varuint32 length: %v", err)
+			}
+			_, _ = buf.Write(packet)
+		}
+		if _, err := encoder.w.Write(buf.Bytes()); err != nil {
+			return fmt.Errorf("error writing packet to io.Writer: %v", err)
+		}
+		return nil
+	}
+
+	if encoder.compression.Prefixed {
+		_ = buf.WriteByte(compressionIDFlate)
+	}
 
 	w := CompressPool.Get().(writeCloseResetter)
 	defer CompressPool.Put(w)
 
 	w.Reset(buf)
-	l := make([]byte, 5)
 
-	// Each packet is prefixed with a varuint32 specifying the length of the packet.
-	if err := writeVaruint32(w, uint32(len(packet)), l); err != nil {
-		return fmt.Errorf("error writing varuint32 length: %v", err)
-	}
-	if _, err := w.Write(packet); err != nil {
-		return fmt.Errorf("error writing packet payload: %v", err)
+	for _, packet := range packets {
+		// Each packet is prefixed with a varuint32 specifying the length of the packet.
+		if err := writeVaruint32(w, uint32(len(packet)), l); err != nil {
+			return fmt.Errorf("error writing varuint32 length: %v", err)
+		}
+		if _, err := w.Write(packet); err != nil {
+			return fmt.Errorf("error writing packet payload: %v", err)
+		}
 	}
 
 	// We compress the data and write the full data to the io.Writer. The data returned includes the header
@@ -79,7 +105,7 @@ func (encoder *Encoder) compress(w writeCloseResetter, buf *bytes.Buffer) ([]byt
 
 // writeVaruint32 writes a uint32 to the destination buffer passed with a size of 1-5 bytes. It uses byte
 // slice b in order to prevent allocations.
-func writeVaruint32(dst writeCloseResetter, x uint32, b []byte) error {
+func writeVaruint32(dst io.Writer, x uint32, b []byte) error {
 	b[4] = 0
 	b[3] = 0
 	b[2] = 0
@@ -0,0 +1,112 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// ErrInvalidChecksum is returned by Encryption.Decrypt if the checksum of a batch does not match its content.
+var ErrInvalidChecksum = errors.New("invalid batch checksum")
+
+// Encryption encrypts and decrypts the batches of a connection once the encryption handshake is completed.
+// Batches are encrypted with AES-256 in CTR mode and carry a checksum of their content. Each direction keeps
+// its own counter, so Encrypt and Decrypt may be used concurrently, but Encrypt must not be called
+// concurrently with itself and batches have to be sent in the order they were encrypted in.
+type Encryption struct {
+	key         []byte
+	sendStream  cipher.Stream
+	recvStream  cipher.Stream
+	sendCounter uint64
+	recvCounter uint64
+}
+
+// NewEncryption returns an Encryption for the 32 byte key passed, as returned by EncryptionKey.
+func NewEncryption(key []byte) (*Encryption, error) {
+	newStream := func() (cipher.Stream, error) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		iv := append(append([]byte(nil), key[:12]...), 0, 0, 0, 2)
+		return cipher.NewCTR(block, iv), nil
+	}
+
+	sendStream, err := newStream()
+	if err != nil {
+		return nil, err
+	}
+	recvStream, err := newStream()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Encryption{
+		key:        append([]byte(nil), key...),
+		sendStream: sendStream,
+		recvStream: recvStream,
+	}, nil
+}
+
+// EncryptionKey derives the key of a session from the shared secret of the private and public key passed and
+// the salt that the server sent in its handshake.
+func EncryptionKey(priv *ecdsa.PrivateKey, pub *ecdsa.PublicKey, salt []byte) []byte {
+	x, _ := pub.Curve.ScalarMult(pub.X, pub.Y, priv.D.Bytes())
+	// The shared secret is the X coordinate, padded to the size of the curve
+	secret := x.Bytes()
+	size := (pub.Curve.Params().BitSize + 7) / 8
+	secret = append(bytes.Repeat([]byte{0}, size-len(secret)), secret...)
+
+	key := sha256.Sum256(append(append([]byte(nil), salt...), secret...))
+	return key[:]
+}
+
+// checksum returns the checksum of the batch content with the counter passed.
+func (e *Encryption) checksum(counter uint64, data []byte) []byte {
+	h := sha256.New()
+	_ = binary.Write(h, binary.LittleEndian, counter)
+	h.Write(data)
+	h.Write(e.key)
+	return h.Sum(nil)[:8]
+}
+
+// Encrypt encrypts the batch passed, including its 0xfe header, and returns the encrypted batch. The header
+// itself stays unencrypted.
+func (e *Encryption) Encrypt(batch []byte) []byte {
+	if len(batch) == 0 {
+		return nil
+	}
+	sum := e.checksum(e.sendCounter, batch[1:])
+	e.sendCounter++
+
+	b := make([]byte, 0, len(batch)+len(sum))
+	b = append(b, batch...)
+	b = append(b, sum...)
+	e.sendStream.XORKeyStream(b[1:], b[1:])
+	return b
+}
+
+// Decrypt decrypts the batch passed, including its 0xfe header, and verifies its checksum. The decrypted
+// batch is returned without the checksum. The batch passed is decrypted in place.
+func (e *Encryption) Decrypt(batch []byte) ([]byte, error) {
+	if len(batch) == 0 || batch[0] != header {
+		return nil, errors.New("invalid encrypted batch header")
+	}
+	if len(batch) < 9 {
+		return nil, errors.New("encrypted batch is too short")
+	}
+	e.recvStream.XORKeyStream(batch[1:], batch[1:])
+
+	data := batch[1 : len(batch)-8]
+	sum := batch[len(batch)-8:]
+	if subtle.ConstantTimeCompare(sum, e.checksum(e.recvCounter, data)) != 1 {
+		return nil, ErrInvalidChecksum
+	}
+	e.recvCounter++
+	return batch[:len(batch)-8], nil
+}
@@ -0,0 +1,97 @@
+package protocol_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"github.com/haveachin/bedprox/bedrock/protocol"
+)
+
+func TestEncryptionKey(t *testing.T) {
+	server, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	salt := []byte("salt")
+	serverKey := protocol.EncryptionKey(server, &client.PublicKey, salt)
+	clientKey := protocol.EncryptionKey(client, &server.PublicKey, salt)
+	if !bytes.Equal(serverKey, clientKey) {
+		t.Error("expected both sides to derive the same key")
+	}
+	if len(serverKey) != 32 {
+		t.Errorf("expected a key of 32 bytes; got %d", len(serverKey))
+	}
+}
+
+func newEncryptionPair(t *testing.T) (*protocol.Encryption, *protocol.Encryption) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	sender, err := protocol.NewEncryption(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := protocol.NewEncryption(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sender, receiver
+}
+
+func TestEncryption_RoundTrip(t *testing.T) {
+	sender, receiver := newEncryptionPair(t)
+
+	for _, batch := range [][]byte{
+		{0xfe, 0x01, 0x02, 0x03},
+		{0xfe},
+		append([]byte{0xfe}, bytes.Repeat([]byte{0xab}, 4096)...),
+	} {
+		encrypted := sender.Encrypt(batch)
+		if encrypted[0] != 0xfe {
+			t.Errorf("expected the header to stay unencrypted; got 0x%x", encrypted[0])
+		}
+		if len(batch) > 1 && bytes.Equal(encrypted[1:len(batch)], batch[1:]) {
+			t.Error("expected the batch to be encrypted")
+		}
+
+		decrypted, err := receiver.Decrypt(encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(decrypted, batch) {
+			t.Errorf("expected %x; got %x", batch, decrypted)
+		}
+	}
+}
+
+func TestEncryption_InvalidChecksum(t *testing.T) {
+	sender, receiver := newEncryptionPair(t)
+
+	encrypted := sender.Encrypt([]byte{0xfe, 0x01, 0x02, 0x03})
+	encrypted[2] ^= 0xff
+	if _, err := receiver.Decrypt(encrypted); !errors.Is(err, protocol.ErrInvalidChecksum) {
+		t.Errorf("expected ErrInvalidChecksum for a tampered batch; got %v", err)
+	}
+
+	// A batch that is replayed has the checksum of an old counter
+	sender, receiver = newEncryptionPair(t)
+	encrypted = sender.Encrypt([]byte{0xfe, 0x01})
+	replayed := append([]byte(nil), encrypted...)
+	if _, err := receiver.Decrypt(encrypted); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receiver.Decrypt(replayed); err == nil {
+		t.Error("expected an error for a replayed batch")
+	}
+
+	if _, err := receiver.Decrypt([]byte{0xfe, 0x01}); err == nil {
+		t.Error("expected an error for a batch without checksum")
+	}
+}
@@ -0,0 +1,39 @@
+package protocol
+
+const (
+	IDLogin                       = 0x01
+	IDPlayStatus                  = 0x02
+	IDServerToClientHandshake     = 0x03
+	IDClientToServerHandshake     = 0x04
+	IDDisconnect                  = 0x05
+	IDResourcePacksInfo           = 0x06
+	IDResourcePackStack           = 0x07
+	IDResourcePackClientResponse  = 0x08
+	IDText                        = 0x09
+	IDStartGame                   = 0x0b
+	IDAddPlayer                   = 0x0c
+	IDAddActor                    = 0x0d
+	IDRemoveActor                 = 0x0e
+	IDAddItemActor                = 0x0f
+	IDMoveActorAbsolute           = 0x12
+	IDMovePlayer                  = 0x13
+	IDAddPainting                 = 0x16
+	IDActorEvent                  = 0x1b
+	IDMobEffect                   = 0x1c
+	IDUpdateAttributes            = 0x1d
+	IDMobEquipment                = 0x1f
+	IDMobArmourEquipment          = 0x20
+	IDPlayerAction                = 0x24
+	IDSetActorData                = 0x27
+	IDSetActorMotion              = 0x28
+	IDChangeDimension             = 0x3d
+	IDSetPlayerGameType           = 0x3e
+	IDRequestChunkRadius          = 0x45
+	IDCommandRequest              = 0x4d
+	IDTransfer                    = 0x55
+	IDMoveActorDelta              = 0x6f
+	IDSetLocalPlayerAsInitialised = 0x71
+	IDNetworkSettings             = 0x8f
+	IDScriptMessage               = 0xb1
+	IDRequestNetworkSettings      = 0xc1
+)
@@ -1,7 +1,5 @@
 package protocol
 
-import "log"
-
 // Login is sent when the client initially tries to join the server. It is the first packet sent and contains
 // information specific to the player.
 type Login struct {
@@ -14,10 +12,12 @@ type Login struct {
 	ConnectionRequest []byte
 }
 
+// ID ...
 func (pk *Login) ID() uint32 {
-	return 0x01
+	return IDLogin
 }
 
+// Unmarshal ...
 func (pk *Login) Unmarshal(r *Reader) error {
 	if err := r.BEInt32(&pk.ClientProtocol); err != nil {
 		return err
@@ -29,6 +29,7 @@ func (pk *Login) Unmarshal(r *Reader) error {
 }
 
 // Marshal ...
-func (pk *Login) Marshal(buf *Writer) {
-	log.Fatal("not implemented yet")
+func (pk *Login) Marshal(w *Writer) {
+	w.BEInt32(pk.ClientProtocol)
+	w.ByteSlice(pk.ConnectionRequest)
 }
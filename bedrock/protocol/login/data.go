@@ -5,9 +5,18 @@ import "github.com/golang-jwt/jwt/v4"
 // IdentityData contains identity data of the player logged in. It is found in one of the JWT claims signed
 // by Mojang, and can thus be trusted.
 type IdentityData struct {
+	// XUID is the XBOX Live user ID of the player, which will remain consistent as long as the player is
+	// logged in with the XBOX Live account. It is empty if the user is not logged into its XBL account.
+	XUID string `json:"XUID"`
+	// Identity is the UUID of the player, which will also remain consistent as long as the user is logged
+	// into its XBOX Live account.
+	Identity string `json:"identity"`
 	// DisplayName is the username of the player, which may be changed by the user. It should for that reason
 	// not be used as a key to store information.
 	DisplayName string `json:"displayName"`
+	// TitleID is a numerical ID present only if the user is logged into XBL. It holds the title ID (XBL
+	// related) of the version that the player is on.
+	TitleID string `json:"titleId"`
 }
 
 // ClientData is a container of client specific data of a Login packet. It holds data such as the skin of a
@@ -18,4 +27,19 @@ type ClientData struct {
 	// actual address, or a hostname. ServerAddress also has the port in it, in the shape of
 	// 'address:port`.
 	ServerAddress string
+	// DeviceOS is the operating system of the device that the player joined with, as a numeric ID.
+	DeviceOS int
+	// DeviceModel is a string indicating the device model used by the player. At the moment, it appears
+	// that this name is always '(Standard system devices) System devices'.
+	DeviceModel string
+	// GameVersion is the game version of the player that attempted to join, for example '1.11.0'.
+	GameVersion string
+	// LanguageCode is the language code of the player. It looks like 'en_UK'.
+	LanguageCode string
+	// CurrentInputMode is the input mode used by the client. It is 1 for mouse and keyboard, 2 for touch,
+	// 3 for gamepad and 4 for motion controllers.
+	CurrentInputMode int
+	// ClientRandomID is a random client ID number generated for the client. It usually remains consistent
+	// through different sessions and worlds, but can be changed arbitrarily.
+	ClientRandomID int64 `json:"ClientRandomId"`
 }
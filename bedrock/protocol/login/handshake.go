@@ -0,0 +1,79 @@
+package login
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// handshakeClaims holds the claims of the JWT of a ServerToClientHandshake packet.
+type handshakeClaims struct {
+	jwt.RegisteredClaims
+	// Salt is the base64 encoded salt that is used to derive the encryption key.
+	Salt string `json:"salt"`
+}
+
+// MarshalPublicKey encodes the public key in base64 encoded DER format, as it is
+// used in the x5u header and the identityPublicKey claim of tokens.
+func MarshalPublicKey(key *ecdsa.PublicKey) (string, error) {
+	b, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", fmt.Errorf("marshal public key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// sign signs the claims with the key passed and sets the x5u header to
+// the public key of the key.
+func sign(key *ecdsa.PrivateKey, claims jwt.Claims) (string, error) {
+	x5u, err := MarshalPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES384, claims)
+	token.Header["x5u"] = x5u
+	return token.SignedString(key)
+}
+
+// EncodeHandshake returns the JWT of a ServerToClientHandshake packet that
+// is signed by the key of the server and holds the salt passed.
+func EncodeHandshake(key *ecdsa.PrivateKey, salt []byte) ([]byte, error) {
+	token, err := sign(key, handshakeClaims{
+		Salt: strings.TrimRight(base64.StdEncoding.EncodeToString(salt), "="),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("sign handshake: %w", err)
+	}
+	return []byte(token), nil
+}
+
+// ParseHandshake parses the JWT of a ServerToClientHandshake packet and verifies
+// its signature. It returns the public key of the server and the salt.
+func ParseHandshake(token []byte) (*ecdsa.PublicKey, []byte, error) {
+	key, err := parseHeaderKey(string(token))
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse handshake key: %w", err)
+	}
+
+	var claims handshakeClaims
+	if err := verify(string(token), key, &claims); err != nil {
+		return nil, nil, fmt.Errorf("verify handshake: %w", err)
+	}
+
+	if claims.Salt == "" {
+		return nil, nil, errors.New("handshake has no salt")
+	}
+
+	// Servers differ in padding the salt or not
+	salt, err := base64.RawStdEncoding.DecodeString(strings.TrimRight(claims.Salt, "="))
+	if err != nil {
+		return nil, nil, fmt.Errorf("decode salt: %w", err)
+	}
+	return key, salt, nil
+}
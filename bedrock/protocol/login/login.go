@@ -2,8 +2,13 @@ package login
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/golang-jwt/jwt/v4"
@@ -22,52 +27,148 @@ type request struct {
 	RawToken string `json:"-"`
 }
 
-func Parse(request []byte) (IdentityData, ClientData, error) {
+// mojangPublicKey is the public key of Mojang that signs the login chains
+// of players that are authenticated with XBOX Live.
+const mojangPublicKey = "MHYwEAYHKoZIzj0CAQYFK4EEACIDYgAECRXueJeTDqNRRgJi/vlRufByu/2G0i2Ebt6YMar5QX/R0DIIyrJMcUpruK4QveTfJSTp3Shlq4Gk34cD/4GUWwkv0DVuzeuB+tXija7HBxii03NHDbPAD0AKnLr2wdAp"
+
+// MojangPublicKey is the parsed public key of Mojang that signs the login chains
+// of players that are authenticated with XBOX Live.
+var MojangPublicKey *ecdsa.PublicKey
+
+func init() {
+	key, err := ParsePublicKey(mojangPublicKey)
+	if err != nil {
+		panic(err)
+	}
+	MojangPublicKey = key
+}
+
+// AuthResult is the result of the verification of a login request.
+type AuthResult struct {
+	// PublicKey is the public key of the client that was verified
+	// through the chain. It is used to initiate the encryption.
+	PublicKey *ecdsa.PublicKey
+	// XBOXLiveAuthenticated reports if the chain was signed by the root key,
+	// meaning that the player is authenticated with XBOX Live.
+	// If false, the chain was self-signed by the client.
+	XBOXLiveAuthenticated bool
+}
+
+// Parse parses the login request and verifies its chain against the Mojang public key.
+func Parse(request []byte) (IdentityData, ClientData, AuthResult, error) {
+	return ParseWithRootKey(request, MojangPublicKey)
+}
+
+// ParseWithRootKey parses the login request and verifies its chain against the root key passed.
+// Every token of the chain has to be signed by the identity public key of the previous token, and the
+// first token has to be signed by the key in its own x5u header. The chain is only authenticated with
+// XBOX Live if one of its tokens is signed by the root key. A chain with invalid signatures, links or
+// expired tokens results in an error, regardless of it being authenticated or not.
+func ParseWithRootKey(request []byte, rootKey *ecdsa.PublicKey) (IdentityData, ClientData, AuthResult, error) {
 	req, err := parseLoginRequest(request)
 	if err != nil {
-		return IdentityData{}, ClientData{}, fmt.Errorf("parse login request: %w", err)
+		return IdentityData{}, ClientData{}, AuthResult{}, fmt.Errorf("parse login request: %w", err)
 	}
 
-	jwtParser := jwt.Parser{}
-	var identityClaims identityClaims
-	switch len(req.Chain) {
-	case 1:
-		// Player was not authenticated with XBOX Live, meaning the one token in here is self-signed.
-		_, _, err = jwtParser.ParseUnverified(req.Chain[2], &identityClaims)
-		if err != nil {
-			return IdentityData{}, ClientData{}, err
-		}
-		if err := identityClaims.Valid(); err != nil {
-			return IdentityData{}, ClientData{}, fmt.Errorf("validate token 0: %w", err)
-		}
-	case 3:
-		// Player was (or should be) authenticated with XBOX Live, meaning the chain is exactly 3 tokens
-		// long.
-		var c jwt.RegisteredClaims
-		_, _, err := jwtParser.ParseUnverified(req.Chain[0], &c)
-		if err != nil {
-			return IdentityData{}, ClientData{}, fmt.Errorf("parse token 0: %w", err)
+	if len(req.Chain) != 1 && len(req.Chain) != 3 {
+		return IdentityData{}, ClientData{}, AuthResult{}, fmt.Errorf("unexpected login chain length %v", len(req.Chain))
+	}
+
+	key, err := parseHeaderKey(req.Chain[0])
+	if err != nil {
+		return IdentityData{}, ClientData{}, AuthResult{}, fmt.Errorf("parse token 0: %w", err)
+	}
+
+	var authenticated bool
+	var claims identityClaims
+	for n, token := range req.Chain {
+		if key.Equal(rootKey) {
+			authenticated = true
 		}
 
-		_, _, err = jwtParser.ParseUnverified(req.Chain[1], &c)
-		if err != nil {
-			return IdentityData{}, ClientData{}, fmt.Errorf("parse token 1: %w", err)
+		claims = identityClaims{}
+		if err := verify(token, key, &claims); err != nil {
+			return IdentityData{}, ClientData{}, AuthResult{}, fmt.Errorf("verify token %d: %w", n, err)
 		}
-		_, _, err = jwtParser.ParseUnverified(req.Chain[2], &identityClaims)
+
+		key, err = ParsePublicKey(claims.IdentityPublicKey)
 		if err != nil {
-			return IdentityData{}, ClientData{}, fmt.Errorf("parse token 2: %w", err)
+			return IdentityData{}, ClientData{}, AuthResult{}, fmt.Errorf("parse identity public key of token %d: %w", n, err)
 		}
-	default:
-		return IdentityData{}, ClientData{}, fmt.Errorf("unexpected login chain length %v", len(req.Chain))
+	}
+
+	// The self-signed token of a chain that is authenticated has to
+	// link to the root key, otherwise the chain was tampered with
+	if len(req.Chain) == 3 && !authenticated {
+		return IdentityData{}, ClientData{}, AuthResult{}, errors.New("login chain is not signed by the root key")
 	}
 
 	var cData ClientData
-	_, _, err = jwtParser.ParseUnverified(req.RawToken, &cData)
+	if err := verify(req.RawToken, key, &cData); err != nil {
+		return IdentityData{}, ClientData{}, AuthResult{}, fmt.Errorf("verify client data: %w", err)
+	}
+
+	return claims.ExtraData, cData, AuthResult{
+		PublicKey:             key,
+		XBOXLiveAuthenticated: authenticated,
+	}, nil
+}
+
+// ParsePublicKey parses a base64 encoded, DER formatted ECDSA public key as
+// it is used in the x5u header and the identityPublicKey claim of tokens.
+func ParsePublicKey(s string) (*ecdsa.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("decode public key: %w", err)
+	}
+
+	pub, err := x509.ParsePKIXPublicKey(b)
 	if err != nil {
-		return IdentityData{}, cData, fmt.Errorf("parse client data: %w", err)
+		return nil, fmt.Errorf("parse public key: %w", err)
 	}
 
-	return identityClaims.ExtraData, cData, nil
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok || key.Curve != elliptic.P384() {
+		return nil, errors.New("public key is not an ECDSA P-384 key")
+	}
+	return key, nil
+}
+
+// parseHeaderKey parses the public key in the x5u header of the token.
+func parseHeaderKey(token string) (*ecdsa.PublicKey, error) {
+	t, _, err := new(jwt.Parser).ParseUnverified(token, &jwt.RegisteredClaims{})
+	if err != nil {
+		return nil, err
+	}
+	return headerKey(t)
+}
+
+func headerKey(t *jwt.Token) (*ecdsa.PublicKey, error) {
+	x5u, ok := t.Header["x5u"].(string)
+	if !ok {
+		return nil, errors.New("x5u header is missing")
+	}
+	return ParsePublicKey(x5u)
+}
+
+// verify verifies the ES384 signature of the token with the key passed and
+// validates the expiry of its claims. The x5u header of the token has to hold
+// the same key, since clients always send the key that they signed with.
+func verify(token string, key *ecdsa.PublicKey, claims jwt.Claims) error {
+	parser := jwt.Parser{
+		ValidMethods: []string{jwt.SigningMethodES384.Alg()},
+	}
+	_, err := parser.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		x5u, err := headerKey(t)
+		if err != nil {
+			return nil, err
+		}
+		if !x5u.Equal(key) {
+			return nil, errors.New("x5u header does not match the expected key")
+		}
+		return key, nil
+	})
+	return err
 }
 
 // parseLoginRequest parses the structure of a login request from the data passed and returns it.
@@ -84,6 +185,9 @@ func parseLoginRequest(requestData []byte) (*request, error) {
 	if err := binary.Read(buf, binary.LittleEndian, &rawLength); err != nil {
 		return nil, fmt.Errorf("error reading raw token length: %v", err)
 	}
+	if rawLength < 0 || int(rawLength) > buf.Len() {
+		return nil, fmt.Errorf("raw token length %v exceeds %v remaining bytes", rawLength, buf.Len())
+	}
 	return &request{Chain: chain, RawToken: string(buf.Next(int(rawLength)))}, nil
 }
 
@@ -93,6 +197,9 @@ func decodeChain(buf *bytes.Buffer) (chain, error) {
 	if err := binary.Read(buf, binary.LittleEndian, &chainLength); err != nil {
 		return nil, fmt.Errorf("error reading chain length: %v", err)
 	}
+	if chainLength < 0 || int(chainLength) > buf.Len() {
+		return nil, fmt.Errorf("chain length %v exceeds %v remaining bytes", chainLength, buf.Len())
+	}
 	chainData := buf.Next(int(chainLength))
 
 	request := &request{}
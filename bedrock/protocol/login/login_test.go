@@ -0,0 +1,298 @@
+package login_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/haveachin/bedprox/bedrock/protocol/login"
+)
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func marshalKey(t *testing.T, key *ecdsa.PublicKey) string {
+	b, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// signToken signs the claims with the signer key and sets the x5u header
+// to the public key of the signer, like clients and Mojang do.
+func signToken(t *testing.T, signer *ecdsa.PrivateKey, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodES384, claims)
+	token.Header["x5u"] = marshalKey(t, &signer.PublicKey)
+	s, err := token.SignedString(signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func identityClaims(t *testing.T, next *ecdsa.PublicKey, exp time.Time) jwt.MapClaims {
+	return jwt.MapClaims{
+		"identityPublicKey": marshalKey(t, next),
+		"nbf":               time.Now().Add(-time.Minute).Unix(),
+		"exp":               exp.Unix(),
+	}
+}
+
+func encodeRequest(t testing.TB, chain []string, rawToken string) []byte {
+	chainData, err := json.Marshal(map[string][]string{"chain": chain})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.Buffer{}
+	_ = binary.Write(&buf, binary.LittleEndian, int32(len(chainData)))
+	buf.Write(chainData)
+	_ = binary.Write(&buf, binary.LittleEndian, int32(len(rawToken)))
+	buf.WriteString(rawToken)
+	return buf.Bytes()
+}
+
+type keyChain struct {
+	root, mojang, client *ecdsa.PrivateKey
+}
+
+func newKeyChain(t *testing.T) keyChain {
+	return keyChain{
+		root:   newKey(t),
+		mojang: newKey(t),
+		client: newKey(t),
+	}
+}
+
+// authenticatedChain builds a chain like the one of a player that is signed in to XBOX Live.
+// The first token is self-signed by the client and links to the root key, which signs
+// the second token. The third token is signed by an intermediate key and holds the identity.
+func (kc keyChain) authenticatedChain(t *testing.T, exp time.Time) []string {
+	t0 := signToken(t, kc.client, identityClaims(t, &kc.root.PublicKey, exp))
+	t1 := signToken(t, kc.root, identityClaims(t, &kc.mojang.PublicKey, exp))
+
+	claims := identityClaims(t, &kc.client.PublicKey, exp)
+	claims["extraData"] = map[string]interface{}{
+		"XUID":        "2535412345678901",
+		"identity":    "5b0e1c52-9d8a-3b0e-a5d5-7b0f4a9c2f11",
+		"displayName": "Steve",
+		"titleId":     "896928775",
+	}
+	t2 := signToken(t, kc.mojang, claims)
+	return []string{t0, t1, t2}
+}
+
+func (kc keyChain) clientData(t *testing.T) string {
+	return signToken(t, kc.client, jwt.MapClaims{
+		"ServerAddress":    "play.example.com:19132",
+		"DeviceOS":         7,
+		"DeviceModel":      "System devices",
+		"GameVersion":      "1.19.50",
+		"LanguageCode":     "en_US",
+		"CurrentInputMode": 1,
+		"ClientRandomId":   int64(-4856732719420013757),
+	})
+}
+
+func TestParseWithRootKey(t *testing.T) {
+	kc := newKeyChain(t)
+	exp := time.Now().Add(time.Hour)
+
+	selfSignedClaims := identityClaims(t, &kc.client.PublicKey, exp)
+	selfSignedClaims["extraData"] = map[string]interface{}{
+		"displayName": "Alex",
+	}
+	selfSigned := signToken(t, kc.client, selfSignedClaims)
+
+	authenticated := kc.authenticatedChain(t, exp)
+
+	otherKey := newKey(t)
+	brokenLink := kc.authenticatedChain(t, exp)
+	brokenLink[2] = signToken(t, otherKey, identityClaims(t, &kc.client.PublicKey, exp))
+
+	otherRoot := newKeyChain(t)
+	otherRoot.client = kc.client
+
+	tt := []struct {
+		name          string
+		chain         []string
+		rawToken      string
+		username      string
+		xuid          string
+		authenticated bool
+		shouldFail    bool
+	}{
+		{
+			name:          "Authenticated",
+			chain:         authenticated,
+			rawToken:      kc.clientData(t),
+			username:      "Steve",
+			xuid:          "2535412345678901",
+			authenticated: true,
+		},
+		{
+			name:          "SelfSigned",
+			chain:         []string{selfSigned},
+			rawToken:      kc.clientData(t),
+			username:      "Alex",
+			authenticated: false,
+		},
+		{
+			name:       "ErrorsWithBrokenLink",
+			chain:      brokenLink,
+			rawToken:   kc.clientData(t),
+			shouldFail: true,
+		},
+		{
+			name:       "ErrorsWithUnknownRootKey",
+			chain:      otherRoot.authenticatedChain(t, exp),
+			rawToken:   kc.clientData(t),
+			shouldFail: true,
+		},
+		{
+			name:       "ErrorsWithExpiredToken",
+			chain:      kc.authenticatedChain(t, time.Now().Add(-time.Second)),
+			rawToken:   kc.clientData(t),
+			shouldFail: true,
+		},
+		{
+			name:  "ErrorsWithForeignClientData",
+			chain: authenticated,
+			rawToken: signToken(t, otherKey, jwt.MapClaims{
+				"ServerAddress": "play.example.com:19132",
+			}),
+			shouldFail: true,
+		},
+		{
+			name:       "ErrorsWithUnexpectedChainLength",
+			chain:      authenticated[:2],
+			rawToken:   kc.clientData(t),
+			shouldFail: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			req := encodeRequest(t, tc.chain, tc.rawToken)
+			iData, cData, authResult, err := login.ParseWithRootKey(req, &kc.root.PublicKey)
+			if tc.shouldFail {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if iData.DisplayName != tc.username {
+				t.Errorf("expected username %q; got %q", tc.username, iData.DisplayName)
+			}
+
+			if iData.XUID != tc.xuid {
+				t.Errorf("expected xuid %q; got %q", tc.xuid, iData.XUID)
+			}
+
+			if cData.ServerAddress != "play.example.com:19132" {
+				t.Errorf("unexpected server address %q", cData.ServerAddress)
+			}
+
+			if cData.DeviceOS != 7 || cData.GameVersion != "1.19.50" || cData.LanguageCode != "en_US" ||
+				cData.CurrentInputMode != 1 || cData.ClientRandomID != -4856732719420013757 {
+				t.Errorf("unexpected client data %+v", cData)
+			}
+
+			if authResult.XBOXLiveAuthenticated != tc.authenticated {
+				t.Errorf("expected authenticated to be %v", tc.authenticated)
+			}
+
+			if !authResult.PublicKey.Equal(&kc.client.PublicKey) {
+				t.Error("public key does not match the client key")
+			}
+		})
+	}
+}
+
+func FuzzParse(f *testing.F) {
+	f.Add(encodeRequest(f, []string{"a.b.c"}, "d.e.f"))
+	f.Add(encodeRequest(f, []string{"a.b.c", "d.e.f", "g.h.i"}, ""))
+	f.Add([]byte{0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, request []byte) {
+		_, _, _, _ = login.Parse(request)
+	})
+}
+
+func TestHandshake(t *testing.T) {
+	key := newKey(t)
+	salt := []byte("0123456789abcdef")
+
+	token, err := login.EncodeHandshake(key, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pub, parsedSalt, err := login.ParseHandshake(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pub.Equal(&key.PublicKey) {
+		t.Error("expected the public key of the signer")
+	}
+	if !bytes.Equal(parsedSalt, salt) {
+		t.Errorf("expected salt %x; got %x", salt, parsedSalt)
+	}
+
+	// Tokens that are signed by another key than in their x5u header are rejected
+	forged := jwt.NewWithClaims(jwt.SigningMethodES384, jwt.MapClaims{"salt": "c2FsdA"})
+	forged.Header["x5u"] = marshalKey(t, &key.PublicKey)
+	s, err := forged.SignedString(newKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := login.ParseHandshake([]byte(s)); err == nil {
+		t.Error("expected an error for a forged handshake")
+	}
+}
+
+func TestResign(t *testing.T) {
+	kc := newKeyChain(t)
+	request := encodeRequest(t, kc.authenticatedChain(t, time.Now().Add(time.Hour)), kc.clientData(t))
+
+	proxyKey := newKey(t)
+	resigned, err := login.Resign(request, proxyKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	iData, cData, authResult, err := login.ParseWithRootKey(resigned, &kc.root.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if authResult.XBOXLiveAuthenticated {
+		t.Error("expected the resigned request to be self-signed")
+	}
+	if !authResult.PublicKey.Equal(&proxyKey.PublicKey) {
+		t.Error("expected the identity public key to be the key of the proxy")
+	}
+	if iData.DisplayName != "Steve" || iData.XUID != "2535412345678901" {
+		t.Errorf("expected the identity data to be kept; got %+v", iData)
+	}
+	if cData.ServerAddress != "play.example.com:19132" || cData.ClientRandomID != -4856732719420013757 {
+		t.Errorf("expected the client data to be kept; got %+v", cData)
+	}
+}
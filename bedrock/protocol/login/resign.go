@@ -0,0 +1,85 @@
+package login
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// selfSignedExpiry is the lifetime of the tokens of a self-signed chain.
+const selfSignedExpiry = 6 * time.Hour
+
+// Resign returns a copy of the login request that is self-signed by the key passed,
+// like the request of a client that is not signed in to XBOX Live. The identity data
+// and client data of the request are kept as they are. The request has to be verified
+// with Parse before, since its signatures are not checked again.
+//
+// A proxy uses the resigned request to log in to a server with its own key, so that it
+// is able to complete the encryption handshake with the server. The server has to accept
+// players that are not authenticated with XBOX Live for that.
+func Resign(requestData []byte, key *ecdsa.PrivateKey) ([]byte, error) {
+	req, err := parseLoginRequest(requestData)
+	if err != nil {
+		return nil, fmt.Errorf("parse login request: %w", err)
+	}
+
+	// Numbers have to be kept as they are, since some of them,
+	// like the ClientRandomId, do not fit into a float64
+	parser := jwt.Parser{UseJSONNumber: true}
+	identity := jwt.MapClaims{}
+	if _, _, err := parser.ParseUnverified(req.Chain[len(req.Chain)-1], identity); err != nil {
+		return nil, fmt.Errorf("parse identity token: %w", err)
+	}
+	clientData := jwt.MapClaims{}
+	if _, _, err := parser.ParseUnverified(req.RawToken, clientData); err != nil {
+		return nil, fmt.Errorf("parse client data: %w", err)
+	}
+
+	pub, err := MarshalPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	token, err := sign(key, jwt.MapClaims{
+		"extraData":         identity["extraData"],
+		"identityPublicKey": pub,
+		"nbf":               now.Add(-time.Minute).Unix(),
+		"exp":               now.Add(selfSignedExpiry).Unix(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("sign identity: %w", err)
+	}
+
+	rawToken, err := sign(key, clientData)
+	if err != nil {
+		return nil, fmt.Errorf("sign client data: %w", err)
+	}
+
+	return encodeLoginRequest(request{Chain: chain{token}, RawToken: rawToken})
+}
+
+// encodeLoginRequest encodes the request in the format that parseLoginRequest reads.
+func encodeLoginRequest(req request) ([]byte, error) {
+	if len(req.Chain) == 0 {
+		return nil, errors.New("JWT chain must be at least 1 token long")
+	}
+
+	chainData, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("encode request chain JSON: %w", err)
+	}
+
+	buf := bytes.Buffer{}
+	_ = binary.Write(&buf, binary.LittleEndian, int32(len(chainData)))
+	buf.Write(chainData)
+	_ = binary.Write(&buf, binary.LittleEndian, int32(len(req.RawToken)))
+	buf.WriteString(req.RawToken)
+	return buf.Bytes(), nil
+}
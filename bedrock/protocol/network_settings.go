@@ -0,0 +1,55 @@
+package protocol
+
+const (
+	// CompressionAlgorithmFlate is the raw DEFLATE compression algorithm
+	CompressionAlgorithmFlate uint16 = iota
+	// CompressionAlgorithmSnappy is the Snappy compression algorithm
+	CompressionAlgorithmSnappy
+)
+
+// NetworkSettings is sent by the server in response to a RequestNetworkSettings packet. It holds the
+// settings that apply to the network connection, like the compression that is used from now on.
+type NetworkSettings struct {
+	// CompressionThreshold is the minimum size of a packet that is compressed when sent. If the size of a
+	// packet is under this value, it is not compressed.
+	CompressionThreshold uint16
+	// CompressionAlgorithm is the algorithm that is used to compress packets.
+	CompressionAlgorithm uint16
+	// ClientThrottle regulates whether the client should throttle players when exceeding the threshold.
+	ClientThrottle bool
+	// ClientThrottleThreshold is the threshold for client throttling.
+	ClientThrottleThreshold uint8
+	// ClientThrottleScalar is the scalar for client throttling.
+	ClientThrottleScalar float32
+}
+
+// ID ...
+func (*NetworkSettings) ID() uint32 {
+	return IDNetworkSettings
+}
+
+// Marshal ...
+func (pk *NetworkSettings) Marshal(w *Writer) {
+	w.Uint16(pk.CompressionThreshold)
+	w.Uint16(pk.CompressionAlgorithm)
+	w.Bool(pk.ClientThrottle)
+	w.Uint8(pk.ClientThrottleThreshold)
+	w.Float32(pk.ClientThrottleScalar)
+}
+
+// Unmarshal ...
+func (pk *NetworkSettings) Unmarshal(r *Reader) error {
+	if err := r.Uint16(&pk.CompressionThreshold); err != nil {
+		return err
+	}
+	if err := r.Uint16(&pk.CompressionAlgorithm); err != nil {
+		return err
+	}
+	if err := r.Bool(&pk.ClientThrottle); err != nil {
+		return err
+	}
+	if err := r.Uint8(&pk.ClientThrottleThreshold); err != nil {
+		return err
+	}
+	return r.Float32(&pk.ClientThrottleScalar)
+}
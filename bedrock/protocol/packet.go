@@ -23,6 +23,11 @@ func (header *Header) Write(w io.ByteWriter) error {
 	return w.WriteByte(byte(x))
 }
 
+// Marshal writes the header to the Writer, which keeps any error.
+func (header *Header) Marshal(w *Writer) {
+	w.Varuint32(header.PacketID | (uint32(header.SenderSubClient) << 10) | (uint32(header.TargetSubClient) << 12))
+}
+
 func (header *Header) Read(r io.ByteReader) error {
 	var value uint32
 	if err := Varuint32(r, &value); err != nil {
@@ -34,7 +39,13 @@ func (header *Header) Read(r io.ByteReader) error {
 	return nil
 }
 
+// UnmarshalPacket unmarshals the packet in the layout of the oldest supported protocol version.
 func UnmarshalPacket(b []byte, pk Packet) error {
+	return UnmarshalPacketFor(b, pk, 0)
+}
+
+// UnmarshalPacketFor unmarshals the packet in the layout of the protocol version of the client passed.
+func UnmarshalPacketFor(b []byte, pk Packet, clientProtocol int32) error {
 	data, err := parseData(b)
 	if err != nil {
 		return err
@@ -44,19 +55,37 @@ func UnmarshalPacket(b []byte, pk Packet) error {
 		return fmt.Errorf("invalid id: 0x%x", data.h.PacketID)
 	}
 
-	return data.decode(pk)
+	return data.decode(pk, clientProtocol)
 }
 
+// MarshalPacket marshals the packet into a batch that is compressed with the DefaultCompression.
 func MarshalPacket(pk Packet) ([]byte, error) {
+	return MarshalPacketWith(pk, DefaultCompression)
+}
+
+// MarshalPacketWith marshals the packet into a batch that is compressed with the compression passed. The
+// packet is marshaled in the layout of the oldest supported protocol version.
+func MarshalPacketWith(pk Packet, c Compression) ([]byte, error) {
+	return MarshalPacketFor(pk, c, 0)
+}
+
+// MarshalPacketFor marshals the packet in the layout of the protocol version of the client passed into a
+// batch that is compressed with the compression passed.
+func MarshalPacketFor(pk Packet, c Compression, clientProtocol int32) ([]byte, error) {
 	buf := bytes.NewBuffer([]byte{})
 	w := NewWriter(buf)
+	w.SetProtocol(clientProtocol)
 
 	header := Header{PacketID: pk.ID()}
-	_ = header.Write(w)
+	header.Marshal(w)
 	pk.Marshal(w)
+	if err := w.Err(); err != nil {
+		return nil, fmt.Errorf("marshal %T: %w", pk, err)
+	}
 
 	encodedPk := bytes.NewBuffer([]byte{})
 	encoder := NewEncoder(encodedPk)
+	encoder.SetCompression(c)
 	if err := encoder.Encode(buf.Bytes()); err != nil {
 		return nil, err
 	}
@@ -90,12 +119,16 @@ type Packet interface {
 	// Unmarshal decodes a serialised packet in buf into the Packet instance. The serialised packet passed
 	// into Unmarshal will not have a header in it.
 	Unmarshal(r *Reader) error
+	// Marshal encodes the packet into its binary form. The serialised packet does not have a header in it.
+	// Errors are kept by the Writer and returned by MarshalPacket.
 	Marshal(w *Writer)
 }
 
 // decode decodes the packet payload held in the packetData and returns the packet.Packet decoded.
-func (p *packetData) decode(pk Packet) error {
-	if err := pk.Unmarshal(NewReader(p.payload)); err != nil {
+func (p *packetData) decode(pk Packet, clientProtocol int32) error {
+	r := NewReader(p.payload)
+	r.SetProtocol(clientProtocol)
+	if err := pk.Unmarshal(r); err != nil {
 		return err
 	}
 	if p.payload.Len() != 0 {
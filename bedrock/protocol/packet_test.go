@@ -0,0 +1,234 @@
+package protocol_test
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/haveachin/bedprox/bedrock/protocol"
+)
+
+func TestDecode_RoundTrip(t *testing.T) {
+	loadingScreenID := uint32(7)
+	tt := []protocol.Packet{
+		&protocol.Login{
+			ClientProtocol:    560,
+			ConnectionRequest: []byte(`{"chain":["a.b.c"]}`),
+		},
+		&protocol.PlayStatus{
+			Status: protocol.PlayStatusLoginFailedServerFull,
+		},
+		&protocol.ServerToClientHandshake{
+			JWT: []byte("header.payload.signature"),
+		},
+		&protocol.ClientToServerHandshake{},
+		&protocol.Disconnect{
+			Message: "Server closed",
+		},
+		&protocol.Disconnect{
+			HideDisconnectionScreen: true,
+		},
+		&protocol.NetworkSettings{
+			CompressionThreshold:    256,
+			CompressionAlgorithm:    protocol.CompressionAlgorithmFlate,
+			ClientThrottle:          true,
+			ClientThrottleThreshold: 10,
+			ClientThrottleScalar:    0.5,
+		},
+		&protocol.RequestNetworkSettings{
+			ClientProtocol: 560,
+		},
+		&protocol.Transfer{
+			Address: "play.example.com",
+			Port:    19132,
+		},
+		&protocol.ResourcePackClientResponse{
+			Response:        protocol.PackResponseSendPacks,
+			PacksToDownload: []string{"0fba4063-dba1-4281-9b89-ff9390653530_1.0.0"},
+		},
+		&protocol.ResourcePackClientResponse{
+			Response: protocol.PackResponseCompleted,
+		},
+		&protocol.RemoveActor{
+			EntityUniqueID: -42,
+		},
+		&protocol.ChangeDimension{
+			Dimension: protocol.DimensionNether,
+			Position:  [3]float32{0.5, 64, -12.5},
+		},
+		&protocol.ChangeDimension{
+			Dimension:       protocol.DimensionOverworld,
+			Respawn:         true,
+			LoadingScreenID: &loadingScreenID,
+		},
+		&protocol.SetPlayerGameType{
+			GameType: 1,
+		},
+		&protocol.SetLocalPlayerAsInitialised{
+			EntityRuntimeID: 1,
+		},
+		&protocol.ScriptMessage{
+			Identifier: "bedprox:transfer",
+			Data:       []byte("survival"),
+		},
+	}
+
+	for _, pk := range tt {
+		t.Run(reflect.TypeOf(pk).Elem().Name(), func(t *testing.T) {
+			b, err := protocol.MarshalPacket(pk)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pks, err := protocol.NewDecoder(bytes.NewReader(b)).Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(pks) != 1 {
+				t.Fatalf("expected 1 packet; got %d", len(pks))
+			}
+
+			decoded, err := protocol.Decode(pks[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(pk, decoded) {
+				t.Errorf("expected %#v; got %#v", pk, decoded)
+			}
+		})
+	}
+}
+
+func TestDecodeFor_Protocol(t *testing.T) {
+	disconnect := &protocol.Disconnect{
+		Reason:          5,
+		Message:         "Server closed",
+		FilteredMessage: "Server closed",
+	}
+	transfer := &protocol.Transfer{
+		Address:     "play.example.com",
+		Port:        19132,
+		ReloadWorld: true,
+	}
+
+	tt := []struct {
+		name     string
+		pk       protocol.Packet
+		protocol int32
+		// expected is the packet without the fields that the protocol
+		// version does not have
+		expected protocol.Packet
+	}{
+		{
+			name:     "disconnect before reason",
+			pk:       disconnect,
+			protocol: 560,
+			expected: &protocol.Disconnect{Message: "Server closed"},
+		},
+		{
+			name:     "disconnect with reason",
+			pk:       disconnect,
+			protocol: protocol.DisconnectReasonProtocol,
+			expected: &protocol.Disconnect{Reason: 5, Message: "Server closed"},
+		},
+		{
+			name:     "disconnect with filtered message",
+			pk:       disconnect,
+			protocol: protocol.DisconnectFilteredMessageProtocol,
+			expected: disconnect,
+		},
+		{
+			name:     "hidden disconnect with reason",
+			pk:       &protocol.Disconnect{Reason: 5, HideDisconnectionScreen: true},
+			protocol: protocol.DisconnectFilteredMessageProtocol,
+			expected: &protocol.Disconnect{Reason: 5, HideDisconnectionScreen: true},
+		},
+		{
+			name:     "transfer before reload world",
+			pk:       transfer,
+			protocol: protocol.TransferReloadWorldProtocol - 1,
+			expected: &protocol.Transfer{Address: "play.example.com", Port: 19132},
+		},
+		{
+			name:     "transfer with reload world",
+			pk:       transfer,
+			protocol: protocol.TransferReloadWorldProtocol,
+			expected: transfer,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := protocol.MarshalPacketFor(tc.pk, protocol.DefaultCompression, tc.protocol)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			pks, err := protocol.NewDecoder(bytes.NewReader(b)).Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(pks) != 1 {
+				t.Fatalf("expected 1 packet; got %d", len(pks))
+			}
+
+			decoded, err := protocol.DecodeFor(pks[0], tc.protocol)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(tc.expected, decoded) {
+				t.Errorf("expected %#v; got %#v", tc.expected, decoded)
+			}
+		})
+	}
+}
+
+func TestDecode_UnknownPacket(t *testing.T) {
+	_, err := protocol.Decode([]byte{0x7f})
+	if !errors.Is(err, protocol.ErrUnknownPacket) {
+		t.Errorf("expected ErrUnknownPacket; got %v", err)
+	}
+}
+
+func TestDecode_UnreadBytes(t *testing.T) {
+	_, err := protocol.Decode([]byte{protocol.IDPlayStatus, 0x00, 0x00, 0x00, 0x07, 0xff})
+	if err == nil {
+		t.Error("expected an error for unread bytes")
+	}
+}
+
+func FuzzUnmarshalPacket(f *testing.F) {
+	for _, pk := range []protocol.Packet{
+		&protocol.Login{ClientProtocol: 560, ConnectionRequest: []byte("{}")},
+		&protocol.Disconnect{Message: "bye"},
+		&protocol.Transfer{Address: "example.com", Port: 19132},
+		&protocol.NetworkSettings{CompressionThreshold: 1},
+	} {
+		buf := &bytes.Buffer{}
+		w := protocol.NewWriter(buf)
+		header := protocol.Header{PacketID: pk.ID()}
+		_ = header.Write(w)
+		pk.Marshal(w)
+		f.Add(buf.Bytes())
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var loginPk protocol.Login
+		_ = protocol.UnmarshalPacket(b, &loginPk)
+
+		pk, err := protocol.Decode(b)
+		if err != nil {
+			return
+		}
+
+		// Every packet that decodes has to marshal again
+		if _, err := protocol.MarshalPacket(pk); err != nil {
+			t.Errorf("marshal decoded %T: %v", pk, err)
+		}
+	})
+}
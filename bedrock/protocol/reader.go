@@ -3,44 +3,151 @@ package protocol
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"math"
 )
 
+// MaxSliceLength is the maximum length of byte slices and strings that are read or written.
+const MaxSliceLength = 1 << 24
+
 type DecodeReader interface {
 	io.Reader
 	io.ByteReader
 }
 
+// lenReader is implemented by readers that know how many bytes are left to read, like bytes.Buffer and
+// bytes.Reader.
+type lenReader interface {
+	Len() int
+}
+
 type Reader struct {
 	DecodeReader
+	// protocol is the protocol version of the client that the packets are read for
+	protocol int32
 }
 
 func NewReader(r DecodeReader) *Reader {
 	return &Reader{DecodeReader: r}
 }
 
+// SetProtocol sets the protocol version of the client that the packets are read for. Packets are read
+// in the layout of the oldest supported protocol version until it is set.
+func (r *Reader) SetProtocol(protocol int32) {
+	r.protocol = protocol
+}
+
+// Protocol returns the protocol version of the client that the packets are read for.
+func (r *Reader) Protocol() int32 {
+	return r.protocol
+}
+
+func (r *Reader) Bool(x *bool) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	*x = b != 0x00
+	return nil
+}
+
+func (r *Reader) Uint8(x *uint8) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	*x = b
+	return nil
+}
+
+func (r *Reader) Int8(x *int8) error {
+	b, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	*x = int8(b)
+	return nil
+}
+
+func (r *Reader) Uint16(x *uint16) error {
+	b := make([]byte, 2)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	*x = binary.LittleEndian.Uint16(b)
+	return nil
+}
+
+func (r *Reader) Int16(x *int16) error {
+	var v uint16
+	if err := r.Uint16(&v); err != nil {
+		return err
+	}
+	*x = int16(v)
+	return nil
+}
+
+func (r *Reader) Uint32(x *uint32) error {
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	*x = binary.LittleEndian.Uint32(b)
+	return nil
+}
+
+func (r *Reader) Int32(x *int32) error {
+	var v uint32
+	if err := r.Uint32(&v); err != nil {
+		return err
+	}
+	*x = int32(v)
+	return nil
+}
+
 func (r *Reader) BEInt32(x *int32) error {
 	b := make([]byte, 4)
-	if _, err := r.Read(b); err != nil {
+	if _, err := io.ReadFull(r, b); err != nil {
 		return err
 	}
 	*x = int32(binary.BigEndian.Uint32(b))
 	return nil
 }
 
-func (r *Reader) ByteSlice(x *[]byte) error {
-	var length uint32
-	r.Varuint32(&length)
-	l := int(length)
-	int32max := 1<<31 - 1
-	if l > int32max {
-		return errors.New("byte slice overflows int32")
+func (r *Reader) Uint64(x *uint64) error {
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
 	}
-	data := make([]byte, l)
-	if _, err := r.Read(data); err != nil {
+	*x = binary.LittleEndian.Uint64(b)
+	return nil
+}
+
+func (r *Reader) Int64(x *int64) error {
+	var v uint64
+	if err := r.Uint64(&v); err != nil {
 		return err
 	}
-	*x = data
+	*x = int64(v)
+	return nil
+}
+
+func (r *Reader) Float32(x *float32) error {
+	var v uint32
+	if err := r.Uint32(&v); err != nil {
+		return err
+	}
+	*x = math.Float32frombits(v)
+	return nil
+}
+
+func (r *Reader) Float64(x *float64) error {
+	var v uint64
+	if err := r.Uint64(&v); err != nil {
+		return err
+	}
+	*x = math.Float64frombits(v)
 	return nil
 }
 
@@ -60,3 +167,131 @@ func (r *Reader) Varuint32(x *uint32) error {
 	}
 	return errors.New("varint overflows int32")
 }
+
+// Varint32 reads a zigzag encoded int32.
+func (r *Reader) Varint32(x *int32) error {
+	var v uint32
+	if err := r.Varuint32(&v); err != nil {
+		return err
+	}
+	*x = int32(v>>1) ^ -int32(v&1)
+	return nil
+}
+
+func (r *Reader) Varuint64(x *uint64) error {
+	var v uint64
+	for i := 0; i < 70; i += 7 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		v |= uint64(b&0x7f) << i
+		if b&0x80 == 0 {
+			*x = v
+			return nil
+		}
+	}
+	return errors.New("varint overflows int64")
+}
+
+// Varint64 reads a zigzag encoded int64.
+func (r *Reader) Varint64(x *int64) error {
+	var v uint64
+	if err := r.Varuint64(&v); err != nil {
+		return err
+	}
+	*x = int64(v>>1) ^ -int64(v&1)
+	return nil
+}
+
+// Vec3 reads the three float32 components of a vector.
+func (r *Reader) Vec3(x *[3]float32) error {
+	for n := range x {
+		if err := r.Float32(&x[n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remaining reports if there are bytes left to read. It always reports true
+// for readers that do not know how many bytes are left.
+func (r *Reader) Remaining() bool {
+	lr, ok := r.DecodeReader.(lenReader)
+	return !ok || lr.Len() > 0
+}
+
+// length reads a varuint32 length prefix and checks it against max and
+// the bytes that are left to read, before anything is allocated for it.
+func (r *Reader) length(max int) (int, error) {
+	var length uint32
+	if err := r.Varuint32(&length); err != nil {
+		return 0, err
+	}
+
+	l := int(length)
+	if l > max {
+		return 0, fmt.Errorf("length %d exceeds %d", l, max)
+	}
+
+	if lr, ok := r.DecodeReader.(lenReader); ok && l > lr.Len() {
+		return 0, fmt.Errorf("length %d exceeds %d remaining bytes", l, lr.Len())
+	}
+	return l, nil
+}
+
+// ByteSlice reads a byte slice that is prefixed with its varuint32 length.
+func (r *Reader) ByteSlice(x *[]byte) error {
+	l, err := r.length(MaxSliceLength)
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, l)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	*x = data
+	return nil
+}
+
+// String reads a string that is prefixed with its varuint32 length.
+func (r *Reader) String(x *string) error {
+	return r.LimitedString(x, MaxSliceLength)
+}
+
+// LimitedString reads a string that is prefixed with its varuint32 length
+// and fails if the string is longer than max bytes.
+func (r *Reader) LimitedString(x *string, max int) error {
+	l, err := r.length(max)
+	if err != nil {
+		return err
+	}
+
+	data := make([]byte, l)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	*x = string(data)
+	return nil
+}
+
+// Bytes reads exactly len(x) raw bytes without a length prefix.
+func (r *Reader) Bytes(x []byte) error {
+	_, err := io.ReadFull(r, x)
+	return err
+}
+
+// UUID reads a UUID that is written as two little endian uint64s.
+func (r *Reader) UUID(x *UUID) error {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return err
+	}
+	for n := 0; n < 8; n++ {
+		x[n] = b[7-n]
+		x[n+8] = b[15-n]
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package protocol_test
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/haveachin/bedprox/bedrock/protocol"
+)
+
+func TestReaderWriter_RoundTrip(t *testing.T) {
+	id, err := protocol.ParseUUID("123e4567-e89b-12d3-a456-426614174000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	w := protocol.NewWriter(buf)
+	w.Bool(true)
+	w.Uint8(0xab)
+	w.Int8(-12)
+	w.Uint16(0xbeef)
+	w.Int16(-1234)
+	w.Uint32(0xdeadbeef)
+	w.Int32(math.MinInt32)
+	w.BEInt32(-42)
+	w.Uint64(math.MaxUint64)
+	w.Int64(math.MinInt64)
+	w.Float32(3.25)
+	w.Float64(-1.5e300)
+	w.Varuint32(math.MaxUint32)
+	w.Varint32(math.MinInt32)
+	w.Varuint64(math.MaxUint64)
+	w.Varint64(math.MinInt64)
+	w.String("BedProx")
+	w.ByteSlice([]byte{0x01, 0x02})
+	w.UUID(id)
+	if err := w.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		b    bool
+		u8   uint8
+		i8   int8
+		u16  uint16
+		i16  int16
+		u32  uint32
+		i32  int32
+		be32 int32
+		u64  uint64
+		i64  int64
+		f32  float32
+		f64  float64
+		vu32 uint32
+		vi32 int32
+		vu64 uint64
+		vi64 int64
+		s    string
+		bs   []byte
+		uuid protocol.UUID
+	)
+	r := protocol.NewReader(buf)
+	for _, err := range []error{
+		r.Bool(&b), r.Uint8(&u8), r.Int8(&i8), r.Uint16(&u16), r.Int16(&i16), r.Uint32(&u32),
+		r.Int32(&i32), r.BEInt32(&be32), r.Uint64(&u64), r.Int64(&i64), r.Float32(&f32), r.Float64(&f64),
+		r.Varuint32(&vu32), r.Varint32(&vi32), r.Varuint64(&vu64), r.Varint64(&vi64), r.String(&s),
+		r.ByteSlice(&bs), r.UUID(&uuid),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if !b || u8 != 0xab || i8 != -12 || u16 != 0xbeef || i16 != -1234 || u32 != 0xdeadbeef ||
+		i32 != math.MinInt32 || be32 != -42 || u64 != math.MaxUint64 || i64 != math.MinInt64 ||
+		f32 != 3.25 || f64 != -1.5e300 || vu32 != math.MaxUint32 || vi32 != math.MinInt32 ||
+		vu64 != math.MaxUint64 || vi64 != math.MinInt64 || s != "BedProx" ||
+		!bytes.Equal(bs, []byte{0x01, 0x02}) || uuid != id {
+		t.Error("decoded values do not match the encoded values")
+	}
+
+	if uuid.String() != "123e4567-e89b-12d3-a456-426614174000" {
+		t.Errorf("unexpected uuid %s", uuid)
+	}
+
+	if buf.Len() != 0 {
+		t.Errorf("%d unread bytes left", buf.Len())
+	}
+}
+
+func TestReader_BoundedLength(t *testing.T) {
+	tt := []struct {
+		name string
+		data []byte
+	}{
+		{
+			name: "LongerThanRemaining",
+			data: []byte{0x05, 'a', 'b'},
+		},
+		{
+			name: "LongerThanMaximum",
+			data: []byte{0xff, 0xff, 0xff, 0xff, 0x0f},
+		},
+		{
+			name: "UnterminatedVarint",
+			data: []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var b []byte
+			if err := protocol.NewReader(bytes.NewBuffer(tc.data)).ByteSlice(&b); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+
+	var s string
+	r := protocol.NewReader(bytes.NewBuffer([]byte{0x03, 'a', 'b', 'c'}))
+	if err := r.LimitedString(&s, 2); err == nil {
+		t.Error("expected an error for a string that exceeds its limit")
+	}
+}
+
+var errWrite = errors.New("write failed")
+
+type failingWriter struct {
+	bytes.Buffer
+	failAfter int
+}
+
+func (fw *failingWriter) Write(b []byte) (int, error) {
+	if fw.Len()+len(b) > fw.failAfter {
+		return 0, errWrite
+	}
+	return fw.Buffer.Write(b)
+}
+
+func (fw *failingWriter) WriteByte(b byte) error {
+	if fw.Len()+1 > fw.failAfter {
+		return errWrite
+	}
+	return fw.Buffer.WriteByte(b)
+}
+
+func TestWriter_StickyError(t *testing.T) {
+	fw := &failingWriter{failAfter: 2}
+	w := protocol.NewWriter(fw)
+	w.Uint16(1)
+	w.Uint32(2)
+	w.Uint8(3)
+	if !errors.Is(w.Err(), errWrite) {
+		t.Errorf("expected the first write error; got %v", w.Err())
+	}
+
+	if fw.Len() != 2 {
+		t.Errorf("expected writes after the error to be dropped; got %d bytes", fw.Len())
+	}
+}
@@ -0,0 +1,61 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrUnknownPacket is returned by Decode if no packet is registered for the ID of the packet data.
+var ErrUnknownPacket = errors.New("unknown packet")
+
+// registry maps packet IDs to functions that return a new instance of the packet.
+var registry = map[uint32]func() Packet{
+	IDLogin:                       func() Packet { return &Login{} },
+	IDPlayStatus:                  func() Packet { return &PlayStatus{} },
+	IDServerToClientHandshake:     func() Packet { return &ServerToClientHandshake{} },
+	IDClientToServerHandshake:     func() Packet { return &ClientToServerHandshake{} },
+	IDDisconnect:                  func() Packet { return &Disconnect{} },
+	IDResourcePackClientResponse:  func() Packet { return &ResourcePackClientResponse{} },
+	IDRemoveActor:                 func() Packet { return &RemoveActor{} },
+	IDChangeDimension:             func() Packet { return &ChangeDimension{} },
+	IDSetPlayerGameType:           func() Packet { return &SetPlayerGameType{} },
+	IDTransfer:                    func() Packet { return &Transfer{} },
+	IDSetLocalPlayerAsInitialised: func() Packet { return &SetLocalPlayerAsInitialised{} },
+	IDNetworkSettings:             func() Packet { return &NetworkSettings{} },
+	IDScriptMessage:               func() Packet { return &ScriptMessage{} },
+	IDRequestNetworkSettings:      func() Packet { return &RequestNetworkSettings{} },
+}
+
+// Register registers a function that returns a new instance of a packet, so that Decode returns a packet
+// of that type for its ID. A packet that is already registered with the same ID is replaced.
+// Register is not safe for concurrent use and should be called during initialisation.
+func Register(newPacket func() Packet) {
+	registry[newPacket().ID()] = newPacket
+}
+
+// Decode decodes a single packet from the packet data b, as found in a batch returned by Decoder.Decode.
+// It returns an error wrapping ErrUnknownPacket if no packet is registered for the ID of the packet data.
+// The packet is decoded in the layout of the oldest supported protocol version.
+func Decode(b []byte) (Packet, error) {
+	return DecodeFor(b, 0)
+}
+
+// DecodeFor decodes a single packet like Decode, but in the layout of the protocol version of the client
+// passed.
+func DecodeFor(b []byte, clientProtocol int32) (Packet, error) {
+	data, err := parseData(b)
+	if err != nil {
+		return nil, err
+	}
+
+	newPacket, ok := registry[data.h.PacketID]
+	if !ok {
+		return nil, fmt.Errorf("%w: 0x%x", ErrUnknownPacket, data.h.PacketID)
+	}
+
+	pk := newPacket()
+	if err := data.decode(pk, clientProtocol); err != nil {
+		return nil, err
+	}
+	return pk, nil
+}
@@ -0,0 +1,24 @@
+package protocol
+
+// RequestNetworkSettings is sent by clients of protocol 554 and newer as the very first packet, before
+// the Login packet. The packet is sent uncompressed, because the compression is only negotiated with
+// the NetworkSettings packet that the server sends in response.
+type RequestNetworkSettings struct {
+	// ClientProtocol is the protocol version of the player.
+	ClientProtocol int32
+}
+
+// ID ...
+func (*RequestNetworkSettings) ID() uint32 {
+	return IDRequestNetworkSettings
+}
+
+// Marshal ...
+func (pk *RequestNetworkSettings) Marshal(w *Writer) {
+	w.BEInt32(pk.ClientProtocol)
+}
+
+// Unmarshal ...
+func (pk *RequestNetworkSettings) Unmarshal(r *Reader) error {
+	return r.BEInt32(&pk.ClientProtocol)
+}
@@ -0,0 +1,53 @@
+package protocol
+
+const (
+	PackResponseRefused byte = iota + 1
+	PackResponseSendPacks
+	PackResponseAllPacksDownloaded
+	PackResponseCompleted
+)
+
+// ResourcePackClientResponse is sent by the client in response to resource pack related packets of the
+// server. It tells the server which packs the client still needs, or that it is ready to continue.
+type ResourcePackClientResponse struct {
+	// Response is the response type of the response. It is one of the constants found above.
+	Response byte
+	// PacksToDownload is a list of resource pack UUIDs combined with their version that need to be
+	// downloaded, if the Response field is PackResponseSendPacks.
+	PacksToDownload []string
+}
+
+// ID ...
+func (*ResourcePackClientResponse) ID() uint32 {
+	return IDResourcePackClientResponse
+}
+
+// Marshal ...
+func (pk *ResourcePackClientResponse) Marshal(w *Writer) {
+	w.Uint8(pk.Response)
+	w.Uint16(uint16(len(pk.PacksToDownload)))
+	for _, pack := range pk.PacksToDownload {
+		w.String(pack)
+	}
+}
+
+// Unmarshal ...
+func (pk *ResourcePackClientResponse) Unmarshal(r *Reader) error {
+	if err := r.Uint8(&pk.Response); err != nil {
+		return err
+	}
+	var count uint16
+	if err := r.Uint16(&count); err != nil {
+		return err
+	}
+
+	pk.PacksToDownload = nil
+	for n := uint16(0); n < count; n++ {
+		var pack string
+		if err := r.String(&pack); err != nil {
+			return err
+		}
+		pk.PacksToDownload = append(pk.PacksToDownload, pack)
+	}
+	return nil
+}
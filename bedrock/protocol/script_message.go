@@ -0,0 +1,30 @@
+package protocol
+
+// ScriptMessage is used to communicate custom messages between the client and the server, or in the case
+// of a proxy, between the server and the proxy. Either side may send it with an identifier, which works
+// like a channel, and arbitrary data.
+type ScriptMessage struct {
+	// Identifier is the identifier of the message, used by either party to identify the message data sent.
+	Identifier string
+	// Data contains the data of the message.
+	Data []byte
+}
+
+// ID ...
+func (*ScriptMessage) ID() uint32 {
+	return IDScriptMessage
+}
+
+// Marshal ...
+func (pk *ScriptMessage) Marshal(w *Writer) {
+	w.String(pk.Identifier)
+	w.ByteSlice(pk.Data)
+}
+
+// Unmarshal ...
+func (pk *ScriptMessage) Unmarshal(r *Reader) error {
+	if err := r.String(&pk.Identifier); err != nil {
+		return err
+	}
+	return r.ByteSlice(&pk.Data)
+}
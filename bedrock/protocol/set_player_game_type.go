@@ -0,0 +1,24 @@
+package protocol
+
+// SetPlayerGameType is sent by the server to update the game type, which is otherwise known as the game
+// mode, of a player.
+type SetPlayerGameType struct {
+	// GameType is the new game type of the player. Some of these game types require additional flags to
+	// be set in an AdventureSettings packet for the game mode to obtain its full functionality.
+	GameType int32
+}
+
+// ID ...
+func (*SetPlayerGameType) ID() uint32 {
+	return IDSetPlayerGameType
+}
+
+// Marshal ...
+func (pk *SetPlayerGameType) Marshal(w *Writer) {
+	w.Varint32(pk.GameType)
+}
+
+// Unmarshal ...
+func (pk *SetPlayerGameType) Unmarshal(r *Reader) error {
+	return r.Varint32(&pk.GameType)
+}
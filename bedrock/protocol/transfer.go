@@ -0,0 +1,45 @@
+package protocol
+
+// TransferReloadWorldProtocol is the first protocol version in which Transfer ends with whether the world
+// is reloaded.
+const TransferReloadWorldProtocol = 729
+
+// Transfer is sent by the server to transfer a player from the current server to another. Doing so will
+// fully disconnect the client, bring it back to the main menu and make it connect to the next server.
+type Transfer struct {
+	// Address is the address of the new server, which might be either a hostname or an actual IP address.
+	Address string
+	// Port is the UDP port of the new server.
+	Port uint16
+	// ReloadWorld specifies if the client reloads the world when it is transferred. It is only written for
+	// clients of TransferReloadWorldProtocol and newer.
+	ReloadWorld bool
+}
+
+// ID ...
+func (*Transfer) ID() uint32 {
+	return IDTransfer
+}
+
+// Marshal ...
+func (pk *Transfer) Marshal(w *Writer) {
+	w.String(pk.Address)
+	w.Uint16(pk.Port)
+	if w.Protocol() >= TransferReloadWorldProtocol {
+		w.Bool(pk.ReloadWorld)
+	}
+}
+
+// Unmarshal ...
+func (pk *Transfer) Unmarshal(r *Reader) error {
+	if err := r.String(&pk.Address); err != nil {
+		return err
+	}
+	if err := r.Uint16(&pk.Port); err != nil {
+		return err
+	}
+	if r.Protocol() >= TransferReloadWorldProtocol {
+		return r.Bool(&pk.ReloadWorld)
+	}
+	return nil
+}
@@ -0,0 +1,31 @@
+package protocol
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+)
+
+// UUID is a 128 bit universally unique identifier.
+type UUID [16]byte
+
+// ParseUUID parses a UUID in its canonical form, like '123e4567-e89b-12d3-a456-426614174000'.
+func ParseUUID(s string) (UUID, error) {
+	var id UUID
+	if len(s) != 36 || s[8] != '-' || s[13] != '-' || s[18] != '-' || s[23] != '-' {
+		return id, errors.New("invalid UUID format")
+	}
+
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil {
+		return id, err
+	}
+	copy(id[:], b)
+	return id, nil
+}
+
+// String returns the canonical form of the UUID.
+func (id UUID) String() string {
+	s := hex.EncodeToString(id[:])
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
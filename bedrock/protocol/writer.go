@@ -1,7 +1,10 @@
 package protocol
 
 import (
+	"encoding/binary"
+	"fmt"
 	"io"
+	"math"
 )
 
 type EncodeReader interface {
@@ -9,32 +12,176 @@ type EncodeReader interface {
 	io.ByteWriter
 }
 
+// Writer writes the primitives of the Bedrock protocol to the underlying writer.
+// Once a write fails, the Writer keeps the first error and ignores all following
+// writes. The error is returned by Err.
 type Writer struct {
 	EncodeReader
+	err error
+	// protocol is the protocol version of the client that the packets are written for
+	protocol int32
 }
 
 func NewWriter(w EncodeReader) *Writer {
 	return &Writer{EncodeReader: w}
 }
 
+// SetProtocol sets the protocol version of the client that the packets are written for. Packets are
+// written in the layout of the oldest supported protocol version until it is set.
+func (w *Writer) SetProtocol(protocol int32) {
+	w.protocol = protocol
+}
+
+// Protocol returns the protocol version of the client that the packets are written for.
+func (w *Writer) Protocol() int32 {
+	return w.protocol
+}
+
+// Err returns the first error that occurred while writing.
+func (w *Writer) Err() error {
+	return w.err
+}
+
+func (w *Writer) setErr(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *Writer) writeByte(b byte) {
+	if w.err != nil {
+		return
+	}
+	w.setErr(w.WriteByte(b))
+}
+
+func (w *Writer) write(b []byte) {
+	if w.err != nil {
+		return
+	}
+	_, err := w.Write(b)
+	w.setErr(err)
+}
+
 func (w *Writer) Bool(x bool) {
 	if x {
-		w.WriteByte(0x01)
+		w.writeByte(0x01)
 	} else {
-		w.WriteByte(0x00)
+		w.writeByte(0x00)
 	}
 }
 
-func (w *Writer) String(x string) {
-	l := uint32(len(x))
-	w.Varuint32(l)
-	_, _ = w.Write([]byte(x))
+func (w *Writer) Uint8(x uint8) {
+	w.writeByte(x)
+}
+
+func (w *Writer) Int8(x int8) {
+	w.writeByte(byte(x))
+}
+
+func (w *Writer) Uint16(x uint16) {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, x)
+	w.write(b)
+}
+
+func (w *Writer) Int16(x int16) {
+	w.Uint16(uint16(x))
+}
+
+func (w *Writer) Uint32(x uint32) {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, x)
+	w.write(b)
+}
+
+func (w *Writer) Int32(x int32) {
+	w.Uint32(uint32(x))
+}
+
+func (w *Writer) BEInt32(x int32) {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(x))
+	w.write(b)
+}
+
+func (w *Writer) Uint64(x uint64) {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, x)
+	w.write(b)
+}
+
+func (w *Writer) Int64(x int64) {
+	w.Uint64(uint64(x))
+}
+
+func (w *Writer) Float32(x float32) {
+	w.Uint32(math.Float32bits(x))
+}
+
+func (w *Writer) Float64(x float64) {
+	w.Uint64(math.Float64bits(x))
 }
 
 func (w *Writer) Varuint32(x uint32) {
 	for x >= 0x80 {
-		_ = w.WriteByte(byte(x) | 0x80)
+		w.writeByte(byte(x) | 0x80)
 		x >>= 7
 	}
-	_ = w.WriteByte(byte(x))
+	w.writeByte(byte(x))
+}
+
+// Varint32 writes a zigzag encoded int32.
+func (w *Writer) Varint32(x int32) {
+	w.Varuint32(uint32(x<<1) ^ uint32(x>>31))
+}
+
+func (w *Writer) Varuint64(x uint64) {
+	for x >= 0x80 {
+		w.writeByte(byte(x) | 0x80)
+		x >>= 7
+	}
+	w.writeByte(byte(x))
+}
+
+// Varint64 writes a zigzag encoded int64.
+func (w *Writer) Varint64(x int64) {
+	w.Varuint64(uint64(x<<1) ^ uint64(x>>63))
+}
+
+// Vec3 writes the three float32 components of a vector.
+func (w *Writer) Vec3(x [3]float32) {
+	w.Float32(x[0])
+	w.Float32(x[1])
+	w.Float32(x[2])
+}
+
+// ByteSlice writes a byte slice that is prefixed with its varuint32 length.
+func (w *Writer) ByteSlice(x []byte) {
+	if len(x) > MaxSliceLength {
+		w.setErr(fmt.Errorf("byte slice length %d exceeds %d", len(x), MaxSliceLength))
+		return
+	}
+	w.Varuint32(uint32(len(x)))
+	w.write(x)
+}
+
+// String writes a string that is prefixed with its varuint32 length.
+func (w *Writer) String(x string) {
+	w.ByteSlice([]byte(x))
+}
+
+// Bytes writes the raw bytes without a length prefix.
+func (w *Writer) Bytes(x []byte) {
+	w.write(x)
+}
+
+// UUID writes a UUID as two little endian uint64s, like the game does.
+func (w *Writer) UUID(x UUID) {
+	b := make([]byte, 16)
+	for n := 0; n < 8; n++ {
+		b[n] = x[7-n]
+		b[n+8] = x[15-n]
+	}
+	w.write(b)
 }
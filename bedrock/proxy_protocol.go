@@ -0,0 +1,571 @@
+package bedrock
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/pires/go-proxyproto"
+	"github.com/sandertv/go-raknet"
+)
+
+const (
+	// proxyProtocolV2HeaderSize is the size of a PROXY protocol v2
+	// header without its addresses and TLVs
+	proxyProtocolV2HeaderSize = 16
+
+	// relayBufferSize is large enough for a datagram of the maximum
+	// RakNet MTU together with a PROXY protocol v2 header and its TLVs
+	relayBufferSize = 4096
+
+	// The IDs of the RakNet packets that clients send before they have a
+	// connection, which are pings of the server list and their pongs and
+	// the first request of a connection
+	idUnconnectedPing                byte = 0x01
+	idUnconnectedPingOpenConnections byte = 0x02
+	idOpenConnectionRequest1         byte = 0x05
+	idOpenConnectionRequest2         byte = 0x07
+	idUnconnectedPong                byte = 0x1c
+
+	// openConnectionRequest1Size is the size of an open connection
+	// request 1 without the padding that advertises the MTU
+	openConnectionRequest1Size = 18
+	// openConnectionRequest2MTUOffset is the offset of the MTU of an
+	// open connection request 2 from its end, since it is only followed
+	// by the GUID of the client
+	openConnectionRequest2MTUOffset = 10
+
+	// unconnectedPingSize is the size of the ID and the ping time that
+	// unconnected pings and pongs start with
+	unconnectedPingSize = 9
+
+	// relayPingSlots is the number of pings that wait for their pong at
+	// most. Newer pings take the slots of the oldest ones.
+	relayPingSlots = 1024
+)
+
+var (
+	proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+	errUntrustedProxy = errors.New("PROXY protocol header from untrusted source")
+	errNoRelaySession = errors.New("datagram of a client without a session does not start a connection")
+	errRelayFull      = errors.New("too many relay sessions")
+)
+
+// ProxyProtocolRelay relays the datagrams of a public UDP socket to a RakNet
+// listener that only listens on the loopback interface.
+// UDP load balancers prefix every datagram with a PROXY protocol v2 header.
+// The relay strips these headers and gives every client its own socket to the
+// listener, so that the address of a socket identifies the client that the
+// header named. Only sources in TrustedProxies may send headers.
+// Clients only get a socket once they start a connection. Pings of the server
+// list share one socket, so that they can not use up the sessions.
+type ProxyProtocolRelay struct {
+	// TrustedProxies are the networks that PROXY protocol headers are
+	// accepted from. Datagrams with a header from any other source are dropped.
+	TrustedProxies []*net.IPNet
+	// Target is the address of the internal RakNet listener
+	Target *net.UDPAddr
+	// IdleTimeout is the time after which the socket of a client that did
+	// not send or receive datagrams is closed
+	IdleTimeout time.Duration
+	// MaxSessions is the number of clients that can have a socket at once.
+	// Zero means no limit.
+	MaxSessions int
+	Log         logr.Logger
+
+	mu sync.Mutex
+	// sessions maps the address of a client to its session
+	sessions map[string]*relaySession
+	// locals maps the local address of the socket of a session
+	// to the session
+	locals map[string]*relaySession
+
+	pingMu sync.Mutex
+	// pingSeq is the ping time of the last ping that was forwarded
+	pingSeq uint64
+	// pings are the pings that wait for their pong by their ping time
+	pings [relayPingSlots]relayPing
+}
+
+// relayPing is a ping that was forwarded to the listener with the sequence
+// number of the relay instead of its ping time
+type relayPing struct {
+	seq uint64
+	// peer is the address that the pong is sent to. It is nil once
+	// the pong was sent.
+	peer     net.Addr
+	pingTime [unconnectedPingSize - 1]byte
+}
+
+// relaySession relays the datagrams of one client
+type relaySession struct {
+	conn   *net.UDPConn
+	client net.Addr
+	// dst is the address that the client sent its datagrams to according
+	// to the PROXY protocol header. It is nil if it sent no header.
+	dst net.Addr
+
+	mu sync.Mutex
+	// peer is the address that replies are sent to, which is the
+	// trusted proxy that sent the last datagram or the client itself
+	peer       net.Addr
+	lastActive time.Time
+}
+
+func (s *relaySession) touch(peer net.Addr) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if peer != nil {
+		s.peer = peer
+	}
+	s.lastActive = time.Now()
+}
+
+func (s *relaySession) state() (net.Addr, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peer, s.lastActive
+}
+
+// Serve relays the datagrams that conn receives until it is closed.
+func (r *ProxyProtocolRelay) Serve(conn net.PacketConn) error {
+	defer conn.Close()
+	defer r.closeSessions()
+
+	pings, err := net.DialUDP("udp", nil, r.Target)
+	if err != nil {
+		return err
+	}
+	defer pings.Close()
+	go r.relayPongs(conn, pings)
+
+	b := make([]byte, relayBufferSize)
+	for {
+		n, peer, err := conn.ReadFrom(b)
+		if err != nil {
+			return err
+		}
+
+		payload, client, dst, err := r.parseDatagram(b[:n], peer)
+		if err != nil {
+			r.Log.V(1).Info("dropped datagram",
+				"remoteAddress", peer,
+				"error", err,
+			)
+			continue
+		}
+
+		if isUnconnectedPing(payload) {
+			if err := r.forwardPing(pings, peer, payload); err != nil {
+				r.Log.V(1).Info("failed to relay ping",
+					"remoteAddress", client,
+					"error", err,
+				)
+			}
+			continue
+		}
+
+		s, err := r.session(conn, client, dst, peer, payload)
+		if errors.Is(err, errNoRelaySession) || errors.Is(err, errRelayFull) {
+			r.Log.V(1).Info("dropped datagram",
+				"remoteAddress", client,
+				"error", err,
+			)
+			continue
+		} else if err != nil {
+			r.Log.Error(err, "failed to open relay session",
+				"remoteAddress", client,
+			)
+			continue
+		}
+
+		if _, err := s.conn.Write(payload); err != nil {
+			r.Log.V(1).Info("failed to relay datagram",
+				"remoteAddress", client,
+				"error", err,
+			)
+		}
+	}
+}
+
+// ClientAddr returns the address of the client whose datagrams are relayed
+// from the local address addr.
+func (r *ProxyProtocolRelay) ClientAddr(addr net.Addr) (net.Addr, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.locals[addr.String()]
+	if !ok {
+		return nil, false
+	}
+	return s.client, true
+}
+
+// DestinationAddr returns the address that the client whose datagrams are
+// relayed from the local address addr sent them to, according to the
+// PROXY protocol header of the client.
+func (r *ProxyProtocolRelay) DestinationAddr(addr net.Addr) (net.Addr, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.locals[addr.String()]
+	if !ok || s.dst == nil {
+		return nil, false
+	}
+	return s.dst, true
+}
+
+// parseDatagram strips the PROXY protocol header of a datagram that was
+// received from peer and returns its payload, the address of the client and
+// the address that the client sent it to. Datagrams without a header are sent
+// by the client itself and have no destination.
+func (r *ProxyProtocolRelay) parseDatagram(b []byte, peer net.Addr) ([]byte, net.Addr, net.Addr, error) {
+	if !bytes.HasPrefix(b, proxyProtocolV2Signature) {
+		return b, peer, nil, nil
+	}
+
+	if !r.trusted(peer) {
+		return nil, nil, nil, errUntrustedProxy
+	}
+
+	if len(b) < proxyProtocolV2HeaderSize {
+		return nil, nil, nil, proxyproto.ErrCantReadLength
+	}
+	size := proxyProtocolV2HeaderSize + int(binary.BigEndian.Uint16(b[14:16]))
+	if len(b) < size {
+		return nil, nil, nil, proxyproto.ErrInvalidLength
+	}
+
+	header, err := proxyproto.Read(bufio.NewReaderSize(bytes.NewReader(b[:size]), size))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	// LOCAL headers are sent by the proxy itself, like health checks
+	if header.Command.IsLocal() {
+		return b[size:], peer, nil, nil
+	}
+
+	srcIP, dstIP, ok := header.IPs()
+	if !ok {
+		return nil, nil, nil, proxyproto.ErrUnsupportedAddressFamilyAndProtocol
+	}
+	srcPort, dstPort, _ := header.Ports()
+	return b[size:], &net.UDPAddr{IP: srcIP, Port: srcPort}, &net.UDPAddr{IP: dstIP, Port: dstPort}, nil
+}
+
+func (r *ProxyProtocolRelay) trusted(addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+
+	for _, ipNet := range r.TrustedProxies {
+		if ipNet.Contains(udpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// session returns the session of the client and opens a new one if the
+// client has none yet and its payload starts a connection.
+func (r *ProxyProtocolRelay) session(conn net.PacketConn, client, dst, peer net.Addr, payload []byte) (*relaySession, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if s, ok := r.sessions[client.String()]; ok {
+		s.touch(peer)
+		return s, nil
+	}
+
+	if !startsConnection(payload) {
+		return nil, errNoRelaySession
+	}
+	if r.MaxSessions > 0 && len(r.sessions) >= r.MaxSessions {
+		return nil, errRelayFull
+	}
+
+	c, err := net.DialUDP("udp", nil, r.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &relaySession{
+		conn:       c,
+		client:     client,
+		dst:        dst,
+		peer:       peer,
+		lastActive: time.Now(),
+	}
+
+	if r.sessions == nil {
+		r.sessions = map[string]*relaySession{}
+		r.locals = map[string]*relaySession{}
+	}
+	r.sessions[client.String()] = s
+	r.locals[c.LocalAddr().String()] = s
+
+	go r.relayReplies(conn, s)
+	return s, nil
+}
+
+// startsConnection reports if the payload is the first RakNet packet
+// of a connection.
+func startsConnection(payload []byte) bool {
+	return len(payload) > 0 && payload[0] == idOpenConnectionRequest1
+}
+
+func isUnconnectedPing(payload []byte) bool {
+	if len(payload) < unconnectedPingSize {
+		return false
+	}
+	return payload[0] == idUnconnectedPing || payload[0] == idUnconnectedPingOpenConnections
+}
+
+// forwardPing sends the ping to the listener over the shared socket of
+// the pings. Its ping time is replaced with a sequence number, so that
+// relayPongs knows which peer its pong belongs to.
+func (r *ProxyProtocolRelay) forwardPing(pings *net.UDPConn, peer net.Addr, payload []byte) error {
+	r.pingMu.Lock()
+	r.pingSeq++
+	seq := r.pingSeq
+	ping := &r.pings[seq%relayPingSlots]
+	ping.seq = seq
+	ping.peer = peer
+	copy(ping.pingTime[:], payload[1:unconnectedPingSize])
+	r.pingMu.Unlock()
+
+	dg := make([]byte, len(payload))
+	copy(dg, payload)
+	binary.BigEndian.PutUint64(dg[1:unconnectedPingSize], seq)
+	_, err := pings.Write(dg)
+	return err
+}
+
+// relayPongs sends the pongs of the listener back to the peers of their
+// pings with their original ping time until pings is closed.
+func (r *ProxyProtocolRelay) relayPongs(conn net.PacketConn, pings *net.UDPConn) {
+	b := make([]byte, relayBufferSize)
+	for {
+		n, err := pings.Read(b)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		} else if err != nil {
+			// The listener might not be up yet
+			continue
+		}
+		if n < unconnectedPingSize || b[0] != idUnconnectedPong {
+			continue
+		}
+
+		seq := binary.BigEndian.Uint64(b[1:unconnectedPingSize])
+		r.pingMu.Lock()
+		ping := &r.pings[seq%relayPingSlots]
+		peer := ping.peer
+		if ping.seq != seq || peer == nil {
+			r.pingMu.Unlock()
+			continue
+		}
+		ping.peer = nil
+		copy(b[1:unconnectedPingSize], ping.pingTime[:])
+		r.pingMu.Unlock()
+
+		if _, err := conn.WriteTo(b[:n], peer); err != nil {
+			r.Log.V(1).Info("failed to relay pong",
+				"remoteAddress", peer,
+				"error", err,
+			)
+		}
+	}
+}
+
+// relayReplies sends the datagrams of the listener back to the client
+// until the session is idle for longer than the IdleTimeout.
+func (r *ProxyProtocolRelay) relayReplies(conn net.PacketConn, s *relaySession) {
+	defer r.closeSession(s)
+
+	b := make([]byte, relayBufferSize)
+	for {
+		_ = s.conn.SetReadDeadline(time.Now().Add(r.IdleTimeout))
+		n, err := s.conn.Read(b)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				if _, lastActive := s.state(); time.Since(lastActive) < r.IdleTimeout {
+					continue
+				}
+			}
+			return
+		}
+
+		peer, _ := s.state()
+		s.touch(nil)
+		if _, err := conn.WriteTo(b[:n], peer); err != nil {
+			return
+		}
+	}
+}
+
+func (r *ProxyProtocolRelay) closeSession(s *relaySession) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.sessions[s.client.String()] == s {
+		delete(r.sessions, s.client.String())
+	}
+	delete(r.locals, s.conn.LocalAddr().String())
+	_ = s.conn.Close()
+}
+
+func (r *ProxyProtocolRelay) closeSessions() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, s := range r.sessions {
+		// The replies of the session stop once its socket is closed
+		_ = s.conn.Close()
+	}
+}
+
+const (
+	// PP2TypeGatewayID is the type of the TLV that holds the ID of the
+	// gateway that the client connected through
+	PP2TypeGatewayID proxyproto.PP2Type = 0xE0
+	// PP2TypeXUID is the type of the TLV that holds the XUID of the client
+	PP2TypeXUID proxyproto.PP2Type = 0xE1
+)
+
+// proxyProtocolHeader returns the PROXY protocol v2 header that tells
+// a server the address of the client and the address that it connected to.
+// The gateway ID and the XUID of the client are sent as TLVs, if they are set.
+func proxyProtocolHeader(pc *ProcessedConn) ([]byte, error) {
+	src, ok := pc.RemoteAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, fmt.Errorf("invalid client address %s", pc.RemoteAddr())
+	}
+
+	dst, ok := pc.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return nil, fmt.Errorf("invalid local address %s", pc.LocalAddr())
+	}
+
+	transport := proxyproto.UDPv4
+	if src.IP.To4() == nil {
+		transport = proxyproto.UDPv6
+	}
+
+	// Both addresses of a header have to be of the same family
+	if (src.IP.To4() == nil) != (dst.IP.To4() == nil) {
+		ip := net.IPv4zero
+		if transport == proxyproto.UDPv6 {
+			ip = net.IPv6unspecified
+		}
+		dst = &net.UDPAddr{IP: ip, Port: dst.Port}
+	}
+
+	header := proxyproto.Header{
+		Version:           2,
+		Command:           proxyproto.PROXY,
+		TransportProtocol: transport,
+		SourceAddr:        src,
+		DestinationAddr:   dst,
+	}
+
+	var tlvs []proxyproto.TLV
+	if pc.GatewayID() != "" {
+		tlvs = append(tlvs, proxyproto.TLV{Type: PP2TypeGatewayID, Value: []byte(pc.GatewayID())})
+	}
+	if pc.XUID() != "" {
+		tlvs = append(tlvs, proxyproto.TLV{Type: PP2TypeXUID, Value: []byte(pc.XUID())})
+	}
+	if err := header.SetTLVs(tlvs); err != nil {
+		return nil, err
+	}
+
+	return header.Format()
+}
+
+// proxyProtocolDialer dials UDP connections that start every datagram with a
+// PROXY protocol header, the way that UDP load balancers send them.
+type proxyProtocolDialer struct {
+	upstream raknet.UpstreamDialer
+	header   []byte
+}
+
+func (d proxyProtocolDialer) Dial(network, address string) (net.Conn, error) {
+	var c net.Conn
+	var err error
+	if d.upstream == nil {
+		c, err = net.Dial(network, address)
+	} else {
+		c, err = d.upstream.Dial(network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	udpConn, ok := c.(*net.UDPConn)
+	if !ok {
+		c.Close()
+		return nil, fmt.Errorf("PROXY protocol needs a UDP connection; got %T", c)
+	}
+
+	return &proxyProtocolConn{
+		UDPConn: udpConn,
+		header:  d.header,
+	}, nil
+}
+
+// proxyProtocolConn is a connected UDP socket that writes
+// the header in front of every datagram.
+type proxyProtocolConn struct {
+	*net.UDPConn
+	header []byte
+}
+
+func (c *proxyProtocolConn) Write(b []byte) (int, error) {
+	dg := make([]byte, 0, len(c.header)+len(b))
+	dg = append(dg, c.header...)
+	dg = append(dg, b...)
+	c.reduceMTU(dg[len(c.header):])
+	if _, err := c.UDPConn.Write(dg[:len(dg)-c.padding(b)]); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// padding returns how much of the padding of an open connection request 1
+// is cut off. Servers take the size of the request as the MTU, so it is
+// reduced by the size of the header, which is sent in front of every
+// datagram of the connection.
+func (c *proxyProtocolConn) padding(b []byte) int {
+	if len(b) == 0 || b[0] != idOpenConnectionRequest1 {
+		return 0
+	}
+	if len(b)-len(c.header) < openConnectionRequest1Size {
+		return 0
+	}
+	return len(c.header)
+}
+
+// reduceMTU reduces the MTU that an open connection request 2 advertises
+// by the size of the header, so that the datagrams of the connection still
+// fit into the MTU of the network together with the header.
+func (c *proxyProtocolConn) reduceMTU(b []byte) {
+	if len(b) < openConnectionRequest2MTUOffset+1 || b[0] != idOpenConnectionRequest2 {
+		return
+	}
+
+	at := len(b) - openConnectionRequest2MTUOffset
+	mtu := binary.BigEndian.Uint16(b[at:])
+	if int(mtu) <= len(c.header) {
+		return
+	}
+	binary.BigEndian.PutUint16(b[at:], mtu-uint16(len(c.header)))
+}
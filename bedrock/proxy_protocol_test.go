@@ -0,0 +1,553 @@
+package bedrock_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/haveachin/bedprox"
+	"github.com/haveachin/bedprox/bedrock"
+	"github.com/pires/go-proxyproto"
+	"github.com/sandertv/go-raknet"
+)
+
+func mustParseCIDR(t *testing.T, cidr string) *net.IPNet {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ipNet
+}
+
+// raknetMagic is the magic that unconnected RakNet messages contain
+var raknetMagic = []byte{0x00, 0xff, 0xff, 0x00, 0xfe, 0xfe, 0xfe, 0xfe, 0xfd, 0xfd, 0xfd, 0xfd, 0x12, 0x34, 0x56, 0x78}
+
+// proxyHeader returns a PROXY protocol v2 header for a UDP datagram of src.
+func proxyHeader(t *testing.T, cmd proxyproto.ProtocolVersionAndCommand, src *net.UDPAddr) []byte {
+	transport := proxyproto.UDPv4
+	dst := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 19132}
+	if src.IP.To4() == nil {
+		transport = proxyproto.UDPv6
+		dst = &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 19132}
+	}
+
+	header := proxyproto.Header{
+		Version:           2,
+		Command:           cmd,
+		TransportProtocol: transport,
+		SourceAddr:        src,
+		DestinationAddr:   dst,
+	}
+	b, err := header.Format()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// startRelay starts a relay for up to maxSessions clients in front of a
+// socket that answers unconnected pings with a pong and echoes every
+// other datagram.
+// The datagrams that the socket receives are sent to the received channel
+// together with the address that they were relayed from.
+func startRelay(t *testing.T, trusted string, maxSessions int) (*bedrock.ProxyProtocolRelay, net.Conn, <-chan relayedDatagram) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { target.Close() })
+
+	received := make(chan relayedDatagram, 4)
+	go func() {
+		b := make([]byte, 1500)
+		for {
+			n, addr, err := target.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			received <- relayedDatagram{payload: string(b[:n]), from: addr}
+			reply := b[:n]
+			if n >= 9 && b[0] == 0x01 {
+				reply = append([]byte{0x1c}, b[1:9]...)
+				reply = append(reply, "pong"...)
+			}
+			_, _ = target.WriteTo(reply, addr)
+		}
+	}()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relay := &bedrock.ProxyProtocolRelay{
+		TrustedProxies: []*net.IPNet{mustParseCIDR(t, trusted)},
+		Target:         target.LocalAddr().(*net.UDPAddr),
+		IdleTimeout:    time.Second,
+		MaxSessions:    maxSessions,
+		Log:            logr.Discard(),
+	}
+	go relay.Serve(conn)
+	t.Cleanup(func() { conn.Close() })
+
+	c, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	return relay, c, received
+}
+
+// connReq and plainConnReq are datagrams that start with the ID of
+// the first request of a connection, so that the relay opens a session
+// for them
+const (
+	connReq      = "\x05hello"
+	plainConnReq = "\x05plain"
+)
+
+type relayedDatagram struct {
+	payload string
+	from    net.Addr
+}
+
+func TestProxyProtocolRelay_Serve(t *testing.T) {
+	clientV4 := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 54321}
+	clientV6 := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 19132}
+
+	tt := []struct {
+		name     string
+		trusted  string
+		datagram func(t *testing.T) []byte
+		// client is the expected address of the client. If nil,
+		// it is the address of the sender.
+		client  net.Addr
+		dropped bool
+	}{
+		{
+			name:    "trusted IPv4 header",
+			trusted: "127.0.0.0/8",
+			datagram: func(t *testing.T) []byte {
+				return append(proxyHeader(t, proxyproto.PROXY, clientV4), connReq...)
+			},
+			client: clientV4,
+		},
+		{
+			name:    "trusted IPv6 header",
+			trusted: "127.0.0.0/8",
+			datagram: func(t *testing.T) []byte {
+				return append(proxyHeader(t, proxyproto.PROXY, clientV6), connReq...)
+			},
+			client: clientV6,
+		},
+		{
+			name:    "trusted local header",
+			trusted: "127.0.0.0/8",
+			datagram: func(t *testing.T) []byte {
+				return append(proxyHeader(t, proxyproto.LOCAL, clientV4), connReq...)
+			},
+		},
+		{
+			name:    "untrusted header",
+			trusted: "10.0.0.0/8",
+			datagram: func(t *testing.T) []byte {
+				return append(proxyHeader(t, proxyproto.PROXY, clientV4), connReq...)
+			},
+			dropped: true,
+		},
+		{
+			name:    "truncated header",
+			trusted: "127.0.0.0/8",
+			datagram: func(t *testing.T) []byte {
+				return proxyHeader(t, proxyproto.PROXY, clientV4)[:20]
+			},
+			dropped: true,
+		},
+		{
+			name:    "no connection start",
+			trusted: "127.0.0.0/8",
+			datagram: func(t *testing.T) []byte {
+				return append(proxyHeader(t, proxyproto.PROXY, clientV4), "hello"...)
+			},
+			dropped: true,
+		},
+		{
+			name:    "no header",
+			trusted: "10.0.0.0/8",
+			datagram: func(t *testing.T) []byte {
+				return []byte(connReq)
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			relay, c, received := startRelay(t, tc.trusted, 0)
+
+			if _, err := c.Write(tc.datagram(t)); err != nil {
+				t.Fatal(err)
+			}
+			// Datagrams are relayed in order, so the dropped datagram
+			// would be received before this one
+			if tc.dropped {
+				if _, err := c.Write([]byte(plainConnReq)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var dg relayedDatagram
+			select {
+			case dg = <-received:
+			case <-time.After(time.Second):
+				t.Fatal("no datagram was relayed")
+			}
+
+			want := connReq
+			if tc.dropped {
+				want = plainConnReq
+			}
+			if dg.payload != want {
+				t.Fatalf("expected %q to be relayed; got %q", want, dg.payload)
+			}
+
+			client := tc.client
+			if client == nil {
+				client = c.LocalAddr()
+			}
+			addr, ok := relay.ClientAddr(dg.from)
+			if !ok {
+				t.Fatalf("no client address for %s", dg.from)
+			}
+			if addr.String() != client.String() {
+				t.Errorf("expected client address %s; got %s", client, addr)
+			}
+
+			// The reply is relayed back without a header
+			b := make([]byte, 1500)
+			_ = c.SetReadDeadline(time.Now().Add(time.Second))
+			n, err := c.Read(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b[:n]) != want {
+				t.Errorf("expected reply %q; got %q", want, b[:n])
+			}
+		})
+	}
+}
+
+func TestProxyProtocolRelay_Serve_MaxSessions(t *testing.T) {
+	_, c, received := startRelay(t, "127.0.0.0/8", 1)
+
+	first := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 54321}
+	second := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 8), Port: 54321}
+	for _, dg := range [][]byte{
+		append(proxyHeader(t, proxyproto.PROXY, first), connReq...),
+		// The second client has no room for a session
+		append(proxyHeader(t, proxyproto.PROXY, second), "\x05second"...),
+		// Clients with a session are still relayed
+		append(proxyHeader(t, proxyproto.PROXY, first), "hello"...),
+	} {
+		if _, err := c.Write(dg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, want := range []string{connReq, "hello"} {
+		select {
+		case dg := <-received:
+			if dg.payload != want {
+				t.Errorf("expected %q to be relayed; got %q", want, dg.payload)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%q was not relayed", want)
+		}
+	}
+}
+
+func TestProxyProtocolRelay_Serve_Ping(t *testing.T) {
+	_, c, received := startRelay(t, "127.0.0.0/8", 1)
+
+	// Pings of many clients do not use up the only session
+	for n := 0; n < 3; n++ {
+		client := &net.UDPAddr{IP: net.IPv4(203, 0, 113, byte(n)), Port: 54321}
+		pingTime := []byte{0x01, 0, 0, 0, 0, 0, 0, 0, byte(n)}
+		if _, err := c.Write(append(proxyHeader(t, proxyproto.PROXY, client), pingTime...)); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatal("ping was not relayed")
+		}
+
+		// The pong is sent back with the ping time of the client
+		b := make([]byte, 1500)
+		_ = c.SetReadDeadline(time.Now().Add(time.Second))
+		size, err := c.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := append([]byte{0x1c}, pingTime[1:]...)
+		if want = append(want, "pong"...); !bytes.Equal(b[:size], want) {
+			t.Errorf("expected pong %x; got %x", want, b[:size])
+		}
+	}
+
+	client := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 54321}
+	if _, err := c.Write(append(proxyHeader(t, proxyproto.PROXY, client), connReq...)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case dg := <-received:
+		if dg.payload != connReq {
+			t.Errorf("expected %q to be relayed; got %q", connReq, dg.payload)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection was not relayed")
+	}
+}
+
+// proxyProtocolDialer dials UDP connections that prefix every datagram
+// with a PROXY protocol header, like a UDP load balancer does.
+type proxyProtocolDialer struct {
+	header []byte
+}
+
+func (d proxyProtocolDialer) Dial(network, address string) (net.Conn, error) {
+	c, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{UDPConn: c.(*net.UDPConn), header: d.header}, nil
+}
+
+type proxyProtocolConn struct {
+	*net.UDPConn
+	header []byte
+}
+
+func (c *proxyProtocolConn) Write(b []byte) (int, error) {
+	if _, err := c.UDPConn.Write(append(c.header[:len(c.header):len(c.header)], b...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func TestProxyProtocolRelay_RakNet(t *testing.T) {
+	l, err := raknet.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	relay := &bedrock.ProxyProtocolRelay{
+		TrustedProxies: []*net.IPNet{mustParseCIDR(t, "127.0.0.0/8")},
+		Target:         l.Addr().(*net.UDPAddr),
+		IdleTimeout:    time.Second,
+		Log:            logr.Discard(),
+	}
+	go relay.Serve(conn)
+
+	client := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 54321}
+	dialer := raknet.Dialer{
+		ErrorLog:       log.New(ioutil.Discard, "", 0),
+		UpstreamDialer: proxyProtocolDialer{header: proxyHeader(t, proxyproto.PROXY, client)},
+	}
+
+	l.PongData([]byte("MCPE;bedprox"))
+	pong, err := dialer.PingTimeout(conn.LocalAddr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(pong) != "MCPE;bedprox" {
+		t.Errorf("expected pong data %q; got %q", "MCPE;bedprox", pong)
+	}
+
+	rc, err := dialer.Dial(conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	addr, ok := relay.ClientAddr(c.RemoteAddr())
+	if !ok {
+		t.Fatalf("no client address for %s", c.RemoteAddr())
+	}
+	if addr.String() != client.String() {
+		t.Errorf("expected client address %s; got %s", client, addr)
+	}
+
+	if _, err := rc.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b, err := c.(*raknet.Conn).ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte("hello")) {
+		t.Errorf("expected %q; got %q", "hello", b)
+	}
+}
+
+func TestGateway_ListenAndServe_ProxyProtocol(t *testing.T) {
+	addr := freeUDPAddr(t)
+	gw := &bedrock.Gateway{
+		ID: "gw",
+		Listeners: []bedrock.Listener{
+			{
+				Bind:                 addr,
+				ReceiveProxyProtocol: true,
+				TrustedProxies:       []*net.IPNet{mustParseCIDR(t, "127.0.0.0/8")},
+			},
+		},
+		Log: logr.Discard(),
+	}
+
+	cpnChan := make(chan net.Conn, 1)
+	go gw.ListenAndServe(cpnChan)
+
+	client := &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 54321}
+	rc := dialRakNetWith(t, raknet.Dialer{
+		UpstreamDialer: proxyProtocolDialer{header: proxyHeader(t, proxyproto.PROXY, client)},
+	}, addr)
+	defer rc.Close()
+
+	var c net.Conn
+	select {
+	case c = <-cpnChan:
+	case <-time.After(time.Second):
+		t.Fatal("no connection was accepted")
+	}
+	defer gw.Listeners[0].Close()
+
+	pcs := make(chan bedprox.ProcessedConn, 1)
+	errs := make(chan error, 1)
+	go func() {
+		pc, err := bedrock.ConnProcessor{}.ProcessConn(c)
+		if err != nil {
+			errs <- err
+			return
+		}
+		pcs <- pc
+	}()
+	logIn(t, rc, 560, newLoginRequest(t, newKey(t)))
+
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	case pc := <-pcs:
+		if pc.RemoteAddr().String() != client.String() {
+			t.Errorf("expected remote address %s; got %s", client, pc.RemoteAddr())
+		}
+		// The destination of the header is the address that the client
+		// connected to, not the RakNet listener behind the relay
+		if dst := "192.0.2.1:19132"; pc.LocalAddr().String() != dst {
+			t.Errorf("expected local address %s; got %s", dst, pc.LocalAddr())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("connection was not processed")
+	}
+}
+
+func TestServer_Dial_ProxyProtocol(t *testing.T) {
+	backend, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	srv := bedrock.Server{
+		Address:           backend.LocalAddr().String(),
+		DialTimeout:       100 * time.Millisecond,
+		SendProxyProtocol: true,
+		Dialer:            raknet.Dialer{ErrorLog: log.New(ioutil.Discard, "", 0)},
+	}
+
+	pc, _ := processConn(t, 471)
+	// The backend only answers the first open connection request, so the
+	// dial times out
+	go srv.Dial(pc.(*bedrock.ProcessedConn))
+
+	b := make([]byte, 4096)
+	_ = backend.SetReadDeadline(time.Now().Add(time.Second))
+	n, dialer, err := backend.ReadFrom(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(bytes.NewReader(b[:n]))
+	header, err := proxyproto.Read(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerSize := n - r.Buffered()
+	// The size of the first open connection request is the MTU that
+	// the dialer tries first, which has to fit the header as well
+	if want := 1492 - 28; n != want {
+		t.Errorf("expected open connection request 1 of %d bytes; got %d", want, n)
+	}
+
+	reply := []byte{0x06}
+	reply = append(reply, raknetMagic...)
+	// An open connection reply 1 with no GUID, no security and an MTU
+	// of 1492
+	reply = append(reply, make([]byte, 9)...)
+	reply = append(reply, 0x05, 0xd4)
+	if _, err := backend.WriteTo(reply, dialer); err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		n, _, err := backend.ReadFrom(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n <= headerSize || b[headerSize] != 0x07 {
+			continue
+		}
+		// The dialer takes the MTU of the backend, so the backend sends
+		// datagrams that fit the header in front of the datagrams of
+		// the dialer
+		if mtu := int(binary.BigEndian.Uint16(b[n-10:])); mtu != 1492-headerSize {
+			t.Errorf("expected open connection request 2 with MTU %d; got %d", 1492-headerSize, mtu)
+		}
+		break
+	}
+	if header.TransportProtocol != proxyproto.UDPv4 {
+		t.Errorf("expected transport protocol UDPv4; got %v", header.TransportProtocol)
+	}
+	if header.SourceAddr.String() != pc.RemoteAddr().String() {
+		t.Errorf("expected source address %s; got %s", pc.RemoteAddr(), header.SourceAddr)
+	}
+
+	tlvs, err := header.TLVs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The connection did not come through a gateway and the XUID that the
+	// unauthenticated client claims is not trusted, so no TLVs are sent
+	if len(tlvs) != 0 {
+		t.Errorf("expected no TLVs; got %v", tlvs)
+	}
+}
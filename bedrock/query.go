@@ -0,0 +1,225 @@
+package bedrock
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/haveachin/bedprox"
+)
+
+const (
+	queryTypeHandshake byte = 0x09
+	queryTypeStat      byte = 0x00
+
+	// queryChallengeLifetime is the time that a challenge token is valid for
+	queryChallengeLifetime = 30 * time.Second
+)
+
+var (
+	queryMagic = []byte{0xfe, 0xfd}
+
+	errInvalidQuery     = errors.New("invalid query packet")
+	errInvalidChallenge = errors.New("invalid query challenge token")
+)
+
+// QueryServer answers the UT3 (GameSpy4) query protocol that server lists
+// and monitoring tools use to get the full status of a server.
+// It reports the ping status of the listener together with the players
+// that are currently connected through the gateway.
+type QueryServer struct {
+	Bind       string
+	GatewayID  string
+	HostIP     string
+	HostPort   int
+	PingStatus PingStatus
+	Players    bedprox.PlayerLister
+	Log        logr.Logger
+
+	mu            sync.Mutex
+	challenge     int32
+	prevChallenge int32
+	rotatedAt     time.Time
+}
+
+// ListenAndServe listens on the Bind address and answers query requests
+func (qs *QueryServer) ListenAndServe() error {
+	conn, err := net.ListenPacket("udp", qs.Bind)
+	if err != nil {
+		return err
+	}
+	return qs.Serve(conn)
+}
+
+// Serve answers query requests on the given connection until it is closed
+func (qs *QueryServer) Serve(conn net.PacketConn) error {
+	defer conn.Close()
+
+	b := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(b)
+		if err != nil {
+			return err
+		}
+
+		resp, err := qs.handle(b[:n])
+		if err != nil {
+			qs.Log.V(1).Info("invalid query",
+				"remoteAddress", addr,
+				"error", err,
+			)
+			continue
+		}
+
+		if _, err := conn.WriteTo(resp, addr); err != nil {
+			qs.Log.Error(err, "failed to write query response",
+				"remoteAddress", addr,
+			)
+		}
+	}
+}
+
+func (qs *QueryServer) handle(b []byte) ([]byte, error) {
+	if len(b) < 7 || !bytes.Equal(b[:2], queryMagic) {
+		return nil, errInvalidQuery
+	}
+	typ := b[2]
+	sessionID := b[3:7]
+
+	switch typ {
+	case queryTypeHandshake:
+		return qs.marshalHandshake(sessionID), nil
+	case queryTypeStat:
+		if len(b) < 11 {
+			return nil, errInvalidQuery
+		}
+		token := int32(binary.BigEndian.Uint32(b[7:11]))
+		if !qs.validChallenge(token) {
+			return nil, errInvalidChallenge
+		}
+		// A full stat request is padded with four additional bytes
+		if len(b) >= 15 {
+			return qs.marshalFullStat(sessionID), nil
+		}
+		return qs.marshalBasicStat(sessionID), nil
+	default:
+		return nil, errInvalidQuery
+	}
+}
+
+// currentChallenge returns the current challenge token and rotates it
+// if it has expired. The previous token stays valid for one more
+// lifetime, so that clients that just did a handshake are not rejected.
+func (qs *QueryServer) currentChallenge() int32 {
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+
+	if time.Since(qs.rotatedAt) > queryChallengeLifetime {
+		qs.prevChallenge = qs.challenge
+		qs.challenge = newQueryChallenge()
+		qs.rotatedAt = time.Now()
+	}
+	return qs.challenge
+}
+
+func (qs *QueryServer) validChallenge(token int32) bool {
+	current := qs.currentChallenge()
+
+	qs.mu.Lock()
+	defer qs.mu.Unlock()
+	return token == current || token == qs.prevChallenge
+}
+
+func newQueryChallenge() int32 {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	// Clients parse the token as a signed integer, so keep it positive
+	return int32(binary.BigEndian.Uint32(b) & 0x7fffffff)
+}
+
+func (qs *QueryServer) players() []string {
+	if qs.Players == nil {
+		return nil
+	}
+	return qs.Players.Usernames(qs.GatewayID)
+}
+
+func (qs *QueryServer) motd() (string, string) {
+	motd := strings.Split(qs.PingStatus.MOTD, "\n")
+	motd2 := ""
+	if len(motd) > 1 {
+		motd2 = motd[1]
+	}
+	return motd[0], motd2
+}
+
+func (qs *QueryServer) marshalHandshake(sessionID []byte) []byte {
+	buf := bytes.Buffer{}
+	buf.WriteByte(queryTypeHandshake)
+	buf.Write(sessionID)
+	writeQueryString(&buf, strconv.Itoa(int(qs.currentChallenge())))
+	return buf.Bytes()
+}
+
+func (qs *QueryServer) marshalBasicStat(sessionID []byte) []byte {
+	motd1, motd2 := qs.motd()
+
+	buf := bytes.Buffer{}
+	buf.WriteByte(queryTypeStat)
+	buf.Write(sessionID)
+	writeQueryString(&buf, motd1)
+	writeQueryString(&buf, "SMP")
+	writeQueryString(&buf, motd2)
+	writeQueryString(&buf, strconv.Itoa(len(qs.players())))
+	writeQueryString(&buf, strconv.Itoa(qs.PingStatus.MaxPlayerCount))
+	_ = binary.Write(&buf, binary.LittleEndian, uint16(qs.HostPort))
+	writeQueryString(&buf, qs.HostIP)
+	return buf.Bytes()
+}
+
+func (qs *QueryServer) marshalFullStat(sessionID []byte) []byte {
+	motd1, motd2 := qs.motd()
+	players := qs.players()
+
+	kv := [][2]string{
+		{"hostname", motd1},
+		{"gametype", "SMP"},
+		{"game_id", "MINECRAFTPE"},
+		{"version", qs.PingStatus.VersionName},
+		{"server_engine", "BedProx"},
+		{"plugins", ""},
+		{"map", motd2},
+		{"numplayers", strconv.Itoa(len(players))},
+		{"maxplayers", strconv.Itoa(qs.PingStatus.MaxPlayerCount)},
+		{"whitelist", "off"},
+		{"hostip", qs.HostIP},
+		{"hostport", strconv.Itoa(qs.HostPort)},
+	}
+
+	buf := bytes.Buffer{}
+	buf.WriteByte(queryTypeStat)
+	buf.Write(sessionID)
+	buf.Write([]byte("splitnum\x00\x80\x00"))
+	for _, pair := range kv {
+		writeQueryString(&buf, pair[0])
+		writeQueryString(&buf, pair[1])
+	}
+	buf.Write([]byte("\x00\x01player_\x00\x00"))
+	for _, player := range players {
+		writeQueryString(&buf, player)
+	}
+	buf.WriteByte(0x00)
+	return buf.Bytes()
+}
+
+func writeQueryString(buf *bytes.Buffer, s string) {
+	buf.WriteString(s)
+	buf.WriteByte(0x00)
+}
@@ -0,0 +1,121 @@
+package bedrock_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/haveachin/bedprox/bedrock"
+)
+
+type mockPlayerLister map[string][]string
+
+func (m mockPlayerLister) Usernames(gatewayID string) []string {
+	return m[gatewayID]
+}
+
+func queryRoundTrip(t *testing.T, c net.Conn, req []byte) []byte {
+	if _, err := c.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1500)
+	_ = c.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := c.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b[:n]
+}
+
+func TestQueryServer_Serve(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qs := bedrock.QueryServer{
+		GatewayID: "gw",
+		HostIP:    "127.0.0.1",
+		HostPort:  19132,
+		PingStatus: bedrock.PingStatus{
+			VersionName:    "1.17.41",
+			MaxPlayerCount: 20,
+			MOTD:           "BedProx\nLobby",
+		},
+		Players: mockPlayerLister{
+			"gw":    {"Steve", "Alex"},
+			"other": {"Notch"},
+		},
+		Log: logr.Discard(),
+	}
+	go qs.Serve(pc)
+	defer pc.Close()
+
+	c, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	sessionID := []byte{0x01, 0x02, 0x03, 0x04}
+	resp := queryRoundTrip(t, c, append([]byte{0xfe, 0xfd, 0x09}, sessionID...))
+	if resp[0] != 0x09 || !bytes.Equal(resp[1:5], sessionID) {
+		t.Fatalf("invalid handshake response: %x", resp)
+	}
+	token, err := strconv.Atoi(string(bytes.TrimRight(resp[5:], "\x00")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(tokenBytes, uint32(token))
+	req := append([]byte{0xfe, 0xfd, 0x00}, sessionID...)
+	req = append(req, tokenBytes...)
+	req = append(req, 0x00, 0x00, 0x00, 0x00)
+	resp = queryRoundTrip(t, c, req)
+
+	for _, want := range []string{
+		"hostname\x00BedProx\x00",
+		"version\x001.17.41\x00",
+		"numplayers\x002\x00",
+		"maxplayers\x0020\x00",
+		"player_\x00\x00Steve\x00Alex\x00\x00",
+	} {
+		if !bytes.Contains(resp, []byte(want)) {
+			t.Errorf("full stat is missing %q: %q", want, resp)
+		}
+	}
+	if bytes.Contains(resp, []byte("Notch")) {
+		t.Error("full stat contains player of other gateway")
+	}
+}
+
+func TestQueryServer_InvalidChallenge(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qs := bedrock.QueryServer{Log: logr.Discard()}
+	go qs.Serve(pc)
+	defer pc.Close()
+
+	c, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	req := []byte{0xfe, 0xfd, 0x00, 0x01, 0x02, 0x03, 0x04, 0x00, 0x00, 0x00, 0x2a}
+	if _, err := c.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := c.Read(make([]byte, 1500)); err == nil {
+		t.Error("expected no response to a stat request with an invalid challenge")
+	}
+}
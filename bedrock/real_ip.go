@@ -0,0 +1,107 @@
+package bedrock
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// realIPSeparator separates the parts of a signed server address
+const realIPSeparator = "///"
+
+var (
+	errInvalidRealIP          = errors.New("invalid real IP server address")
+	errInvalidRealIPSignature = errors.New("invalid real IP signature")
+	errStaleRealIP            = errors.New("real IP timestamp is outside of the max age")
+)
+
+// RealIP verifies the server addresses that front proxies like TCPShield put
+// the address of the client in. The server address has the form of
+// hostname///ip:port///timestamp///signature, where the signature is the
+// base64 encoded SHA512withECDSA signature of everything in front of it.
+type RealIP struct {
+	PublicKey *ecdsa.PublicKey
+	// MaxAge is the maximum age of the timestamp of a server address
+	MaxAge time.Duration
+}
+
+// Parse verifies the signed server address and returns the hostname that
+// the client joined with and the address of the client.
+func (r RealIP) Parse(serverAddr string, now time.Time) (string, *net.UDPAddr, error) {
+	parts := strings.Split(serverAddr, realIPSeparator)
+	if len(parts) != 4 {
+		return "", nil, errInvalidRealIP
+	}
+	host, ipPort, timestamp, sig := parts[0], parts[1], parts[2], parts[3]
+
+	// The client appends the port that it connected to
+	if n := strings.LastIndexByte(sig, ':'); n >= 0 {
+		sig = sig[:n]
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		return "", nil, errInvalidRealIPSignature
+	}
+
+	signed := strings.Join(parts[:3], realIPSeparator)
+	hash := sha512.Sum512([]byte(signed))
+	if !ecdsa.VerifyASN1(r.PublicKey, hash[:], signature) {
+		return "", nil, errInvalidRealIPSignature
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", nil, errInvalidRealIP
+	}
+	age := now.Sub(time.Unix(unix, 0))
+	if age > r.MaxAge || age < -r.MaxAge {
+		return "", nil, errStaleRealIP
+	}
+
+	ipStr, portStr, err := net.SplitHostPort(ipPort)
+	if err != nil {
+		return "", nil, errInvalidRealIP
+	}
+	ip := net.ParseIP(ipStr)
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if ip == nil || err != nil {
+		return "", nil, errInvalidRealIP
+	}
+
+	return host, &net.UDPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// ParseRealIPPublicKey parses an ECDSA public key in the PKIX format, either
+// PEM encoded or as base64 encoded DER like TCPShield publishes it.
+func ParseRealIPPublicKey(s string) (*ecdsa.PublicKey, error) {
+	var der []byte
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		der = block.Bytes
+	} else {
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+		if err != nil {
+			return nil, err
+		}
+		der = b
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+
+	ecdsaKey, ok := key.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("real IP public key is a %T; expected an ECDSA key", key)
+	}
+	return ecdsaKey, nil
+}
@@ -0,0 +1,160 @@
+package bedrock_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/haveachin/bedprox/bedrock"
+)
+
+// signRealIP returns a server address with the signed real IP of a client.
+func signRealIP(t *testing.T, key *ecdsa.PrivateKey, host, ipPort string, timestamp time.Time) string {
+	signed := fmt.Sprintf("%s///%s///%d", host, ipPort, timestamp.Unix())
+	hash := sha512.Sum512([]byte(signed))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "///" + base64.StdEncoding.EncodeToString(sig)
+}
+
+func TestRealIP_Parse(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	realIP := bedrock.RealIP{
+		PublicKey: &key.PublicKey,
+		MaxAge:    5 * time.Second,
+	}
+
+	tt := []struct {
+		name       string
+		serverAddr string
+		host       string
+		addr       string
+		ok         bool
+	}{
+		{
+			name:       "valid",
+			serverAddr: signRealIP(t, key, "play.example.com", "203.0.113.7:54321", now.Add(-2*time.Second)),
+			host:       "play.example.com",
+			addr:       "203.0.113.7:54321",
+			ok:         true,
+		},
+		{
+			name:       "valid with port",
+			serverAddr: signRealIP(t, key, "play.example.com", "203.0.113.7:54321", now) + ":19132",
+			host:       "play.example.com",
+			addr:       "203.0.113.7:54321",
+			ok:         true,
+		},
+		{
+			name:       "valid IPv6",
+			serverAddr: signRealIP(t, key, "play.example.com", "[2001:db8::1]:19132", now),
+			host:       "play.example.com",
+			addr:       "[2001:db8::1]:19132",
+			ok:         true,
+		},
+		{
+			name:       "stale",
+			serverAddr: signRealIP(t, key, "play.example.com", "203.0.113.7:54321", now.Add(-time.Minute)),
+		},
+		{
+			name:       "from the future",
+			serverAddr: signRealIP(t, key, "play.example.com", "203.0.113.7:54321", now.Add(time.Minute)),
+		},
+		{
+			name:       "signed by other key",
+			serverAddr: signRealIP(t, otherKey, "play.example.com", "203.0.113.7:54321", now),
+		},
+		{
+			name: "tampered IP",
+			serverAddr: strings.Replace(
+				signRealIP(t, key, "play.example.com", "203.0.113.7:54321", now),
+				"203.0.113.7", "203.0.113.8", 1),
+		},
+		{
+			name:       "invalid IP",
+			serverAddr: signRealIP(t, key, "play.example.com", "example.com:54321", now),
+		},
+		{
+			name:       "unsigned",
+			serverAddr: "play.example.com",
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			host, addr, err := realIP.Parse(tc.serverAddr, now)
+			if !tc.ok {
+				if err == nil {
+					t.Fatalf("expected an error; got host %q and address %s", host, addr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if host != tc.host {
+				t.Errorf("expected host %q; got %q", tc.host, host)
+			}
+			if addr.String() != tc.addr {
+				t.Errorf("expected address %s; got %s", tc.addr, addr)
+			}
+		})
+	}
+}
+
+func TestParseRealIPPublicKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		name string
+		key  string
+	}{
+		{
+			name: "base64",
+			key:  base64.StdEncoding.EncodeToString(der),
+		},
+		{
+			name: "PEM",
+			key:  string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			pub, err := bedrock.ParseRealIPPublicKey(tc.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !pub.Equal(&key.PublicKey) {
+				t.Error("expected the parsed key to equal the original key")
+			}
+		})
+	}
+}
@@ -1,13 +1,16 @@
 package bedrock
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-logr/logr"
 	"github.com/haveachin/bedprox"
+	"github.com/haveachin/bedprox/bedrock/protocol"
 	"github.com/haveachin/bedprox/webhook"
 	"github.com/sandertv/go-raknet"
 )
@@ -22,6 +25,41 @@ type Server struct {
 	DialTimeoutMessage string
 	WebhookIDs         []string
 	Log                logr.Logger
+	// Mode is how the sessions of clients with the server are handled.
+	// An empty Mode is the same as ServerModeProxy.
+	Mode ServerMode
+	// ClientPacketHandlers and ServerPacketHandlers handle the packets
+	// of sessions in ServerModeTerminate that are sent by the client
+	// and by the server respectively.
+	ClientPacketHandlers []PacketHandler
+	ServerPacketHandlers []PacketHandler
+	// SwitchServers are the servers that players of terminated sessions can
+	// switch to with the SwitchCommand, or that the server can switch them
+	// to with a script message, mapped by their ID.
+	SwitchServers map[string]*Server
+	// TransferTarget is the public address that clients are sent to
+	// in ServerModeTransfer.
+	TransferTarget bedprox.TransferTarget
+	// MinProtocolVersion and MaxProtocolVersion are the protocol versions
+	// of the clients that the server supports. Zero means no bound.
+	MinProtocolVersion int32
+	MaxProtocolVersion int32
+	// IdleTimeout closes the tunnels of the server if it sends no
+	// packets for this long. Zero means no timeout.
+	IdleTimeout time.Duration
+	// TrafficLimit limits the traffic of each tunnel of the server
+	TrafficLimit bedprox.TrafficLimit
+	// SharedTrafficLimit limits the traffic of all tunnels of the
+	// server together
+	SharedTrafficLimit bedprox.TrafficLimit
+	// Capacity is the number of players that the server has room for
+	Capacity bedprox.Capacity
+	// Queue is the policy of the join queue of the server. Clients stay
+	// connected if the server can not be reached, while it has a queue.
+	Queue bedprox.QueuePolicy
+	// DialConcurrency is the number of clients that the server is dialed
+	// for at once. Their sessions still start in the order that they joined.
+	DialConcurrency int
 }
 
 func (s Server) GetID() string {
@@ -36,12 +74,47 @@ func (s Server) GetWebhookIDs() []string {
 	return s.WebhookIDs
 }
 
+func (s Server) GetTransferTarget() (bedprox.TransferTarget, bool) {
+	return s.TransferTarget, s.Mode == ServerModeTransfer
+}
+
+func (s Server) GetCapacity() bedprox.Capacity {
+	return s.Capacity
+}
+
+func (s Server) GetQueuePolicy() bedprox.QueuePolicy {
+	return s.Queue
+}
+
+func (s Server) GetSharedTrafficLimit() bedprox.TrafficLimit {
+	return s.SharedTrafficLimit
+}
+
+func (s Server) GetDialConcurrency() int {
+	return s.DialConcurrency
+}
+
 func (s *Server) SetLogger(log logr.Logger) {
 	s.Log = log
 }
 
-func (s Server) Dial() (*raknet.Conn, error) {
-	c, err := s.Dialer.DialTimeout(s.Address, s.DialTimeout)
+// Dial connects to the server for the client. If SendProxyProtocol is set,
+// every datagram to the server starts with a PROXY protocol v2 header
+// with the address of the client.
+func (s Server) Dial(pc *ProcessedConn) (*raknet.Conn, error) {
+	dialer := s.Dialer
+	if s.SendProxyProtocol {
+		header, err := proxyProtocolHeader(pc)
+		if err != nil {
+			return nil, err
+		}
+		dialer.UpstreamDialer = proxyProtocolDialer{
+			upstream: s.Dialer.UpstreamDialer,
+			header:   header,
+		}
+	}
+
+	c, err := dialer.DialTimeout(s.Address, s.DialTimeout)
 	if err != nil {
 		return nil, err
 	}
@@ -49,9 +122,56 @@ func (s Server) Dial() (*raknet.Conn, error) {
 	return c, nil
 }
 
+// requestNetworkSettings replays the network settings request of the client
+// to the server. The server responds with its network settings which are not
+// forwarded, since the client already got them during processing. The server
+// has to use the same compression algorithm as the proxy though.
+func (s Server) requestNetworkSettings(rc *raknet.Conn, req []byte) error {
+	if _, err := rc.Write(req); err != nil {
+		return err
+	}
+
+	if s.DialTimeout > 0 {
+		_ = rc.SetReadDeadline(time.Now().Add(s.DialTimeout))
+		defer rc.SetReadDeadline(time.Time{})
+	}
+
+	b, err := rc.ReadPacket()
+	if err != nil {
+		return err
+	}
+
+	decoder := protocol.NewDecoder(nil)
+	decoder.SetCompression(protocol.NoCompression)
+	pks, err := decoder.DecodeBatch(b)
+	if err != nil {
+		return err
+	}
+
+	if len(pks) < 1 {
+		return errors.New("no network settings received")
+	}
+
+	var pk protocol.NetworkSettings
+	if err := protocol.UnmarshalPacket(pks[0], &pk); err != nil {
+		return err
+	}
+
+	if pk.CompressionAlgorithm != protocol.CompressionAlgorithmFlate {
+		return fmt.Errorf("unsupported compression algorithm %d", pk.CompressionAlgorithm)
+	}
+	return nil
+}
+
 func (s Server) replaceTemplates(c ProcessedConn, msg string) string {
 	tmpls := map[string]string{
 		"username":      c.username,
+		"xuid":          c.XUID(),
+		"uuid":          c.UUID(),
+		"deviceOS":      strconv.Itoa(c.DeviceOS()),
+		"deviceModel":   c.DeviceModel(),
+		"gameVersion":   c.GameVersion(),
+		"languageCode":  c.LanguageCode(),
 		"now":           time.Now().Format(time.RFC822),
 		"remoteAddress": c.RemoteAddr().String(),
 		"localAddress":  c.LocalAddr().String(),
@@ -71,10 +191,30 @@ func (s Server) handleOffline(c ProcessedConn) error {
 	return c.Disconnect(msg)
 }
 
+// checkProtocolVersion returns a bedprox.RejectError if the server
+// does not support clients of the protocol version.
+func (s Server) checkProtocolVersion(v int32) error {
+	if s.MinProtocolVersion > 0 && v < s.MinProtocolVersion {
+		return bedprox.RejectError{Reason: bedprox.RejectReasonOutdatedClient}
+	}
+	if s.MaxProtocolVersion > 0 && v > s.MaxProtocolVersion {
+		return bedprox.RejectError{Reason: bedprox.RejectReasonOutdatedServer}
+	}
+	return nil
+}
+
 func (s Server) ProcessConn(c net.Conn, webhooks []webhook.Webhook) (bedprox.ConnTunnel, error) {
 	pc := c.(*ProcessedConn)
-	rc, err := s.Dial()
+	if err := s.checkProtocolVersion(pc.clientProtocol); err != nil {
+		return bedprox.ConnTunnel{}, err
+	}
+
+	rc, err := s.Dial(pc)
 	if err != nil {
+		// The client waits in the queue until the server is reachable
+		if s.Queue.Enabled() {
+			return bedprox.ConnTunnel{}, bedprox.ErrServerUnavailable
+		}
 		if err := s.handleOffline(*pc); err != nil {
 			s.Log.Error(err, "failed to handle offline")
 			return bedprox.ConnTunnel{}, err
@@ -83,14 +223,73 @@ func (s Server) ProcessConn(c net.Conn, webhooks []webhook.Webhook) (bedprox.Con
 		return bedprox.ConnTunnel{}, err
 	}
 
+	if pc.networkSettingsRequest != nil {
+		if err := s.requestNetworkSettings(rc, pc.networkSettingsRequest); err != nil {
+			s.Log.Error(err, "failed to request network settings")
+			rc.Close()
+			if err := s.handleOffline(*pc); err != nil {
+				s.Log.Error(err, "failed to handle offline")
+			}
+			return bedprox.ConnTunnel{}, err
+		}
+	}
+
+	if s.Mode == ServerModeTerminate {
+		return s.processTerminated(pc, rc)
+	}
+
 	if _, err := rc.Write(pc.readBytes); err != nil {
 		s.Log.Error(err, "failed to write to server")
 		rc.Close()
+		if err := s.handleOffline(*pc); err != nil {
+			s.Log.Error(err, "failed to handle offline")
+		}
+		return bedprox.ConnTunnel{}, err
+	}
+
+	return bedprox.ConnTunnel{
+		Conn:               pc,
+		RemoteConn:         rc,
+		ServerIdleTimeout:  s.IdleTimeout,
+		ServerTrafficLimit: s.TrafficLimit,
+	}, nil
+}
+
+// processTerminated terminates the encryption of the session with the client and
+// logs in to the server with a session of the proxy.
+func (s Server) processTerminated(pc *ProcessedConn, rc *raknet.Conn) (bedprox.ConnTunnel, error) {
+	key, err := newSessionKey()
+	if err != nil {
+		rc.Close()
+		if err := s.handleOffline(*pc); err != nil {
+			s.Log.Error(err, "failed to handle offline")
+		}
+		return bedprox.ConnTunnel{}, err
+	}
+
+	if err := s.terminateClientEncryption(pc, key); err != nil {
+		s.Log.Error(err, "failed to terminate client encryption")
+		rc.Close()
+		if err := s.handleOffline(*pc); err != nil {
+			s.Log.Error(err, "failed to handle offline")
+		}
+		return bedprox.ConnTunnel{}, err
+	}
+
+	sc, err := s.login(rc, pc, key)
+	if err != nil {
+		s.Log.Error(err, "failed to log in to server")
+		rc.Close()
+		if err := s.handleOffline(*pc); err != nil {
+			s.Log.Error(err, "failed to handle offline")
+		}
 		return bedprox.ConnTunnel{}, err
 	}
 
 	return bedprox.ConnTunnel{
-		Conn:       pc,
-		RemoteConn: rc,
+		Conn:               pc,
+		RemoteConn:         newSession(pc, key, sc),
+		ServerIdleTimeout:  s.IdleTimeout,
+		ServerTrafficLimit: s.TrafficLimit,
 	}, nil
 }
@@ -0,0 +1,453 @@
+package bedrock
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/haveachin/bedprox/bedrock/protocol"
+	"github.com/haveachin/bedprox/bedrock/protocol/login"
+	"github.com/sandertv/go-raknet"
+)
+
+// ServerMode defines how the proxy handles the session of a client with a server.
+type ServerMode string
+
+const (
+	// ServerModeProxy relays the session of the client as it is. The proxy only
+	// sees the login of the client, since everything after it is encrypted.
+	ServerModeProxy ServerMode = "proxy"
+	// ServerModeTerminate terminates the encryption of the session at the proxy.
+	// The proxy logs in to the server with a resigned login of the client, so the
+	// server has to accept players that are not signed in to XBOX Live.
+	ServerModeTerminate ServerMode = "terminate"
+	// ServerModeTransfer sends the client a Transfer packet to the public
+	// address of the server instead of relaying its session. The proxy still
+	// routes the client by its address, but the server sees the client's IP.
+	ServerModeTransfer ServerMode = "transfer"
+)
+
+// PacketHandler handles a packet that is relayed in a Session. The packet holds its
+// header and can be decoded with protocol.Decode or protocol.UnmarshalPacket.
+// The packet is dropped if the handler returns false.
+type PacketHandler func(s *Session, id uint32, pk []byte) bool
+
+// serverConn is the connection of a Session to a server.
+type serverConn struct {
+	*raknet.Conn
+	server *Server
+	// encryption is nil if the server did not start an encryption handshake
+	encryption *encryption
+	// pending holds batches that the server sent during the login,
+	// which are read before any other batch
+	pending [][]byte
+}
+
+func (sc *serverConn) readPacket() ([]byte, error) {
+	if len(sc.pending) > 0 {
+		b := sc.pending[0]
+		sc.pending = sc.pending[1:]
+		return b, nil
+	}
+
+	if sc.encryption == nil {
+		return sc.Conn.ReadPacket()
+	}
+	return sc.encryption.readPacket(sc.Conn)
+}
+
+func (sc *serverConn) writePacket(b []byte) (int, error) {
+	if sc.encryption == nil {
+		return sc.Conn.Write(b)
+	}
+	return sc.encryption.writePacket(sc.Conn, b)
+}
+
+// Session is the connection to a server of a session whose encryption is terminated
+// by the proxy. It is the remote connection of the tunnel: reading returns the decrypted
+// batches of the server and writing sends the decrypted batches of the client to the
+// server. The packets of both directions pass through the handlers of the server.
+//
+// The server of a Session can be switched while the client stays connected to the proxy.
+type Session struct {
+	client *ProcessedConn
+	// key is the key that the proxy logs in to servers with
+	key *ecdsa.PrivateKey
+	// done is closed when the Session is closed
+	done chan struct{}
+
+	mu     sync.Mutex
+	server *serverConn
+	closed bool
+	// player holds the state of the player that is needed to switch servers
+	player playerState
+	// switching is true while the session switches servers
+	switching bool
+	// paused is closed once a switch completes. It is nil if no switch is
+	// running. The batches of the servers are not relayed while it is set.
+	paused chan struct{}
+}
+
+func newSession(pc *ProcessedConn, key *ecdsa.PrivateKey, sc *serverConn) *Session {
+	return &Session{
+		client: pc,
+		key:    key,
+		done:   make(chan struct{}),
+		server: sc,
+		player: playerState{
+			entities: map[int64]struct{}{},
+		},
+	}
+}
+
+// Client returns the connection of the client of the session.
+func (s *Session) Client() *ProcessedConn {
+	return s.client
+}
+
+// Server returns the server that the client is currently connected to.
+func (s *Session) Server() *Server {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.server.server
+}
+
+// current returns the connection to the current server. It waits for
+// a running switch to complete.
+func (s *Session) current() (*serverConn, error) {
+	s.mu.Lock()
+	paused := s.paused
+	s.mu.Unlock()
+
+	if paused != nil {
+		select {
+		case <-paused:
+		case <-s.done:
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, net.ErrClosed
+	}
+	return s.server, nil
+}
+
+// replaced reports if the session switched away from the server
+// connection sc.
+func (s *Session) replaced(sc *serverConn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.closed && s.server != sc
+}
+
+// ReadPacket reads the next batch of the server, decrypts it and
+// runs its packets through the server packet handlers.
+func (s *Session) ReadPacket() ([]byte, error) {
+	for {
+		sc, err := s.current()
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := sc.readPacket()
+		if s.replaced(sc) {
+			// The batches of a server that the session switched
+			// away from are not relayed anymore
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		b, err = s.handle(b, func(pk []byte) ([]byte, bool) {
+			return s.handleServerPacket(sc, pk)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		// All packets of the batch were dropped
+		if b == nil {
+			continue
+		}
+		return b, nil
+	}
+}
+
+func (s *Session) Read(b []byte) (int, error) {
+	return readInto(b, s.ReadPacket)
+}
+
+// Write runs the packets of the batch of the client through the client
+// packet handlers, encrypts it and writes it to the server.
+func (s *Session) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	sc := s.server
+	paused := s.paused != nil
+	s.mu.Unlock()
+
+	batch, err := s.handle(b, func(pk []byte) ([]byte, bool) {
+		return s.handleClientPacket(sc, pk)
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// The batches of the client are dropped while the client
+	// is reset for the server that it switches to
+	if batch == nil || paused {
+		return len(b), nil
+	}
+
+	if _, err := sc.writePacket(batch); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close closes the connection to the current server.
+func (s *Session) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	return s.server.Close()
+}
+
+func (s *Session) LocalAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.server.LocalAddr()
+}
+
+func (s *Session) RemoteAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.server.RemoteAddr()
+}
+
+func (s *Session) SetDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.server.SetDeadline(t)
+}
+
+func (s *Session) SetReadDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.server.SetReadDeadline(t)
+}
+
+func (s *Session) SetWriteDeadline(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.server.SetWriteDeadline(t)
+}
+
+// WritePacketToClient sends the packet to the client without
+// passing it through the handlers.
+func (s *Session) WritePacketToClient(pk protocol.Packet) error {
+	return s.client.writePacket(pk)
+}
+
+// WritePacketToServer sends the packet to the current server without
+// passing it through the handlers.
+func (s *Session) WritePacketToServer(pk protocol.Packet) error {
+	s.mu.Lock()
+	sc := s.server
+	s.mu.Unlock()
+	return writePacketTo(sc, pk, s.client.compression)
+}
+
+// Disconnect disconnects the client with the message and closes
+// the connection to the server.
+func (s *Session) Disconnect(msg string) error {
+	defer s.Close()
+	return s.client.Disconnect(msg)
+}
+
+// writePacketTo marshals the packet with the compression passed and writes it
+// to the server connection.
+func writePacketTo(sc *serverConn, pk protocol.Packet, c protocol.Compression) error {
+	b, err := protocol.MarshalPacketWith(pk, c)
+	if err != nil {
+		return err
+	}
+
+	_, err = sc.writePacket(b)
+	return err
+}
+
+// encodeBatch encodes the packets into one batch with the compression passed.
+func encodeBatch(c protocol.Compression, pks ...[]byte) ([]byte, error) {
+	buf := bytes.Buffer{}
+	encoder := protocol.NewEncoder(&buf)
+	encoder.SetCompression(c)
+	if err := encoder.Encode(pks...); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// handle runs the packets of the batch through handlePacket, which returns the
+// packet that is relayed and if it changed the packet. A nil packet is dropped.
+// handle returns the batch itself if no packet was changed, a new batch with the
+// remaining packets if some were changed and nil if all of them were dropped.
+func (s *Session) handle(batch []byte, handlePacket func(pk []byte) ([]byte, bool)) ([]byte, error) {
+	decoder := protocol.NewDecoder(nil)
+	decoder.SetCompression(s.client.compression)
+	pks, err := decoder.DecodeBatch(batch)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed bool
+	kept := make([][]byte, 0, len(pks))
+	for _, pk := range pks {
+		pk, c := handlePacket(pk)
+		changed = changed || c
+		if pk != nil {
+			kept = append(kept, pk)
+		}
+	}
+
+	if !changed {
+		return batch, nil
+	}
+	if len(kept) == 0 {
+		return nil, nil
+	}
+	return encodeBatch(s.client.compression, kept...)
+}
+
+// runHandlers reports if the packet is kept by all handlers.
+func (s *Session) runHandlers(id uint32, pk []byte, handlers []PacketHandler) bool {
+	for _, handle := range handlers {
+		if !handle(s, id, pk) {
+			return false
+		}
+	}
+	return true
+}
+
+// readLoginBatch reads a batch during the login of a session and returns it with
+// its packets. The read is bounded by the timeout, if it is not zero.
+func readLoginBatch(readPacket func() ([]byte, error), c net.Conn, compression protocol.Compression, timeout time.Duration) ([]byte, [][]byte, error) {
+	if timeout > 0 {
+		_ = c.SetReadDeadline(time.Now().Add(timeout))
+		defer c.SetReadDeadline(time.Time{})
+	}
+
+	b, err := readPacket()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	decoder := protocol.NewDecoder(nil)
+	decoder.SetCompression(compression)
+	pks, err := decoder.DecodeBatch(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(pks) < 1 {
+		return nil, nil, errors.New("no packets received")
+	}
+	return b, pks, nil
+}
+
+// terminateClientEncryption completes the encryption handshake with the client
+// with the key of the session.
+func (s Server) terminateClientEncryption(pc *ProcessedConn, key *ecdsa.PrivateKey) error {
+	if pc.publicKey == nil {
+		return errors.New("client has no public key")
+	}
+
+	salt, err := newSalt()
+	if err != nil {
+		return err
+	}
+
+	jwt, err := login.EncodeHandshake(key, salt)
+	if err != nil {
+		return err
+	}
+
+	if err := pc.writePacket(&protocol.ServerToClientHandshake{JWT: jwt}); err != nil {
+		return err
+	}
+
+	// The client encrypts everything after the handshake
+	enc, err := newEncryption(protocol.EncryptionKey(key, pc.publicKey, salt))
+	if err != nil {
+		return err
+	}
+	pc.encryption = enc
+
+	_, pks, err := readLoginBatch(pc.ReadPacket, pc.Conn, pc.compression, s.DialTimeout)
+	if err != nil {
+		return err
+	}
+
+	var handshake protocol.ClientToServerHandshake
+	return protocol.UnmarshalPacket(pks[0], &handshake)
+}
+
+// login logs in to the server with the login of the client, which is resigned
+// with the key of the session, and completes the encryption handshake with the server.
+func (s *Server) login(rc *raknet.Conn, pc *ProcessedConn, key *ecdsa.PrivateKey) (*serverConn, error) {
+	sc := serverConn{
+		Conn:   rc,
+		server: s,
+	}
+
+	req, err := login.Resign(pc.connectionRequest, key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := writePacketTo(&sc, &protocol.Login{
+		ClientProtocol:    pc.clientProtocol,
+		ConnectionRequest: req,
+	}, pc.compression); err != nil {
+		return nil, err
+	}
+
+	b, pks, err := readLoginBatch(rc.ReadPacket, rc, pc.compression, s.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var handshake protocol.ServerToClientHandshake
+	if err := protocol.UnmarshalPacket(pks[0], &handshake); err != nil {
+		// Servers that do not encrypt the session continue with the login
+		// right away, so the batch is relayed to the client
+		sc.pending = append(sc.pending, b)
+		return &sc, nil
+	}
+
+	serverKey, salt, err := login.ParseHandshake(handshake.JWT)
+	if err != nil {
+		return nil, err
+	}
+
+	enc, err := newEncryption(protocol.EncryptionKey(key, serverKey, salt))
+	if err != nil {
+		return nil, err
+	}
+	sc.encryption = enc
+
+	if err := writePacketTo(&sc, &protocol.ClientToServerHandshake{}, pc.compression); err != nil {
+		return nil, fmt.Errorf("write handshake: %w", err)
+	}
+	return &sc, nil
+}
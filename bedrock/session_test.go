@@ -0,0 +1,500 @@
+package bedrock_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/haveachin/bedprox/bedrock"
+	"github.com/haveachin/bedprox/bedrock/protocol"
+	"github.com/haveachin/bedprox/bedrock/protocol/login"
+	"github.com/sandertv/go-raknet"
+)
+
+const (
+	idText           = 0x09
+	idCommandRequest = 0x4d
+)
+
+// peer is one end of a session in the tests, either a fake client or a fake server.
+type peer struct {
+	conn *raknet.Conn
+	enc  *protocol.Encryption
+	// compression is the compression of the batches once the network
+	// settings were negotiated. Nil means the DefaultCompression.
+	compression *protocol.Compression
+	// protocol is the protocol version that the packets are read for
+	protocol int32
+}
+
+func (p *peer) write(pks ...[]byte) error {
+	buf := bytes.Buffer{}
+	encoder := protocol.NewEncoder(&buf)
+	if p.compression != nil {
+		encoder.SetCompression(*p.compression)
+	}
+	if err := encoder.Encode(pks...); err != nil {
+		return err
+	}
+
+	b := buf.Bytes()
+	if p.enc != nil {
+		b = p.enc.Encrypt(b)
+	}
+	_, err := p.conn.Write(b)
+	return err
+}
+
+func (p *peer) writePacket(pk protocol.Packet) error {
+	return p.write(marshal(pk))
+}
+
+func (p *peer) read() ([][]byte, error) {
+	_ = p.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b, err := p.conn.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.enc != nil {
+		if b, err = p.enc.Decrypt(b); err != nil {
+			return nil, err
+		}
+	}
+	decoder := protocol.NewDecoder(nil)
+	if p.compression != nil {
+		decoder.SetCompression(*p.compression)
+	}
+	return decoder.DecodeBatch(b)
+}
+
+func (p *peer) readPacket(pk protocol.Packet) error {
+	pks, err := p.read()
+	if err != nil {
+		return err
+	}
+	if len(pks) != 1 {
+		return fmt.Errorf("expected 1 packet; got %d", len(pks))
+	}
+	return protocol.UnmarshalPacketFor(pks[0], pk, p.protocol)
+}
+
+// marshal returns the packet with its header, but without a batch.
+func marshal(pk protocol.Packet) []byte {
+	buf := bytes.Buffer{}
+	w := protocol.NewWriter(&buf)
+	header := protocol.Header{PacketID: pk.ID()}
+	_ = header.Write(w)
+	pk.Marshal(w)
+	return buf.Bytes()
+}
+
+// rawPacket returns a packet with the ID and payload passed.
+func rawPacket(id uint32, payload string) []byte {
+	buf := bytes.Buffer{}
+	header := protocol.Header{PacketID: id}
+	_ = header.Write(&buf)
+	buf.WriteString(payload)
+	return buf.Bytes()
+}
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func signToken(t *testing.T, key *ecdsa.PrivateKey, claims jwt.MapClaims) string {
+	x5u, err := login.MarshalPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES384, claims)
+	token.Header["x5u"] = x5u
+	s, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// newLoginRequest returns a self-signed login request of a player named Steve.
+func newLoginRequest(t *testing.T, key *ecdsa.PrivateKey) []byte {
+	return newLoginRequestTo(t, key, "play.example.com:19132")
+}
+
+// newLoginRequestTo returns a self-signed login request of a player named
+// Steve that joins serverAddr.
+func newLoginRequestTo(t *testing.T, key *ecdsa.PrivateKey, serverAddr string) []byte {
+	pub, err := login.MarshalPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity := signToken(t, key, jwt.MapClaims{
+		"identityPublicKey": pub,
+		"extraData": map[string]interface{}{
+			"displayName": "Steve",
+			"XUID":        "2535412345678901",
+			"identity":    "5b0e1c52-9d8a-3b0e-a5d5-7b0f4a9c2f11",
+		},
+	})
+	clientData := signToken(t, key, jwt.MapClaims{
+		"ServerAddress": serverAddr,
+		"GameVersion":   "1.19.50",
+	})
+
+	chainData, err := json.Marshal(map[string][]string{"chain": {identity}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.Buffer{}
+	_ = binary.Write(&buf, binary.LittleEndian, int32(len(chainData)))
+	buf.Write(chainData)
+	_ = binary.Write(&buf, binary.LittleEndian, int32(len(clientData)))
+	buf.WriteString(clientData)
+	return buf.Bytes()
+}
+
+// acceptPlayer accepts one player and completes the login and the encryption
+// handshake as a server.
+func acceptPlayer(l *raknet.Listener) (*peer, error) {
+	c, err := l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	p := peer{conn: c.(*raknet.Conn)}
+
+	var loginPk protocol.Login
+	if err := p.readPacket(&loginPk); err != nil {
+		return nil, fmt.Errorf("read login: %w", err)
+	}
+	p.protocol = loginPk.ClientProtocol
+
+	iData, _, authResult, err := login.Parse(loginPk.ConnectionRequest)
+	if err != nil {
+		return nil, fmt.Errorf("parse login: %w", err)
+	}
+	if iData.DisplayName != "Steve" {
+		return nil, fmt.Errorf("expected username Steve; got %q", iData.DisplayName)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := []byte("0123456789abcdef")
+	token, err := login.EncodeHandshake(key, salt)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.writePacket(&protocol.ServerToClientHandshake{JWT: token}); err != nil {
+		return nil, err
+	}
+
+	if p.enc, err = protocol.NewEncryption(protocol.EncryptionKey(key, authResult.PublicKey, salt)); err != nil {
+		return nil, err
+	}
+	if err := p.readPacket(&protocol.ClientToServerHandshake{}); err != nil {
+		return nil, fmt.Errorf("read handshake: %w", err)
+	}
+	return &p, nil
+}
+
+// fakeServer accepts one player, completes the login and sends every batch
+// that it receives after the login to the received channel.
+func fakeServer(l *raknet.Listener, received chan<- [][]byte) error {
+	p, err := acceptPlayer(l)
+	if err != nil {
+		return err
+	}
+	defer p.conn.Close()
+
+	if err := p.writePacket(&protocol.PlayStatus{Status: protocol.PlayStatusLoginSuccess}); err != nil {
+		return err
+	}
+
+	for {
+		pks, err := p.read()
+		if err != nil {
+			close(received)
+			return nil
+		}
+		received <- pks
+	}
+}
+
+// proxy processes one connection and starts the tunnel to the server in
+// ServerModeTerminate. The session is sent to the sessions channel.
+func proxy(l *raknet.Listener, srv bedrock.Server, sessions chan<- *bedrock.Session) error {
+	c, err := l.Accept()
+	if err != nil {
+		return err
+	}
+
+	pc, err := bedrock.ConnProcessor{}.ProcessConn(&bedrock.Conn{Conn: c.(*raknet.Conn)})
+	if err != nil {
+		return fmt.Errorf("process conn: %w", err)
+	}
+
+	ct, err := srv.ProcessConn(pc, nil)
+	if err != nil {
+		return fmt.Errorf("process conn with server: %w", err)
+	}
+
+	sessions <- ct.RemoteConn.(*bedrock.Session)
+	go ct.Start()
+	return nil
+}
+
+// connectClient connects a fake client of the protocol version passed to the
+// proxy and completes the encryption handshake with the proxy.
+func connectClient(t *testing.T, addr string, clientProtocol int32) *peer {
+	dialer := raknet.Dialer{ErrorLog: log.New(ioutil.Discard, "", 0)}
+	rc, err := dialer.Dial(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := peer{conn: rc, protocol: clientProtocol}
+
+	clientKey := newKey(t)
+	if err := client.writePacket(&protocol.Login{
+		ClientProtocol:    clientProtocol,
+		ConnectionRequest: newLoginRequest(t, clientKey),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	var handshake protocol.ServerToClientHandshake
+	if err := client.readPacket(&handshake); err != nil {
+		t.Fatal(err)
+	}
+	proxyKey, salt, err := login.ParseHandshake(handshake.JWT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.enc, err = protocol.NewEncryption(protocol.EncryptionKey(clientKey, proxyKey, salt)); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.writePacket(&protocol.ClientToServerHandshake{}); err != nil {
+		t.Fatal(err)
+	}
+	return &client
+}
+
+func TestServer_ProcessConn_Terminate(t *testing.T) {
+	srvListener, err := raknet.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srvListener.Close()
+
+	proxyListener, err := raknet.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyListener.Close()
+
+	srv := bedrock.Server{
+		Address:     srvListener.Addr().String(),
+		DialTimeout: 5 * time.Second,
+		Mode:        bedrock.ServerModeTerminate,
+		Log:         logr.Discard(),
+		ClientPacketHandlers: []bedrock.PacketHandler{
+			// The proxy handles commands itself
+			func(s *bedrock.Session, id uint32, pk []byte) bool {
+				return id != idCommandRequest
+			},
+		},
+	}
+
+	errs := make(chan error, 2)
+	received := make(chan [][]byte, 4)
+	sessions := make(chan *bedrock.Session, 1)
+	go func() {
+		if err := fakeServer(srvListener, received); err != nil {
+			errs <- err
+		}
+	}()
+	go func() {
+		if err := proxy(proxyListener, srv, sessions); err != nil {
+			errs <- err
+		}
+	}()
+
+	client := connectClient(t, proxyListener.Addr().String(), 471)
+	defer client.conn.Close()
+
+	var status protocol.PlayStatus
+	if err := client.readPacket(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Status != protocol.PlayStatusLoginSuccess {
+		t.Errorf("expected login success; got status %d", status.Status)
+	}
+
+	var sess *bedrock.Session
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	case sess = <-sessions:
+	}
+
+	text := rawPacket(idText, "hello")
+	if err := client.write(text, rawPacket(idCommandRequest, "/server lobby")); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-errs:
+		t.Fatal(err)
+	case pks := <-received:
+		if len(pks) != 1 || !bytes.Equal(pks[0], text) {
+			t.Errorf("expected only the text packet to be relayed; got %x", pks)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not receive the packets of the client")
+	}
+
+	transfer := protocol.Transfer{Address: "play.example.com", Port: 19132}
+	if err := sess.WritePacketToClient(&transfer); err != nil {
+		t.Fatal(err)
+	}
+	var injected protocol.Transfer
+	if err := client.readPacket(&injected); err != nil {
+		t.Fatal(err)
+	}
+	if injected != transfer {
+		t.Errorf("expected %v; got %v", transfer, injected)
+	}
+
+	if err := sess.Disconnect("Goodbye"); err != nil {
+		t.Fatal(err)
+	}
+	var disconnect protocol.Disconnect
+	if err := client.readPacket(&disconnect); err != nil {
+		t.Fatal(err)
+	}
+	if disconnect.Message != "Goodbye" {
+		t.Errorf("expected disconnect message %q; got %q", "Goodbye", disconnect.Message)
+	}
+}
+
+func TestServer_ProcessConn_TerminateFailsWithoutServer(t *testing.T) {
+	proxyListener, err := raknet.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyListener.Close()
+
+	srv := bedrock.Server{
+		Address:            "127.0.0.1:1",
+		DialTimeout:        100 * time.Millisecond,
+		Mode:               bedrock.ServerModeTerminate,
+		DialTimeoutMessage: "offline",
+		Log:                logr.Discard(),
+	}
+
+	errs := make(chan error, 1)
+	go func() { errs <- proxy(proxyListener, srv, nil) }()
+
+	rc, err := raknet.Dial(proxyListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	client := peer{conn: rc}
+
+	if err := client.writePacket(&protocol.Login{
+		ClientProtocol:    471,
+		ConnectionRequest: newLoginRequest(t, newKey(t)),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client is disconnected before the proxy starts the handshake
+	var disconnect protocol.Disconnect
+	if err := client.readPacket(&disconnect); err != nil {
+		t.Fatal(err)
+	}
+	if disconnect.Message != "offline" {
+		t.Errorf("expected disconnect message %q; got %q", "offline", disconnect.Message)
+	}
+
+	if err := <-errs; err == nil {
+		t.Error("expected processing to fail")
+	}
+}
+
+func TestServer_ProcessConn_TerminateFailsWithoutHandshake(t *testing.T) {
+	proxyListener, err := raknet.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyListener.Close()
+
+	srv := bedrock.Server{
+		Address:            silentBackend(t),
+		DialTimeout:        100 * time.Millisecond,
+		Mode:               bedrock.ServerModeTerminate,
+		DialTimeoutMessage: "offline",
+		Log:                logr.Discard(),
+	}
+
+	errs := make(chan error, 1)
+	go func() { errs <- proxy(proxyListener, srv, nil) }()
+
+	rc, err := raknet.Dial(proxyListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	client := peer{conn: rc}
+
+	clientKey := newKey(t)
+	if err := client.writePacket(&protocol.Login{
+		ClientProtocol:    471,
+		ConnectionRequest: newLoginRequest(t, clientKey),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client never answers the handshake of the proxy
+	var handshake protocol.ServerToClientHandshake
+	if err := client.readPacket(&handshake); err != nil {
+		t.Fatal(err)
+	}
+	proxyKey, salt, err := login.ParseHandshake(handshake.JWT)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.enc, err = protocol.NewEncryption(protocol.EncryptionKey(clientKey, proxyKey, salt)); err != nil {
+		t.Fatal(err)
+	}
+
+	var disconnect protocol.Disconnect
+	if err := client.readPacket(&disconnect); err != nil {
+		t.Fatal(err)
+	}
+	if disconnect.Message != "offline" {
+		t.Errorf("expected disconnect message %q; got %q", "offline", disconnect.Message)
+	}
+
+	if err := <-errs; err == nil {
+		t.Error("expected processing to fail")
+	}
+}
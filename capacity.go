@@ -0,0 +1,114 @@
+package bedprox
+
+import (
+	"strings"
+	"sync"
+)
+
+// Capacity is the number of players that a server or gateway has room for
+type Capacity struct {
+	// MaxPlayers is the number of players that can be connected at once.
+	// Zero means no limit.
+	MaxPlayers int
+	// HardCap is the number of players that can be connected at once,
+	// including the players with a reserved slot. Reserved slots are only
+	// available if it is above MaxPlayers.
+	HardCap int
+	// Reserved are the players that can join past MaxPlayers up to HardCap
+	Reserved PlayerSet
+}
+
+// PlayerSet is a set of players by their XUID or username
+type PlayerSet struct {
+	XUIDs []string
+	// Usernames only match players that are authenticated with
+	// XBOX Live, since anyone could join with any username otherwise
+	Usernames []string
+}
+
+// contains reports if the player of pc is in the set.
+func (r PlayerSet) contains(pc ProcessedConn) bool {
+	if !pc.Authenticated() {
+		return false
+	}
+
+	for _, xuid := range r.XUIDs {
+		if xuid == pc.XUID() {
+			return true
+		}
+	}
+
+	for _, username := range r.Usernames {
+		if strings.EqualFold(username, pc.Username()) {
+			return true
+		}
+	}
+	return false
+}
+
+// admits reports if the player of pc can join while count
+// players are already connected.
+func (c Capacity) admits(pc ProcessedConn, count int) bool {
+	if c.MaxPlayers <= 0 || count < c.MaxPlayers {
+		return true
+	}
+	return count < c.HardCap && c.Reserved.contains(pc)
+}
+
+// SessionCounter counts the sessions of players that are currently active
+type SessionCounter interface {
+	// ServerSessionCount returns the number of sessions
+	// with the server with the given ID
+	ServerSessionCount(serverID string) int
+	// GatewaySessionCount returns the number of sessions
+	// through the gateway with the given ID
+	GatewaySessionCount(gatewayID string) int
+}
+
+// admissions counts the players that were admitted to join a server, but
+// whose sessions are not counted by the SessionCounter yet, because they
+// are still dialed or wait to be pooled.
+type admissions struct {
+	mu       sync.Mutex
+	servers  map[string]int
+	gateways map[string]int
+}
+
+func newAdmissions() *admissions {
+	return &admissions{
+		servers:  map[string]int{},
+		gateways: map[string]int{},
+	}
+}
+
+// admit reports if both capacities have room for the player while the
+// admitted players are counted as well, and counts the player if so.
+func (a *admissions) admit(pc ProcessedConn, srvID string, srvCapacity, gwCapacity Capacity, sessions SessionCounter) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	gwID := pc.GatewayID()
+	if !gwCapacity.admits(pc, sessions.GatewaySessionCount(gwID)+a.gateways[gwID]) {
+		return false
+	}
+	if !srvCapacity.admits(pc, sessions.ServerSessionCount(srvID)+a.servers[srvID]) {
+		return false
+	}
+	a.gateways[gwID]++
+	a.servers[srvID]++
+	return true
+}
+
+// release stops to count the player, either because its session is
+// counted by the SessionCounter or because it failed to join.
+func (a *admissions) release(gatewayID, serverID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.gateways[gatewayID]--; a.gateways[gatewayID] <= 0 {
+		delete(a.gateways, gatewayID)
+	}
+	if a.servers[serverID]--; a.servers[serverID] <= 0 {
+		delete(a.servers, serverID)
+	}
+}
@@ -57,4 +57,7 @@ func main() {
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
 	<-sc
+
+	logger.Info("shutting down proxy")
+	p.ConnPool.Shutdown()
 }
@@ -7,4 +7,5 @@ type ProxyConfig interface {
 	LoadServers() ([]Server, error)
 	LoadCPNs() ([]CPN, error)
 	LoadWebhooks() ([]webhook.Webhook, error)
+	LoadPipeline() (Pipeline, error)
 }
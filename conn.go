@@ -1,8 +1,11 @@
 package bedprox
 
 import (
+	"errors"
 	"io"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/haveachin/bedprox/webhook"
 )
@@ -13,25 +16,224 @@ type ProcessedConn interface {
 	GatewayID() string
 	// Username returns the username of the connecting player
 	Username() string
+	// XUID returns the XBOX Live user ID of the player.
+	// It is empty if the player is not authenticated.
+	XUID() string
+	// UUID returns the identity UUID of the player.
+	// It is empty if the player is not authenticated.
+	UUID() string
+	// TitleID returns the XBOX Live title ID of the game version that
+	// the player uses. It is empty if the player is not authenticated.
+	TitleID() string
+	// DeviceOS returns the numeric ID of the operating system
+	// of the player's device
+	DeviceOS() int
+	// DeviceModel returns the model of the player's device
+	DeviceModel() string
+	// GameVersion returns the game version of the player
+	GameVersion() string
+	// LanguageCode returns the language code of the player
+	LanguageCode() string
+	// InputMode returns the numeric ID of the input mode
+	// that the player currently uses
+	InputMode() int
+	// ClientRandomID returns the random ID that the client
+	// generated for itself
+	ClientRandomID() int64
 	// ServerAddr returns the exact Server Address string
 	// that the client send to the server
 	ServerAddr() string
+	// Authenticated reports if the player is authenticated
+	// with XBOX Live
+	Authenticated() bool
 	// Disconnect sends the client a disconnect message
 	// and closes the connection
 	Disconnect(msg string) error
+	// Transfer sends the client to the server at the given
+	// host and port and closes the connection
+	Transfer(host string, port uint16) error
+	// Reject sends the client the native login failure
+	// of the reason and closes the connection
+	Reject(reason RejectReason) error
 }
 
+// CloseReason is the reason why a tunnel was closed
+type CloseReason string
+
+const (
+	// CloseReasonClientQuit closes tunnels of clients that left
+	CloseReasonClientQuit CloseReason = "client_quit"
+	// CloseReasonServerClosed closes tunnels of servers that
+	// closed the connection
+	CloseReasonServerClosed CloseReason = "server_closed"
+	// CloseReasonIdleTimeout closes tunnels that had no traffic
+	// for longer than the idle timeout
+	CloseReasonIdleTimeout CloseReason = "idle_timeout"
+	// CloseReasonServerTimeout closes tunnels of servers that sent
+	// nothing for longer than the server idle timeout
+	CloseReasonServerTimeout CloseReason = "server_timeout"
+	// CloseReasonKicked closes tunnels of players that were kicked
+	// by the proxy
+	CloseReasonKicked CloseReason = "kicked"
+	// CloseReasonTrafficLimit closes tunnels that exceeded a traffic
+	// limit with TrafficLimitActionDisconnect
+	CloseReasonTrafficLimit CloseReason = "traffic_limit"
+	// CloseReasonProxyShutdown closes tunnels when the proxy shuts down
+	CloseReasonProxyShutdown CloseReason = "proxy_shutdown"
+)
+
 type ConnTunnel struct {
 	Conn       ProcessedConn
 	RemoteConn net.Conn
 	Webhooks   []webhook.Webhook
+	// IdleTimeout closes the tunnel if no packets flow in either
+	// direction for this long. Zero means no timeout.
+	IdleTimeout time.Duration
+	// ServerIdleTimeout closes the tunnel if the server sends no
+	// packets for this long. Zero means no timeout.
+	ServerIdleTimeout time.Duration
+	// TrafficLimit and ServerTrafficLimit are the traffic limits of the
+	// gateway and of the server. Both apply to the tunnel.
+	TrafficLimit       TrafficLimit
+	ServerTrafficLimit TrafficLimit
+	// SharedTrafficLimiters are the limiters that the tunnel shares
+	// with other tunnels, like those of its gateway and of its server
+	SharedTrafficLimiters []*TrafficLimiter
+
+	// ServerID is the ID of the server that the tunnel leads to
+	ServerID string
+
+	// onPooled is called once the pool counts the session of the tunnel
+	onPooled func()
+
+	// state is shared by all copies of the tunnel, so that any of them
+	// can close it with a reason and read its traffic
+	state *tunnelState
+}
+
+// tunnelState is the state that all copies of a tunnel share
+type tunnelState struct {
+	// traffic is first to be 64-bit aligned for atomic access
+	traffic tunnelTraffic
+
+	once   sync.Once
+	reason CloseReason
+	// closed is closed once the tunnel was closed with a reason
+	closed chan struct{}
 }
 
-func (t ConnTunnel) Start() {
-	defer t.Close()
+// withState returns the tunnel with a state, so that copies
+// of it share their close reason and traffic.
+func (t ConnTunnel) withState() ConnTunnel {
+	if t.state == nil {
+		t.state = &tunnelState{closed: make(chan struct{})}
+	}
+	return t
+}
+
+// Traffic returns the traffic that the tunnel relayed so far
+func (t ConnTunnel) Traffic() TrafficStats {
+	if t.state == nil {
+		return TrafficStats{}
+	}
+	return t.state.traffic.stats()
+}
+
+// Start relays the traffic of the tunnel in both directions. Once either
+// direction ends, the tunnel is closed and both directions are awaited.
+// Start returns the reason why the tunnel was closed.
+func (t ConnTunnel) Start() CloseReason {
+	t = t.withState()
+	traffic := &t.state.traffic
+	traffic.touch()
+
+	limiters := append([]*TrafficLimiter{
+		NewTrafficLimiter(t.TrafficLimit),
+		NewTrafficLimiter(t.ServerTrafficLimit),
+	}, t.SharedTrafficLimiters...)
+	clientReader := newLimitReader(traffic.clientReader(t.Conn), t.state.closed, clientToServer, limiters...)
+	serverReader := newLimitReader(traffic.serverReader(t.RemoteConn), t.state.closed, serverToClient, limiters...)
+
+	reasons := make(chan CloseReason, 2)
+	go func() {
+		_, err := io.Copy(t.RemoteConn, clientReader)
+		reasons <- copyCloseReason(err, CloseReasonClientQuit)
+	}()
+	go func() {
+		_, err := io.Copy(t.Conn, serverReader)
+		reasons <- copyCloseReason(err, CloseReasonServerClosed)
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	go t.watch(done)
+
+	// The reason is only set by the first one to close the tunnel
+	t.CloseWithReason(<-reasons)
+	<-reasons
+	return t.state.reason
+}
+
+// copyCloseReason returns the reason for the error that ended a direction
+// of a tunnel, which is the given reason unless a traffic limit ended it.
+func copyCloseReason(err error, reason CloseReason) CloseReason {
+	if errors.Is(err, errTrafficLimitExceeded) {
+		return CloseReasonTrafficLimit
+	}
+	return reason
+}
+
+// watch closes the tunnel once it was idle for longer than
+// one of its idle timeouts, or returns once done is closed.
+func (t ConnTunnel) watch(done <-chan struct{}) {
+	interval := t.IdleTimeout
+	if interval <= 0 || t.ServerIdleTimeout > 0 && t.ServerIdleTimeout < interval {
+		interval = t.ServerIdleTimeout
+	}
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			clientReadAt, serverReadAt := t.state.traffic.readAt()
+			lastReadAt := clientReadAt
+			if serverReadAt.After(lastReadAt) {
+				lastReadAt = serverReadAt
+			}
+
+			if t.IdleTimeout > 0 && now.Sub(lastReadAt) > t.IdleTimeout {
+				t.CloseWithReason(CloseReasonIdleTimeout)
+				return
+			}
+			if t.ServerIdleTimeout > 0 && now.Sub(serverReadAt) > t.ServerIdleTimeout {
+				t.CloseWithReason(CloseReasonServerTimeout)
+				return
+			}
+		}
+	}
+}
+
+// CloseWithReason closes the tunnel for the reason. Only the first reason
+// that a tunnel is closed for is kept. Copies of a tunnel share the reason
+// once the tunnel was added to a ConnPool.
+func (t ConnTunnel) CloseWithReason(reason CloseReason) {
+	if t.state == nil {
+		t.Close()
+		return
+	}
 
-	go io.Copy(t.Conn, t.RemoteConn)
-	io.Copy(t.RemoteConn, t.Conn)
+	t.state.once.Do(func() {
+		t.state.reason = reason
+		close(t.state.closed)
+		t.Close()
+	})
 }
 
 func (t ConnTunnel) Close() {
@@ -0,0 +1,301 @@
+package bedprox_test
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/haveachin/bedprox"
+)
+
+// mockProcessedConn is a processed connection of a player named Steve
+// that reads from and writes to the connection c.
+type mockProcessedConn struct {
+	bedprox.ProcessedConn
+	c net.Conn
+}
+
+func (pc mockProcessedConn) Read(b []byte) (int, error) {
+	return pc.c.Read(b)
+}
+
+func (pc mockProcessedConn) Write(b []byte) (int, error) {
+	return pc.c.Write(b)
+}
+
+func (pc mockProcessedConn) Close() error {
+	return pc.c.Close()
+}
+
+func (pc mockProcessedConn) RemoteAddr() net.Addr {
+	return pc.c.RemoteAddr()
+}
+
+func (pc mockProcessedConn) Username() string {
+	return "Steve"
+}
+
+func (pc mockProcessedConn) XUID() string {
+	return "2535412345678901"
+}
+
+func (pc mockProcessedConn) GatewayID() string {
+	return "gw"
+}
+
+// newTunnel returns a tunnel together with the client end of its
+// connection and the server end of its remote connection.
+func newTunnel() (bedprox.ConnTunnel, net.Conn, net.Conn) {
+	client, clientProxy := net.Pipe()
+	serverProxy, server := net.Pipe()
+	ct := bedprox.ConnTunnel{
+		Conn:       mockProcessedConn{c: clientProxy},
+		RemoteConn: serverProxy,
+	}
+	return ct, client, server
+}
+
+func TestConnTunnel_Start(t *testing.T) {
+	tt := []struct {
+		name   string
+		close  func(client, server net.Conn)
+		reason bedprox.CloseReason
+	}{
+		{
+			name: "client quit",
+			close: func(client, server net.Conn) {
+				client.Close()
+			},
+			reason: bedprox.CloseReasonClientQuit,
+		},
+		{
+			name: "server closed",
+			close: func(client, server net.Conn) {
+				server.Close()
+			},
+			reason: bedprox.CloseReasonServerClosed,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ct, client, server := newTunnel()
+			defer client.Close()
+			defer server.Close()
+
+			reasons := make(chan bedprox.CloseReason, 1)
+			go func() { reasons <- ct.Start() }()
+
+			// The tunnel relays in both directions until it is closed
+			msg := []byte("hello")
+			go client.Write(msg)
+			b := make([]byte, len(msg))
+			if _, err := server.Read(b); err != nil {
+				t.Fatal(err)
+			}
+
+			tc.close(client, server)
+
+			select {
+			case reason := <-reasons:
+				if reason != tc.reason {
+					t.Errorf("expected reason %q; got %q", tc.reason, reason)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("tunnel was not closed")
+			}
+		})
+	}
+}
+
+func TestConnTunnel_Start_IdleTimeout(t *testing.T) {
+	tt := []struct {
+		name              string
+		idleTimeout       time.Duration
+		serverIdleTimeout time.Duration
+		// clientActive keeps the client sending packets
+		clientActive bool
+		reason       bedprox.CloseReason
+	}{
+		{
+			name:        "idle tunnel",
+			idleTimeout: 50 * time.Millisecond,
+			reason:      bedprox.CloseReasonIdleTimeout,
+		},
+		{
+			name:              "idle server",
+			idleTimeout:       time.Minute,
+			serverIdleTimeout: 100 * time.Millisecond,
+			clientActive:      true,
+			reason:            bedprox.CloseReasonServerTimeout,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ct, client, server := newTunnel()
+			defer client.Close()
+			defer server.Close()
+			ct.IdleTimeout = tc.idleTimeout
+			ct.ServerIdleTimeout = tc.serverIdleTimeout
+
+			// The server drains everything that the client sends
+			go func() {
+				b := make([]byte, 16)
+				for {
+					if _, err := server.Read(b); err != nil {
+						return
+					}
+				}
+			}()
+
+			if tc.clientActive {
+				go func() {
+					for {
+						if _, err := client.Write([]byte("move")); err != nil {
+							return
+						}
+						time.Sleep(10 * time.Millisecond)
+					}
+				}()
+			}
+
+			reasons := make(chan bedprox.CloseReason, 1)
+			go func() { reasons <- ct.Start() }()
+
+			select {
+			case reason := <-reasons:
+				if reason != tc.reason {
+					t.Errorf("expected reason %q; got %q", tc.reason, reason)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("tunnel was not closed")
+			}
+		})
+	}
+}
+
+func TestConnTunnel_Start_TrafficLimit(t *testing.T) {
+	tt := []struct {
+		name        string
+		limit       bedprox.TrafficLimit
+		serverLimit bedprox.TrafficLimit
+		// shared is the limiter that both tunnels share
+		shared bedprox.TrafficLimit
+		// minDuration is how long relaying the packets takes at least
+		minDuration time.Duration
+		// received is the number of packets that reach the servers
+		received int
+		reason   bedprox.CloseReason
+	}{
+		{
+			name: "throttle bytes",
+			limit: bedprox.TrafficLimit{
+				ClientToServer: bedprox.TrafficRate{BytesPerSecond: 100},
+			},
+			minDuration: 150 * time.Millisecond,
+			received:    24,
+			reason:      bedprox.CloseReasonClientQuit,
+		},
+		{
+			name: "throttle server packets",
+			serverLimit: bedprox.TrafficLimit{
+				ClientToServer: bedprox.TrafficRate{PacketsPerSecond: 10},
+			},
+			minDuration: 150 * time.Millisecond,
+			received:    24,
+			reason:      bedprox.CloseReasonClientQuit,
+		},
+		{
+			// Each tunnel alone stays within the limit
+			name: "shared",
+			shared: bedprox.TrafficLimit{
+				ClientToServer: bedprox.TrafficRate{BytesPerSecond: 200},
+			},
+			minDuration: 150 * time.Millisecond,
+			received:    24,
+			reason:      bedprox.CloseReasonClientQuit,
+		},
+		{
+			name: "other direction",
+			limit: bedprox.TrafficLimit{
+				ServerToClient: bedprox.TrafficRate{BytesPerSecond: 1},
+			},
+			received: 24,
+			reason:   bedprox.CloseReasonClientQuit,
+		},
+		{
+			name: "disconnect",
+			limit: bedprox.TrafficLimit{
+				ClientToServer: bedprox.TrafficRate{BytesPerSecond: 100},
+				Action:         bedprox.TrafficLimitActionDisconnect,
+			},
+			received: 20,
+			reason:   bedprox.CloseReasonTrafficLimit,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			shared := bedprox.NewTrafficLimiter(tc.shared)
+			reasons := make(chan bedprox.CloseReason, 2)
+			var received int32
+			var wg sync.WaitGroup
+
+			// Both tunnels relay 12 packets of 10 bytes one after
+			// the other
+			start := time.Now()
+			for n := 0; n < 2; n++ {
+				ct, client, server := newTunnel()
+				defer client.Close()
+				defer server.Close()
+				ct.TrafficLimit = tc.limit
+				ct.ServerTrafficLimit = tc.serverLimit
+				ct.SharedTrafficLimiters = []*bedprox.TrafficLimiter{shared}
+				go func() { reasons <- ct.Start() }()
+
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					b := make([]byte, 16)
+					for {
+						if _, err := server.Read(b); err != nil {
+							return
+						}
+						atomic.AddInt32(&received, 1)
+					}
+				}()
+
+				for n := 0; n < 12; n++ {
+					if _, err := client.Write([]byte("0123456789")); err != nil {
+						break
+					}
+				}
+				if tc.reason == bedprox.CloseReasonClientQuit {
+					client.Close()
+				}
+			}
+
+			for n := 0; n < 2; n++ {
+				select {
+				case reason := <-reasons:
+					if reason != tc.reason {
+						t.Errorf("expected reason %q; got %q", tc.reason, reason)
+					}
+				case <-time.After(time.Second):
+					t.Fatal("tunnel was not closed")
+				}
+			}
+			wg.Wait()
+
+			if d := time.Since(start); d < tc.minDuration {
+				t.Errorf("expected relaying to take at least %v; took %v", tc.minDuration, d)
+			}
+			if received != int32(tc.received) {
+				t.Errorf("expected %d packets to be relayed; got %d", tc.received, received)
+			}
+		})
+	}
+}
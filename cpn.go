@@ -2,6 +2,7 @@ package bedprox
 
 import (
 	"net"
+	"time"
 
 	"github.com/go-logr/logr"
 )
@@ -10,6 +11,11 @@ import (
 type CPN struct {
 	ConnProcessor
 	Log logr.Logger
+
+	// srvQueue rejects processed connections while the server queue is
+	// overloaded. Without it, sends to the server queue block.
+	srvQueue    *queueMeter
+	busyMessage string
 }
 
 type ConnProcessor interface {
@@ -34,6 +40,24 @@ func (cpn *CPN) Start(cpnChan <-chan net.Conn, srvChan chan<- ProcessedConn) {
 			c.Close()
 			continue
 		}
-		srvChan <- pc
+		if cpn.srvQueue == nil {
+			srvChan <- pc
+			continue
+		}
+
+		sent := cpn.srvQueue.send(time.Now(), func() bool {
+			select {
+			case srvChan <- pc:
+				return true
+			default:
+				return false
+			}
+		})
+		if !sent {
+			cpn.Log.Info("disconnecting client; proxy busy",
+				"remoteAddress", c.RemoteAddr(),
+			)
+			_ = pc.Disconnect(cpn.busyMessage)
+		}
 	}
 }
@@ -0,0 +1,138 @@
+package bedprox
+
+import (
+	"errors"
+	"sync"
+)
+
+// serverDialer connects the players that join a server to it without
+// blocking the routing of the players of other servers. It dials the
+// server for up to limit players at once, but hands their tunnels to
+// the pool in the order that they joined.
+type serverDialer struct {
+	sg       ServerGateway
+	srv      Server
+	queue    *joinQueue
+	poolChan chan<- ConnTunnel
+
+	mu      sync.Mutex
+	pending []ProcessedConn
+	// signal is sent to if a player joins
+	signal chan struct{}
+	// inflight are the dials in join order. It holds one dial less than
+	// the limit, since the oldest dial is held by handOff.
+	inflight chan *dialJob
+}
+
+// dialJob is a dial of the server for a player
+type dialJob struct {
+	pc   ProcessedConn
+	ct   ConnTunnel
+	err  error
+	done chan struct{}
+}
+
+func newServerDialer(sg ServerGateway, srv Server, q *joinQueue, poolChan chan<- ConnTunnel) *serverDialer {
+	limit := srv.GetDialConcurrency()
+	if limit < 1 {
+		limit = 1
+	}
+
+	return &serverDialer{
+		sg:       sg,
+		srv:      srv,
+		queue:    q,
+		poolChan: poolChan,
+		signal:   make(chan struct{}, 1),
+		inflight: make(chan *dialJob, limit-1),
+	}
+}
+
+// dial connects the player to the server without blocking.
+func (d *serverDialer) dial(pc ProcessedConn) {
+	d.mu.Lock()
+	d.pending = append(d.pending, pc)
+	d.mu.Unlock()
+
+	select {
+	case d.signal <- struct{}{}:
+	default:
+	}
+}
+
+// next removes the player that joined first from the pending players.
+func (d *serverDialer) next() (ProcessedConn, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.pending) == 0 {
+		return nil, false
+	}
+	pc := d.pending[0]
+	d.pending[0] = nil
+	d.pending = d.pending[1:]
+	return pc, true
+}
+
+// run dials the server for the pending players in join order until done
+// is closed and no players are pending. It returns once every tunnel was
+// handed off.
+func (d *serverDialer) run(done <-chan struct{}) {
+	handedOff := make(chan struct{})
+	go func() {
+		d.handOff()
+		close(handedOff)
+	}()
+
+	for {
+		pc, ok := d.next()
+		if !ok {
+			select {
+			case <-d.signal:
+				continue
+			case <-done:
+			}
+
+			// Players might have joined right before done was closed
+			if pc, ok = d.next(); !ok {
+				break
+			}
+		}
+
+		job := &dialJob{
+			pc:   pc,
+			done: make(chan struct{}),
+		}
+		// Blocks while the limit of dials is reached
+		d.inflight <- job
+		go func() {
+			job.ct, job.err = d.sg.dialServer(job.pc, d.srv)
+			close(job.done)
+		}()
+	}
+
+	close(d.inflight)
+	<-handedOff
+}
+
+// handOff sends the tunnels of the dials to the pool in join order. Players
+// that could not reach the server wait in its queue if it has one.
+func (d *serverDialer) handOff() {
+	for job := range d.inflight {
+		<-job.done
+
+		if job.err == nil {
+			d.sg.handOff(job.pc, job.ct, d.srv, d.poolChan)
+			continue
+		}
+
+		if !errors.Is(job.err, ErrServerUnavailable) {
+			continue
+		}
+		if d.queue == nil {
+			_ = job.pc.Close()
+			continue
+		}
+		d.sg.enqueue(d.queue, job.pc)
+	}
+}
@@ -1,7 +1,9 @@
 package bedprox
 
 import (
+	"fmt"
 	"net"
+	"time"
 
 	"github.com/go-logr/logr"
 )
@@ -13,6 +15,122 @@ type Gateway interface {
 	// that are registered in that gateway
 	GetServerIDs() []string
 	GetServerNotFoundMessage() string
+	// GetServerNotFoundTransfer returns the target that clients are
+	// transferred to if no server matches their address, if ok is true
+	GetServerNotFoundTransfer() (target TransferTarget, ok bool)
+	GetUnauthenticatedPolicy() UnauthenticatedPolicy
+	// GetIdleTimeout returns the time after which tunnels without
+	// traffic in either direction are closed
+	GetIdleTimeout() time.Duration
+	// GetTrafficLimit returns the traffic limit of the tunnels
+	// of the players of the gateway
+	GetTrafficLimit() TrafficLimit
+	// GetSharedTrafficLimit returns the traffic limit of all tunnels
+	// of the gateway together
+	GetSharedTrafficLimit() TrafficLimit
+	// GetCapacity returns the number of players that
+	// the gateway has room for
+	GetCapacity() Capacity
+	// GetRejectionPolicies returns how rejected players are told
+	// the reason that they were rejected for
+	GetRejectionPolicies() map[RejectReason]RejectionPolicy
 	SetLogger(log logr.Logger)
+	// SetPlayerLister sets the source that the gateway uses
+	// to look up the players that are currently connected
+	SetPlayerLister(pl PlayerLister)
 	ListenAndServe(cpnChan chan<- net.Conn) error
 }
+
+// PlayerLister lists the players that are currently connected
+type PlayerLister interface {
+	// Usernames returns the usernames of all players that are
+	// connected through the gateway with the given ID
+	Usernames(gatewayID string) []string
+}
+
+const (
+	// UnauthenticatedActionAccept lets unauthenticated players join
+	// like any other player
+	UnauthenticatedActionAccept = "accept"
+	// UnauthenticatedActionReject disconnects unauthenticated players
+	UnauthenticatedActionReject = "reject"
+	// UnauthenticatedActionRoute sends unauthenticated players to
+	// one specific server regardless of the address they joined with
+	UnauthenticatedActionRoute = "route"
+)
+
+// UnauthenticatedPolicy defines how a gateway handles players that
+// are not authenticated with XBOX Live
+type UnauthenticatedPolicy struct {
+	// Action is one of the UnauthenticatedAction constants.
+	// An empty action is treated like UnauthenticatedActionAccept.
+	Action string
+	// ServerID is the ID of the server that players are routed to
+	// if the action is UnauthenticatedActionRoute
+	ServerID string
+	// Message is the message that players are disconnected with
+	// if the action is UnauthenticatedActionReject
+	Message string
+}
+
+// RejectReason is the reason why the proxy rejects a client
+type RejectReason string
+
+const (
+	// RejectReasonOutdatedClient rejects clients with a protocol
+	// version that is older than the server supports
+	RejectReasonOutdatedClient RejectReason = "outdated_client"
+	// RejectReasonOutdatedServer rejects clients with a protocol
+	// version that is newer than the server supports
+	RejectReasonOutdatedServer RejectReason = "outdated_server"
+	// RejectReasonServerFull rejects clients if the server has
+	// no free slots left
+	RejectReasonServerFull RejectReason = "server_full"
+	// RejectReasonInvalidTenant rejects clients that belong to a
+	// tenant that is not allowed to join the server
+	RejectReasonInvalidTenant RejectReason = "invalid_tenant"
+	// RejectReasonEditionMismatch rejects clients of an edition
+	// that the server does not run
+	RejectReasonEditionMismatch RejectReason = "edition_mismatch"
+)
+
+// RejectReasons are all reasons that the proxy can reject clients for
+var RejectReasons = []RejectReason{
+	RejectReasonOutdatedClient,
+	RejectReasonOutdatedServer,
+	RejectReasonServerFull,
+	RejectReasonInvalidTenant,
+	RejectReasonEditionMismatch,
+}
+
+const (
+	// RejectionActionPlayStatus shows rejected players the native
+	// and localized error screen of the game for the reason
+	RejectionActionPlayStatus = "play_status"
+	// RejectionActionDisconnect disconnects rejected players
+	// with a custom message
+	RejectionActionDisconnect = "disconnect"
+)
+
+// RejectionPolicy defines how a gateway tells players that they
+// were rejected for a reason
+type RejectionPolicy struct {
+	// Action is one of the RejectionAction constants.
+	// An empty action is treated like RejectionActionPlayStatus.
+	Action string
+	// Message is the message that players are disconnected with
+	// if the action is RejectionActionDisconnect. It must be empty
+	// for RejectionActionPlayStatus, since play statuses have none.
+	Message string
+}
+
+// RejectError is returned by servers that reject a client for
+// a reason without telling the client about it. The gateway
+// rejects the client according to its RejectionPolicy instead.
+type RejectError struct {
+	Reason RejectReason
+}
+
+func (err RejectError) Error() string {
+	return fmt.Sprintf("client rejected: %s", err.Reason)
+}
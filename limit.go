@@ -0,0 +1,237 @@
+package bedprox
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// TrafficLimitAction is what happens to tunnels that exceed a traffic limit
+type TrafficLimitAction string
+
+const (
+	// TrafficLimitActionThrottle delays the traffic of tunnels until
+	// it is within the limit again
+	TrafficLimitActionThrottle TrafficLimitAction = "throttle"
+	// TrafficLimitActionDisconnect throttles tunnels like
+	// TrafficLimitActionThrottle, but closes them once they exceeded
+	// the limit for longer than the DisconnectAfter of the limit
+	TrafficLimitActionDisconnect TrafficLimitAction = "disconnect"
+)
+
+var errTrafficLimitExceeded = errors.New("traffic limit exceeded")
+
+// TrafficRate is a rate of traffic in one direction.
+// Zero means no limit.
+type TrafficRate struct {
+	BytesPerSecond   uint64
+	PacketsPerSecond uint64
+}
+
+// TrafficLimit limits the traffic in both directions with token buckets
+// that hold the traffic of one second at most. Every tunnel has its own
+// buckets, unless the limit is shared with a TrafficLimiter.
+type TrafficLimit struct {
+	ClientToServer TrafficRate
+	ServerToClient TrafficRate
+	// Action is what happens to tunnels that exceed the limit.
+	// An empty action is treated like TrafficLimitActionThrottle.
+	Action TrafficLimitAction
+	// DisconnectAfter is how long a tunnel has to exceed the limit
+	// without a break before TrafficLimitActionDisconnect closes it
+	DisconnectAfter time.Duration
+}
+
+// tokenBucket holds tokens that refill with the rate per second up to
+// the burst. Takes can overdraw the bucket, so that a packet larger than
+// the burst still passes once the debt was paid off.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate uint64, now time.Time) tokenBucket {
+	return tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(rate),
+		tokens: float64(rate),
+		last:   now,
+	}
+}
+
+// take takes n tokens and returns how long to wait until the
+// bucket is no longer in debt.
+func (b *tokenBucket) take(n float64, now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// rateLimiter limits one direction of the traffic of one or more tunnels.
+type rateLimiter struct {
+	mu      sync.Mutex
+	bytes   tokenBucket
+	packets tokenBucket
+}
+
+// newRateLimiter returns nil if the rate has no limit.
+func newRateLimiter(rate TrafficRate, now time.Time) *rateLimiter {
+	if rate.BytesPerSecond == 0 && rate.PacketsPerSecond == 0 {
+		return nil
+	}
+
+	return &rateLimiter{
+		bytes:   newTokenBucket(rate.BytesPerSecond, now),
+		packets: newTokenBucket(rate.PacketsPerSecond, now),
+	}
+}
+
+// take takes a packet of n bytes and returns how long to throttle it.
+// Tunnels that share the limiter queue up behind each other's debt.
+func (l *rateLimiter) take(n int, now time.Time) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delay := l.bytes.take(float64(n), now)
+	if d := l.packets.take(1, now); d > delay {
+		delay = d
+	}
+	return delay
+}
+
+// TrafficLimiter holds the token buckets of a traffic limit. Tunnels
+// that share a limiter share its buckets, so that the limit applies to
+// their traffic together.
+type TrafficLimiter struct {
+	limit          TrafficLimit
+	clientToServer *rateLimiter
+	serverToClient *rateLimiter
+}
+
+// NewTrafficLimiter returns a limiter with full buckets.
+func NewTrafficLimiter(limit TrafficLimit) *TrafficLimiter {
+	now := time.Now()
+	return &TrafficLimiter{
+		limit:          limit,
+		clientToServer: newRateLimiter(limit.ClientToServer, now),
+		serverToClient: newRateLimiter(limit.ServerToClient, now),
+	}
+}
+
+// readerLimit is a limiter of a limitReader. Only the goroutine that
+// reads the direction of the tunnel uses it, so it needs no lock.
+type readerLimit struct {
+	limiter         *rateLimiter
+	action          TrafficLimitAction
+	disconnectAfter time.Duration
+	// exceededSince is when the traffic of the tunnel started to exceed
+	// the limit. It is zero while the traffic is within the limit.
+	exceededSince time.Time
+}
+
+// limitReader throttles the packets that it reads until they are within
+// the limits of all of its limiters. Every direction of a tunnel is read
+// by its own goroutine, so throttling one direction delays no other
+// traffic of the proxy. It stops waiting once closed is closed.
+type limitReader struct {
+	r      io.Reader
+	limits []readerLimit
+	closed <-chan struct{}
+}
+
+// newLimitReader returns r itself if none of the limiters limit the
+// direction that limiter returns.
+func newLimitReader(r io.Reader, closed <-chan struct{}, limiter func(*TrafficLimiter) *rateLimiter, limiters ...*TrafficLimiter) io.Reader {
+	var limits []readerLimit
+	for _, tl := range limiters {
+		if l := limiter(tl); l != nil {
+			limits = append(limits, readerLimit{
+				limiter:         l,
+				action:          tl.limit.Action,
+				disconnectAfter: tl.limit.DisconnectAfter,
+			})
+		}
+	}
+
+	if len(limits) == 0 {
+		return r
+	}
+
+	return limitReader{
+		r:      r,
+		limits: limits,
+		closed: closed,
+	}
+}
+
+func (r limitReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n <= 0 {
+		return n, err
+	}
+
+	delay, limitErr := r.take(n, time.Now())
+	if limitErr != nil {
+		return 0, limitErr
+	}
+
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.closed:
+			return 0, io.ErrClosedPipe
+		}
+	}
+	return n, err
+}
+
+// take takes a packet of n bytes from all limits and returns how long to
+// throttle it. It returns errTrafficLimitExceeded if the tunnel has to
+// be closed.
+func (r limitReader) take(n int, now time.Time) (time.Duration, error) {
+	var delay time.Duration
+	for i := range r.limits {
+		l := &r.limits[i]
+		d := l.limiter.take(n, now)
+		if d == 0 {
+			l.exceededSince = time.Time{}
+			continue
+		}
+
+		if l.exceededSince.IsZero() {
+			l.exceededSince = now
+		}
+		if l.action == TrafficLimitActionDisconnect && now.Sub(l.exceededSince) >= l.disconnectAfter {
+			return 0, errTrafficLimitExceeded
+		}
+		if d > delay {
+			delay = d
+		}
+	}
+	return delay, nil
+}
+
+func clientToServer(l *TrafficLimiter) *rateLimiter {
+	return l.clientToServer
+}
+
+func serverToClient(l *TrafficLimiter) *rateLimiter {
+	return l.serverToClient
+}
@@ -0,0 +1,198 @@
+package bedprox
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// defaultQueueSize is the size of the queues of pipelines without one
+const defaultQueueSize = 10
+
+// Pipeline configures the queues between the stages of the proxy. New
+// connections wait in the CPN queue to be processed, processed connections
+// wait in the server queue to be routed and tunnels wait in the pool queue
+// to be started. Queues of size zero have the default size.
+type Pipeline struct {
+	CPNQueueSize    int
+	ServerQueueSize int
+	PoolQueueSize   int
+	// Overload decides when the CPN and server queue are overloaded
+	Overload OverloadPolicy
+}
+
+// OverloadPolicy defines when a queue of the proxy is overloaded. Connections
+// that arrive at an overloaded queue are rejected right away instead of
+// waiting behind all the others.
+type OverloadPolicy struct {
+	// MaxQueueDepth is the number of connections in a queue at which it is
+	// overloaded. Zero means that only a full queue is overloaded.
+	MaxQueueDepth int
+	// MaxQueueAge is the time that the oldest connection in a queue can
+	// wait before the queue is overloaded. Zero means no limit.
+	MaxQueueAge time.Duration
+	// BusyMessage is the message that processed players are disconnected
+	// with while the server queue is overloaded. New connections that are
+	// rejected by the CPN queue are closed without a message, since the
+	// client can not be sent one before its login was processed.
+	BusyMessage string
+}
+
+// QueueStats are the metrics of a queue of the proxy
+type QueueStats struct {
+	Depth    int
+	Capacity int
+	// Age is the time that the oldest connection in the queue waited
+	Age time.Duration
+	// Rejected is the number of connections that the queue rejected
+	// because it was overloaded
+	Rejected uint64
+}
+
+// PipelineStats are the metrics of the queues of the proxy
+type PipelineStats struct {
+	CPN    QueueStats
+	Server QueueStats
+	Pool   QueueStats
+}
+
+// queueMeter measures the depth and the age of a channel and rejects
+// connections once it is overloaded. It has to be the only one that sends
+// to the channel, since it keeps the time of every send in the same order.
+type queueMeter struct {
+	policy OverloadPolicy
+	// depth and capacity return the length and capacity of the channel
+	depth    func() int
+	capacity int
+
+	mu sync.Mutex
+	// sentAt are the times that the connections in the channel were sent at
+	sentAt   []time.Time
+	rejected uint64
+}
+
+// send calls trySend unless the queue is overloaded and reports if the
+// connection was sent. trySend must not block and report if it sent.
+func (m *queueMeter) send(now time.Time, trySend func() bool) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.overloaded(m.trim(), now) || !trySend() {
+		m.rejected++
+		return false
+	}
+	m.sentAt = append(m.sentAt, now)
+	return true
+}
+
+// trim forgets the times of the connections that were already received
+// and returns the depth of the channel.
+func (m *queueMeter) trim() int {
+	depth := m.depth()
+	if received := len(m.sentAt) - depth; received > 0 {
+		m.sentAt = m.sentAt[received:]
+	}
+	return depth
+}
+
+func (m *queueMeter) overloaded(depth int, now time.Time) bool {
+	maxDepth := m.policy.MaxQueueDepth
+	if maxDepth <= 0 || maxDepth > m.capacity {
+		maxDepth = m.capacity
+	}
+	if depth >= maxDepth {
+		return true
+	}
+	return m.policy.MaxQueueAge > 0 && len(m.sentAt) > 0 &&
+		now.Sub(m.sentAt[0]) > m.policy.MaxQueueAge
+}
+
+func (m *queueMeter) stats(now time.Time) QueueStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stats := QueueStats{
+		Depth:    m.trim(),
+		Capacity: m.capacity,
+		Rejected: m.rejected,
+	}
+	if len(m.sentAt) > 0 {
+		stats.Age = now.Sub(m.sentAt[0])
+	}
+	return stats
+}
+
+// pipeline are the queues between the stages of the proxy
+type pipeline struct {
+	cpnChan  chan net.Conn
+	srvChan  chan ProcessedConn
+	poolChan chan ConnTunnel
+
+	cpnQueue    *queueMeter
+	srvQueue    *queueMeter
+	busyMessage string
+}
+
+func newPipeline(cfg Pipeline) *pipeline {
+	queueSize := func(size int) int {
+		if size <= 0 {
+			return defaultQueueSize
+		}
+		return size
+	}
+
+	pl := &pipeline{
+		cpnChan:     make(chan net.Conn, queueSize(cfg.CPNQueueSize)),
+		srvChan:     make(chan ProcessedConn, queueSize(cfg.ServerQueueSize)),
+		poolChan:    make(chan ConnTunnel, queueSize(cfg.PoolQueueSize)),
+		busyMessage: cfg.Overload.BusyMessage,
+	}
+	pl.cpnQueue = &queueMeter{
+		policy:   cfg.Overload,
+		depth:    func() int { return len(pl.cpnChan) },
+		capacity: cap(pl.cpnChan),
+	}
+	pl.srvQueue = &queueMeter{
+		policy:   cfg.Overload,
+		depth:    func() int { return len(pl.srvChan) },
+		capacity: cap(pl.srvChan),
+	}
+	return pl
+}
+
+// admit sends the new connections of the gateways to the CPN queue and
+// closes them while it is overloaded.
+func (pl *pipeline) admit(acceptChan <-chan net.Conn, log logr.Logger) {
+	for c := range acceptChan {
+		sent := pl.cpnQueue.send(time.Now(), func() bool {
+			select {
+			case pl.cpnChan <- c:
+				return true
+			default:
+				return false
+			}
+		})
+		if sent {
+			continue
+		}
+
+		log.V(1).Info("rejected connection; proxy busy",
+			"remoteAddress", c.RemoteAddr(),
+		)
+		c.Close()
+	}
+}
+
+func (pl *pipeline) stats() PipelineStats {
+	now := time.Now()
+	return PipelineStats{
+		CPN:    pl.cpnQueue.stats(now),
+		Server: pl.srvQueue.stats(now),
+		Pool: QueueStats{
+			Depth:    len(pl.poolChan),
+			Capacity: cap(pl.poolChan),
+		},
+	}
+}
@@ -1,11 +1,80 @@
 package bedprox
 
 import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
 	"github.com/go-logr/logr"
+	"github.com/haveachin/bedprox/webhook"
+)
+
+var (
+	// ErrSessionNotFound is returned by ConnPool.SwitchServer if the
+	// session is not active
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrSwitchNotSupported is returned by ConnPool.SwitchServer if the
+	// tunnel of the session can not switch servers
+	ErrSwitchNotSupported = errors.New("session can not switch servers")
 )
 
+// ServerSwitcher is implemented by the remote connections of tunnels
+// that can move the player to another server without disconnecting
+// the client, like sessions whose encryption the proxy terminates.
+type ServerSwitcher interface {
+	// SwitchServer moves the player to the server with the given ID
+	SwitchServer(serverID string) error
+}
+
+// Session is a snapshot of the session of a player with an active tunnel
+type Session struct {
+	// ID is the ID that the ConnPool gave the session
+	ID         uint64
+	Username   string
+	XUID       string
+	GatewayID  string
+	ServerID   string
+	RemoteAddr net.Addr
+	StartedAt  time.Time
+	// Traffic is the traffic of the session at the time of the snapshot
+	Traffic TrafficStats
+}
+
+// poolSession is a tunnel in the registry of a ConnPool
+type poolSession struct {
+	tunnel    ConnTunnel
+	startedAt time.Time
+}
+
+func (s poolSession) snapshot(id uint64) Session {
+	return Session{
+		ID:         id,
+		Username:   s.tunnel.Conn.Username(),
+		XUID:       s.tunnel.Conn.XUID(),
+		GatewayID:  s.tunnel.Conn.GatewayID(),
+		ServerID:   s.tunnel.ServerID,
+		RemoteAddr: s.tunnel.Conn.RemoteAddr(),
+		StartedAt:  s.startedAt,
+		Traffic:    s.tunnel.Traffic(),
+	}
+}
+
 type ConnPool struct {
 	Log logr.Logger
+
+	mu     sync.RWMutex
+	nextID uint64
+	// sessions maps the session ID to the session of an active tunnel
+	sessions map[uint64]poolSession
+	wg       sync.WaitGroup
+
+	// serverTraffic and gatewayTraffic hold the traffic of closed
+	// tunnels by the ID of their server and gateway
+	serverTraffic  map[string]TrafficStats
+	gatewayTraffic map[string]TrafficStats
 }
 
 func (cp *ConnPool) Start(poolChan <-chan ConnTunnel) {
@@ -15,11 +84,302 @@ func (cp *ConnPool) Start(poolChan <-chan ConnTunnel) {
 			break
 		}
 
+		ct = ct.withState()
+		startedAt := time.Now()
+		id := cp.add(ct, startedAt)
+		if ct.onPooled != nil {
+			ct.onPooled()
+		}
+
 		cp.Log.Info("starting tunnel",
+			"sessionId", id,
 			"client", ct.Conn.RemoteAddr(),
 			"server", ct.RemoteConn.RemoteAddr(),
 		)
+		go cp.run(id, ct, startedAt)
+	}
+}
+
+// run starts the tunnel and reports when and why it was closed. Its events
+// are dispatched in order, but without delaying the traffic of the tunnel.
+func (cp *ConnPool) run(id uint64, ct ConnTunnel, startedAt time.Time) {
+	events := make(chan webhook.Event, 2)
+	defer close(events)
+	go func() {
+		defer cp.wg.Done()
+		for event := range events {
+			dispatchEvent(cp.Log, ct.Webhooks, event)
+		}
+	}()
+
+	events <- webhook.EventPlayerJoin{
+		Username:      ct.Conn.Username(),
+		XUID:          ct.Conn.XUID(),
+		RemoteAddress: ct.Conn.RemoteAddr().String(),
+		TargetAddress: ct.RemoteConn.RemoteAddr().String(),
+	}
+
+	reason := ct.Start()
+	cp.remove(id)
+	duration := time.Since(startedAt)
+	traffic := ct.Traffic()
+
+	cp.Log.Info("closed tunnel",
+		"sessionId", id,
+		"username", ct.Conn.Username(),
+		"xuid", ct.Conn.XUID(),
+		"client", ct.Conn.RemoteAddr(),
+		"server", ct.RemoteConn.RemoteAddr(),
+		"reason", reason,
+		"duration", duration,
+		"clientToServerBytes", traffic.ClientToServerBytes,
+		"clientToServerPackets", traffic.ClientToServerPackets,
+		"serverToClientBytes", traffic.ServerToClientBytes,
+		"serverToClientPackets", traffic.ServerToClientPackets,
+	)
+
+	events <- webhook.EventPlayerLeave{
+		Username:      ct.Conn.Username(),
+		XUID:          ct.Conn.XUID(),
+		RemoteAddress: ct.Conn.RemoteAddr().String(),
+		TargetAddress: ct.RemoteConn.RemoteAddr().String(),
+		Reason:        string(reason),
+		Duration:      duration.Seconds(),
+
+		ClientToServerBytes:   traffic.ClientToServerBytes,
+		ClientToServerPackets: traffic.ClientToServerPackets,
+		ServerToClientBytes:   traffic.ServerToClientBytes,
+		ServerToClientPackets: traffic.ServerToClientPackets,
+	}
+}
+
+func (cp *ConnPool) add(ct ConnTunnel, startedAt time.Time) uint64 {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	if cp.sessions == nil {
+		cp.sessions = map[uint64]poolSession{}
+	}
+	cp.nextID++
+	cp.sessions[cp.nextID] = poolSession{
+		tunnel:    ct,
+		startedAt: startedAt,
+	}
+	cp.wg.Add(1)
+	return cp.nextID
+}
+
+// remove removes the tunnel and adds its traffic to the totals
+// of its server and gateway.
+func (cp *ConnPool) remove(id uint64) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+
+	session, ok := cp.sessions[id]
+	if !ok {
+		return
+	}
+	delete(cp.sessions, id)
+	ct := session.tunnel
+
+	if cp.serverTraffic == nil {
+		cp.serverTraffic = map[string]TrafficStats{}
+		cp.gatewayTraffic = map[string]TrafficStats{}
+	}
+	traffic := ct.Traffic()
+	gatewayID := ct.Conn.GatewayID()
+	cp.serverTraffic[ct.ServerID] = cp.serverTraffic[ct.ServerID].Add(traffic)
+	cp.gatewayTraffic[gatewayID] = cp.gatewayTraffic[gatewayID].Add(traffic)
+}
+
+// Shutdown closes all tunnels with CloseReasonProxyShutdown and waits
+// until they are closed and their events are dispatched.
+func (cp *ConnPool) Shutdown() {
+	cp.mu.RLock()
+	for _, session := range cp.sessions {
+		session.tunnel.CloseWithReason(CloseReasonProxyShutdown)
+	}
+	cp.mu.RUnlock()
+
+	cp.wg.Wait()
+}
+
+// Usernames returns the usernames of all players that currently
+// have an active tunnel through the gateway with the given ID.
+func (cp *ConnPool) Usernames(gatewayID string) []string {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+
+	var usernames []string
+	for _, session := range cp.sessions {
+		if session.tunnel.Conn.GatewayID() != gatewayID {
+			continue
+		}
+		usernames = append(usernames, session.tunnel.Conn.Username())
+	}
+	return usernames
+}
 
-		go ct.Start()
+// Sessions returns the sessions of all active tunnels ordered by their ID.
+func (cp *ConnPool) Sessions() []Session {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+
+	sessions := make([]Session, 0, len(cp.sessions))
+	for id, session := range cp.sessions {
+		sessions = append(sessions, session.snapshot(id))
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
+
+// Session returns the session with the given ID, if it is active.
+func (cp *ConnPool) Session(id uint64) (Session, bool) {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+
+	session, ok := cp.sessions[id]
+	if !ok {
+		return Session{}, false
+	}
+	return session.snapshot(id), true
+}
+
+// FindByUsername returns the active session of the player with the
+// username. Usernames are compared case-insensitively like the game does.
+func (cp *ConnPool) FindByUsername(username string) (Session, bool) {
+	return cp.find(func(pc ProcessedConn) bool {
+		return strings.EqualFold(pc.Username(), username)
+	})
+}
+
+// FindByXUID returns the active session of the player with the XUID.
+func (cp *ConnPool) FindByXUID(xuid string) (Session, bool) {
+	if xuid == "" {
+		return Session{}, false
+	}
+	return cp.find(func(pc ProcessedConn) bool {
+		return pc.XUID() == xuid
+	})
+}
+
+// find returns the oldest active session whose connection matches.
+func (cp *ConnPool) find(match func(pc ProcessedConn) bool) (Session, bool) {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+
+	var found Session
+	var ok bool
+	for id, session := range cp.sessions {
+		if !match(session.tunnel.Conn) || ok && found.ID < id {
+			continue
+		}
+		found, ok = session.snapshot(id), true
+	}
+	return found, ok
+}
+
+// CloseSession closes the tunnel of the session with the given ID with
+// CloseReasonKicked. It reports false if the session is not active.
+func (cp *ConnPool) CloseSession(id uint64) bool {
+	cp.mu.RLock()
+	session, ok := cp.sessions[id]
+	cp.mu.RUnlock()
+	if !ok {
+		return false
+	}
+
+	session.tunnel.CloseWithReason(CloseReasonKicked)
+	return true
+}
+
+// SwitchServer moves the player of the session with the given ID to the
+// server with the given ID, if the tunnel of the session supports it.
+func (cp *ConnPool) SwitchServer(id uint64, serverID string) error {
+	cp.mu.RLock()
+	session, ok := cp.sessions[id]
+	cp.mu.RUnlock()
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	switcher, ok := session.tunnel.RemoteConn.(ServerSwitcher)
+	if !ok {
+		return ErrSwitchNotSupported
+	}
+	return switcher.SwitchServer(serverID)
+}
+
+// ServerSessionCount returns the number of active sessions
+// with the server with the given ID.
+func (cp *ConnPool) ServerSessionCount(serverID string) int {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+
+	var count int
+	for _, session := range cp.sessions {
+		if session.tunnel.ServerID == serverID {
+			count++
+		}
+	}
+	return count
+}
+
+// GatewaySessionCount returns the number of active sessions
+// through the gateway with the given ID.
+func (cp *ConnPool) GatewaySessionCount(gatewayID string) int {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+
+	var count int
+	for _, session := range cp.sessions {
+		if session.tunnel.Conn.GatewayID() == gatewayID {
+			count++
+		}
+	}
+	return count
+}
+
+// ServerTraffic returns the traffic that was relayed to and from
+// the server with the given ID, including that of active tunnels.
+func (cp *ConnPool) ServerTraffic(serverID string) TrafficStats {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+
+	traffic := cp.serverTraffic[serverID]
+	for _, session := range cp.sessions {
+		if session.tunnel.ServerID == serverID {
+			traffic = traffic.Add(session.tunnel.Traffic())
+		}
+	}
+	return traffic
+}
+
+// GatewayTraffic returns the traffic that was relayed for the clients
+// of the gateway with the given ID, including that of active tunnels.
+func (cp *ConnPool) GatewayTraffic(gatewayID string) TrafficStats {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+
+	traffic := cp.gatewayTraffic[gatewayID]
+	for _, session := range cp.sessions {
+		if session.tunnel.Conn.GatewayID() == gatewayID {
+			traffic = traffic.Add(session.tunnel.Traffic())
+		}
+	}
+	return traffic
+}
+
+// dispatchEvent dispatches the event to all webhooks that subscribed to it.
+func dispatchEvent(log logr.Logger, webhooks []webhook.Webhook, event webhook.Event) {
+	for _, w := range webhooks {
+		if err := w.DispatchEvent(event); err != nil && !errors.Is(err, webhook.ErrEventNotAllowed) {
+			log.Error(err, "failed to dispatch event",
+				"webhookId", w.ID,
+				"eventType", event.EventType(),
+			)
+		}
 	}
 }
@@ -0,0 +1,392 @@
+package bedprox_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/haveachin/bedprox"
+	"github.com/haveachin/bedprox/webhook"
+)
+
+// recordingHTTPClient records the events that webhooks dispatch.
+type recordingHTTPClient struct {
+	mu     sync.Mutex
+	events []json.RawMessage
+}
+
+func (c *recordingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	var eventLog struct {
+		Event json.RawMessage `json:"event"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&eventLog); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.events = append(c.events, eventLog.Event)
+	c.mu.Unlock()
+	return &http.Response{Body: ioutil.NopCloser(&bytes.Buffer{})}, nil
+}
+
+func (c *recordingHTTPClient) recorded() []json.RawMessage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.events
+}
+
+func TestConnPool_Shutdown(t *testing.T) {
+	httpClient := &recordingHTTPClient{}
+	ct, client, server := newTunnel()
+	defer client.Close()
+	defer server.Close()
+	ct.Webhooks = []webhook.Webhook{
+		{
+			ID:         "wh",
+			HTTPClient: httpClient,
+			EventTypes: []string{webhook.EventTypePlayerLeave},
+		},
+	}
+
+	pool := bedprox.ConnPool{Log: logr.Discard()}
+	poolChan := make(chan bedprox.ConnTunnel)
+	go pool.Start(poolChan)
+	poolChan <- ct
+	close(poolChan)
+
+	// The tunnel is registered once the player is listed
+	deadline := time.Now().Add(time.Second)
+	for len(pool.Usernames("gw")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel was not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	pool.Shutdown()
+
+	if usernames := pool.Usernames("gw"); len(usernames) != 0 {
+		t.Errorf("expected no players after shutdown; got %v", usernames)
+	}
+
+	events := httpClient.recorded()
+	if len(events) != 1 {
+		t.Fatalf("expected only the PlayerLeave event; got %d events", len(events))
+	}
+
+	var leave webhook.EventPlayerLeave
+	if err := json.Unmarshal(events[0], &leave); err != nil {
+		t.Fatal(err)
+	}
+	if leave.Username != "Steve" {
+		t.Errorf("expected username Steve; got %q", leave.Username)
+	}
+	if leave.Reason != string(bedprox.CloseReasonProxyShutdown) {
+		t.Errorf("expected reason %q; got %q", bedprox.CloseReasonProxyShutdown, leave.Reason)
+	}
+	if leave.Duration <= 0 {
+		t.Errorf("expected a positive duration; got %v", leave.Duration)
+	}
+}
+
+// blockingHTTPClient answers requests once release is closed.
+type blockingHTTPClient struct {
+	recordingHTTPClient
+	release chan struct{}
+}
+
+func (c *blockingHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	<-c.release
+	return c.recordingHTTPClient.Do(req)
+}
+
+func TestConnPool_Start_SlowWebhook(t *testing.T) {
+	httpClient := &blockingHTTPClient{release: make(chan struct{})}
+	ct, client, server := newTunnel()
+	defer client.Close()
+	defer server.Close()
+	ct.Webhooks = []webhook.Webhook{
+		{
+			ID:         "wh",
+			HTTPClient: httpClient,
+			EventTypes: []string{webhook.EventTypePlayerJoin, webhook.EventTypePlayerLeave},
+		},
+	}
+
+	pool := bedprox.ConnPool{Log: logr.Discard()}
+	poolChan := make(chan bedprox.ConnTunnel)
+	go pool.Start(poolChan)
+	poolChan <- ct
+	close(poolChan)
+
+	// Traffic is relayed while the PlayerJoin event is still dispatched
+	go client.Write([]byte("hello"))
+	server.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(server, make([]byte, 5)); err != nil {
+		t.Fatalf("traffic was not relayed while dispatching: %v", err)
+	}
+
+	close(httpClient.release)
+	pool.Shutdown()
+
+	events := httpClient.recorded()
+	if len(events) != 2 {
+		t.Fatalf("expected the PlayerJoin and PlayerLeave event; got %d events", len(events))
+	}
+	// Only the PlayerLeave event has a reason
+	var leave webhook.EventPlayerLeave
+	if err := json.Unmarshal(events[1], &leave); err != nil {
+		t.Fatal(err)
+	}
+	if leave.Reason != string(bedprox.CloseReasonProxyShutdown) {
+		t.Errorf("expected the PlayerLeave event last; got %s", events[1])
+	}
+}
+
+func TestConnPool_Traffic(t *testing.T) {
+	ct, client, server := newTunnel()
+	defer client.Close()
+	defer server.Close()
+	ct.ServerID = "srv"
+
+	pool := bedprox.ConnPool{Log: logr.Discard()}
+	poolChan := make(chan bedprox.ConnTunnel)
+	go pool.Start(poolChan)
+	poolChan <- ct
+	close(poolChan)
+
+	relay := func(from, to net.Conn, msg string) {
+		go from.Write([]byte(msg))
+		b := make([]byte, len(msg))
+		if _, err := io.ReadFull(to, b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	relay(client, server, "hello")
+	relay(client, server, "world")
+	relay(server, client, "hi")
+
+	want := bedprox.TrafficStats{
+		ClientToServerBytes:   10,
+		ClientToServerPackets: 2,
+		ServerToClientBytes:   2,
+		ServerToClientPackets: 1,
+	}
+	if traffic := pool.ServerTraffic("srv"); traffic != want {
+		t.Errorf("expected live server traffic %+v; got %+v", want, traffic)
+	}
+	if traffic := pool.GatewayTraffic("gw"); traffic != want {
+		t.Errorf("expected live gateway traffic %+v; got %+v", want, traffic)
+	}
+
+	// The traffic of closed tunnels still counts towards the totals
+	pool.Shutdown()
+	if traffic := pool.ServerTraffic("srv"); traffic != want {
+		t.Errorf("expected server traffic %+v; got %+v", want, traffic)
+	}
+	if traffic := pool.GatewayTraffic("gw"); traffic != want {
+		t.Errorf("expected gateway traffic %+v; got %+v", want, traffic)
+	}
+	if traffic := pool.ServerTraffic("other"); traffic != (bedprox.TrafficStats{}) {
+		t.Errorf("expected no traffic for other servers; got %+v", traffic)
+	}
+}
+
+func TestConnPool_Sessions(t *testing.T) {
+	httpClient := &recordingHTTPClient{}
+	ct, client, server := newTunnel()
+	defer client.Close()
+	defer server.Close()
+	ct.ServerID = "srv"
+	ct.Webhooks = []webhook.Webhook{
+		{
+			ID:         "wh",
+			HTTPClient: httpClient,
+			EventTypes: []string{webhook.EventTypePlayerLeave},
+		},
+	}
+
+	pool := bedprox.ConnPool{Log: logr.Discard()}
+	poolChan := make(chan bedprox.ConnTunnel)
+	go pool.Start(poolChan)
+	poolChan <- ct
+	close(poolChan)
+
+	deadline := time.Now().Add(time.Second)
+	for len(pool.Sessions()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnel was not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	sessions := pool.Sessions()
+	if len(sessions) != 1 {
+		t.Fatalf("expected one session; got %d", len(sessions))
+	}
+	session := sessions[0]
+	if session.Username != "Steve" || session.XUID != "2535412345678901" ||
+		session.GatewayID != "gw" || session.ServerID != "srv" {
+		t.Errorf("unexpected session %+v", session)
+	}
+	if session.StartedAt.IsZero() {
+		t.Error("expected the start time to be set")
+	}
+
+	tt := []struct {
+		name string
+		find func() (bedprox.Session, bool)
+		ok   bool
+	}{
+		{
+			name: "by ID",
+			find: func() (bedprox.Session, bool) { return pool.Session(session.ID) },
+			ok:   true,
+		},
+		{
+			name: "by username",
+			find: func() (bedprox.Session, bool) { return pool.FindByUsername("steve") },
+			ok:   true,
+		},
+		{
+			name: "by XUID",
+			find: func() (bedprox.Session, bool) { return pool.FindByXUID("2535412345678901") },
+			ok:   true,
+		},
+		{
+			name: "unknown username",
+			find: func() (bedprox.Session, bool) { return pool.FindByUsername("Alex") },
+		},
+		{
+			name: "empty XUID",
+			find: func() (bedprox.Session, bool) { return pool.FindByXUID("") },
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			found, ok := tc.find()
+			if ok != tc.ok {
+				t.Fatalf("expected ok to be %v; got %v", tc.ok, ok)
+			}
+			if ok && found.ID != session.ID {
+				t.Errorf("expected session %d; got %d", session.ID, found.ID)
+			}
+		})
+	}
+
+	if !pool.CloseSession(session.ID) {
+		t.Fatal("expected the session to be closed")
+	}
+	pool.Shutdown()
+
+	if pool.CloseSession(session.ID) {
+		t.Error("expected closed sessions to be gone")
+	}
+	if sessions := pool.Sessions(); len(sessions) != 0 {
+		t.Errorf("expected no sessions; got %v", sessions)
+	}
+
+	events := httpClient.recorded()
+	if len(events) != 1 {
+		t.Fatalf("expected only the PlayerLeave event; got %d events", len(events))
+	}
+	var leave webhook.EventPlayerLeave
+	if err := json.Unmarshal(events[0], &leave); err != nil {
+		t.Fatal(err)
+	}
+	if leave.Reason != string(bedprox.CloseReasonKicked) {
+		t.Errorf("expected reason %q; got %q", bedprox.CloseReasonKicked, leave.Reason)
+	}
+}
+
+// switchingConn is the remote connection of a tunnel that records the
+// servers that it switches to.
+type switchingConn struct {
+	net.Conn
+	switched chan string
+}
+
+func (c switchingConn) SwitchServer(serverID string) error {
+	c.switched <- serverID
+	return nil
+}
+
+func TestConnPool_SwitchServer(t *testing.T) {
+	ct, client, server := newTunnel()
+	defer client.Close()
+	defer server.Close()
+	switched := make(chan string, 1)
+	ct.RemoteConn = switchingConn{Conn: ct.RemoteConn, switched: switched}
+
+	plain, plainClient, plainServer := newTunnel()
+	defer plainClient.Close()
+	defer plainServer.Close()
+
+	pool := bedprox.ConnPool{Log: logr.Discard()}
+	poolChan := make(chan bedprox.ConnTunnel)
+	go pool.Start(poolChan)
+	poolChan <- ct
+	poolChan <- plain
+	close(poolChan)
+	defer pool.Shutdown()
+
+	deadline := time.Now().Add(time.Second)
+	for len(pool.Sessions()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("tunnels were not started")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	// Sessions are ordered by their ID, which the pool assigns in order
+	sessions := pool.Sessions()
+	switchable, other := sessions[0].ID, sessions[1].ID
+
+	tt := []struct {
+		name string
+		id   uint64
+		err  error
+	}{
+		{
+			name: "switchable session",
+			id:   switchable,
+		},
+		{
+			name: "session that can not switch",
+			id:   other,
+			err:  bedprox.ErrSwitchNotSupported,
+		},
+		{
+			name: "unknown session",
+			id:   switchable + other,
+			err:  bedprox.ErrSessionNotFound,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := pool.SwitchServer(tc.id, "survival"); err != tc.err {
+				t.Fatalf("expected error %v; got %v", tc.err, err)
+			}
+			if tc.err != nil {
+				return
+			}
+
+			select {
+			case serverID := <-switched:
+				if serverID != "survival" {
+					t.Errorf("expected switch to survival; got %q", serverID)
+				}
+			default:
+				t.Error("session was not switched")
+			}
+		})
+	}
+}
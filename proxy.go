@@ -2,6 +2,7 @@ package bedprox
 
 import (
 	"net"
+	"time"
 
 	"github.com/go-logr/logr"
 )
@@ -10,7 +11,11 @@ type Proxy struct {
 	Gateways      []Gateway
 	CPNs          []CPN
 	ServerGateway ServerGateway
-	ConnPool      ConnPool
+	ConnPool      *ConnPool
+	// Pipeline configures the queues between the stages of the proxy
+	Pipeline Pipeline
+
+	pipeline *pipeline
 }
 
 func NewProxy(cfg ProxyConfig) (Proxy, error) {
@@ -21,9 +26,25 @@ func NewProxy(cfg ProxyConfig) (Proxy, error) {
 
 	gwIDsIDs := map[string][]string{}
 	srvNotFoundMsgs := map[string]string{}
+	srvNotFoundTransfers := map[string]TransferTarget{}
+	unauthPolicies := map[string]UnauthenticatedPolicy{}
+	rejectPolicies := map[string]map[RejectReason]RejectionPolicy{}
+	idleTimeouts := map[string]time.Duration{}
+	trafficLimits := map[string]TrafficLimit{}
+	sharedTrafficLimits := map[string]TrafficLimit{}
+	capacities := map[string]Capacity{}
 	for _, gw := range gateways {
 		gwIDsIDs[gw.GetID()] = gw.GetServerIDs()
 		srvNotFoundMsgs[gw.GetID()] = gw.GetServerNotFoundMessage()
+		if target, ok := gw.GetServerNotFoundTransfer(); ok {
+			srvNotFoundTransfers[gw.GetID()] = target
+		}
+		unauthPolicies[gw.GetID()] = gw.GetUnauthenticatedPolicy()
+		rejectPolicies[gw.GetID()] = gw.GetRejectionPolicies()
+		idleTimeouts[gw.GetID()] = gw.GetIdleTimeout()
+		trafficLimits[gw.GetID()] = gw.GetTrafficLimit()
+		sharedTrafficLimits[gw.GetID()] = gw.GetSharedTrafficLimit()
+		capacities[gw.GetID()] = gw.GetCapacity()
 	}
 
 	cpns, err := cfg.LoadCPNs()
@@ -36,44 +57,82 @@ func NewProxy(cfg ProxyConfig) (Proxy, error) {
 		return Proxy{}, err
 	}
 
+	webhooks, err := cfg.LoadWebhooks()
+	if err != nil {
+		return Proxy{}, err
+	}
+
+	pipelineCfg, err := cfg.LoadPipeline()
+	if err != nil {
+		return Proxy{}, err
+	}
+
+	pool := &ConnPool{}
 	return Proxy{
 		Gateways: gateways,
 		CPNs:     cpns,
 		ServerGateway: ServerGateway{
-			GatewayIDServerIDs:     gwIDsIDs,
-			ServerNotFoundMessages: srvNotFoundMsgs,
-			Servers:                servers,
+			GatewayIDServerIDs:      gwIDsIDs,
+			ServerNotFoundMessages:  srvNotFoundMsgs,
+			ServerNotFoundTransfers: srvNotFoundTransfers,
+			UnauthenticatedPolicies: unauthPolicies,
+			RejectionPolicies:       rejectPolicies,
+			IdleTimeouts:            idleTimeouts,
+			TrafficLimits:           trafficLimits,
+			SharedTrafficLimits:     sharedTrafficLimits,
+			Capacities:              capacities,
+			Sessions:                pool,
+			Servers:                 servers,
+			Webhooks:                webhooks,
 		},
-		ConnPool: ConnPool{},
+		ConnPool: pool,
+		Pipeline: pipelineCfg,
+		pipeline: newPipeline(pipelineCfg),
 	}, nil
 }
 
 func (p Proxy) Start(log logr.Logger) error {
-	cpnChan := make(chan net.Conn, 10)
-	srvChan := make(chan ProcessedConn, 10)
-	poolChan := make(chan ConnTunnel, 10)
+	pl := p.pipeline
+	if pl == nil {
+		pl = newPipeline(p.Pipeline)
+	}
+
+	acceptChan := make(chan net.Conn)
+	go pl.admit(acceptChan, log)
 
 	for _, gw := range p.Gateways {
 		gw.SetLogger(log)
-		go gw.ListenAndServe(cpnChan)
+		gw.SetPlayerLister(p.ConnPool)
+		go gw.ListenAndServe(acceptChan)
 	}
 
 	for _, cpn := range p.CPNs {
 		cpn.Log = log
-		go cpn.Start(cpnChan, srvChan)
+		cpn.srvQueue = pl.srvQueue
+		cpn.busyMessage = pl.busyMessage
+		go cpn.Start(pl.cpnChan, pl.srvChan)
 	}
 
 	p.ConnPool.Log = log
-	go p.ConnPool.Start(poolChan)
+	go p.ConnPool.Start(pl.poolChan)
 
 	for _, srv := range p.ServerGateway.Servers {
 		srv.SetLogger(log)
 	}
 
 	p.ServerGateway.Log = log
-	if err := p.ServerGateway.Start(srvChan, poolChan); err != nil {
+	if err := p.ServerGateway.Start(pl.srvChan, pl.poolChan); err != nil {
 		return err
 	}
 
 	return nil
 }
+
+// PipelineStats returns the metrics of the queues between the stages
+// of the proxy. Proxies that were not created by NewProxy have none.
+func (p Proxy) PipelineStats() PipelineStats {
+	if p.pipeline == nil {
+		return PipelineStats{}
+	}
+	return p.pipeline.stats()
+}
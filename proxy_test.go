@@ -0,0 +1,187 @@
+package bedprox_test
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/haveachin/bedprox"
+	"github.com/haveachin/bedprox/webhook"
+)
+
+// mockGateway sends the connections of conns to the CPN queue.
+type mockGateway struct {
+	bedprox.Gateway
+	conns chan net.Conn
+}
+
+func (gw mockGateway) GetID() string {
+	return "gw"
+}
+
+func (gw mockGateway) GetServerIDs() []string {
+	return nil
+}
+
+func (gw mockGateway) GetServerNotFoundMessage() string {
+	return ""
+}
+
+func (gw mockGateway) GetServerNotFoundTransfer() (bedprox.TransferTarget, bool) {
+	return bedprox.TransferTarget{}, false
+}
+
+func (gw mockGateway) GetUnauthenticatedPolicy() bedprox.UnauthenticatedPolicy {
+	return bedprox.UnauthenticatedPolicy{}
+}
+
+func (gw mockGateway) GetIdleTimeout() time.Duration {
+	return 0
+}
+
+func (gw mockGateway) GetTrafficLimit() bedprox.TrafficLimit {
+	return bedprox.TrafficLimit{}
+}
+
+func (gw mockGateway) GetSharedTrafficLimit() bedprox.TrafficLimit {
+	return bedprox.TrafficLimit{}
+}
+
+func (gw mockGateway) GetCapacity() bedprox.Capacity {
+	return bedprox.Capacity{}
+}
+
+func (gw mockGateway) GetRejectionPolicies() map[bedprox.RejectReason]bedprox.RejectionPolicy {
+	return nil
+}
+
+func (gw mockGateway) SetLogger(log logr.Logger) {}
+
+func (gw mockGateway) SetPlayerLister(pl bedprox.PlayerLister) {}
+
+func (gw mockGateway) ListenAndServe(cpnChan chan<- net.Conn) error {
+	for c := range gw.conns {
+		cpnChan <- c
+	}
+	return nil
+}
+
+// stuckProcessor processes connections until release is closed.
+type stuckProcessor struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (p stuckProcessor) ProcessConn(c net.Conn) (bedprox.ProcessedConn, error) {
+	p.started <- struct{}{}
+	<-p.release
+	return nil, errors.New("released")
+}
+
+type mockProxyConfig struct {
+	gw       mockGateway
+	cpn      bedprox.CPN
+	pipeline bedprox.Pipeline
+}
+
+func (cfg mockProxyConfig) LoadGateways() ([]bedprox.Gateway, error) {
+	return []bedprox.Gateway{cfg.gw}, nil
+}
+
+func (cfg mockProxyConfig) LoadServers() ([]bedprox.Server, error) {
+	return nil, nil
+}
+
+func (cfg mockProxyConfig) LoadCPNs() ([]bedprox.CPN, error) {
+	return []bedprox.CPN{cfg.cpn}, nil
+}
+
+func (cfg mockProxyConfig) LoadWebhooks() ([]webhook.Webhook, error) {
+	return nil, nil
+}
+
+func (cfg mockProxyConfig) LoadPipeline() (bedprox.Pipeline, error) {
+	return cfg.pipeline, nil
+}
+
+func TestProxy_Start_Overload(t *testing.T) {
+	tt := []struct {
+		name     string
+		overload bedprox.OverloadPolicy
+		// wait is the time between the second and the third connection
+		wait time.Duration
+	}{
+		{
+			name:     "max queue depth",
+			overload: bedprox.OverloadPolicy{MaxQueueDepth: 1},
+		},
+		{
+			name:     "max queue age",
+			overload: bedprox.OverloadPolicy{MaxQueueAge: 20 * time.Millisecond},
+			wait:     50 * time.Millisecond,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			proc := stuckProcessor{
+				started: make(chan struct{}, 3),
+				release: make(chan struct{}),
+			}
+			defer close(proc.release)
+
+			gw := mockGateway{conns: make(chan net.Conn)}
+			defer close(gw.conns)
+
+			p, err := bedprox.NewProxy(mockProxyConfig{
+				gw:  gw,
+				cpn: bedprox.CPN{ConnProcessor: proc},
+				pipeline: bedprox.Pipeline{
+					CPNQueueSize: 10,
+					Overload:     tc.overload,
+				},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			go p.Start(logr.Discard())
+
+			// The first connection keeps the only CPN busy, so that the
+			// second one waits in the queue.
+			var clients []net.Conn
+			for n := 0; n < 3; n++ {
+				c, client := net.Pipe()
+				defer client.Close()
+				clients = append(clients, client)
+				gw.conns <- c
+
+				switch n {
+				case 0:
+					select {
+					case <-proc.started:
+					case <-time.After(time.Second):
+						t.Fatal("first connection was not processed")
+					}
+				case 1:
+					time.Sleep(tc.wait)
+				}
+			}
+
+			clients[2].SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := clients[2].Read(make([]byte, 1)); err != io.EOF {
+				t.Errorf("expected the third connection to be closed; got %v", err)
+			}
+
+			stats := p.PipelineStats().CPN
+			if stats.Depth != 1 || stats.Capacity != 10 || stats.Rejected != 1 {
+				t.Errorf("expected depth 1 of 10 with 1 rejection; got %+v", stats)
+			}
+			if stats.Age < tc.wait {
+				t.Errorf("expected an age of at least %s; got %s", tc.wait, stats.Age)
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package bedprox
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultQueueRetryInterval is the retry interval of queues without one
+const defaultQueueRetryInterval = time.Second
+
+// ErrServerUnavailable is returned by servers that could not be reached
+// while the client is still connected, so that it can wait in the queue
+// of the server.
+var ErrServerUnavailable = errors.New("server unavailable")
+
+// QueuePolicy defines the join queue of a server. Players wait in the queue
+// if the server is full, could not be reached or already has a queue.
+type QueuePolicy struct {
+	// MaxWait is the time that players wait in the queue at most.
+	// Zero disables the queue.
+	MaxWait time.Duration
+	// RetryInterval is the interval that the first players of the
+	// queue try to join the server in
+	RetryInterval time.Duration
+	// Tiers are the priority tiers of the queue. Players are queued behind
+	// all players of their own and of higher tiers, but ahead of players of
+	// lower tiers. Players of no tier are in the lowest tier.
+	Tiers []PlayerSet
+	// TimeoutMessage is the message that players are disconnected with
+	// once they waited for MaxWait
+	TimeoutMessage string
+}
+
+// Enabled reports if the server has a queue
+func (p QueuePolicy) Enabled() bool {
+	return p.MaxWait > 0
+}
+
+// tier returns the priority tier of the player, where lower is higher.
+func (p QueuePolicy) tier(pc ProcessedConn) int {
+	for n, tier := range p.Tiers {
+		if tier.contains(pc) {
+			return n
+		}
+	}
+	return len(p.Tiers)
+}
+
+// connWatcher is implemented by connections that notice when the client
+// closes them, even while nobody reads from them
+type connWatcher interface {
+	// Watch returns a channel that is closed once the connection was closed
+	Watch() <-chan struct{}
+}
+
+// queueEntry is a player that waits in a queue
+type queueEntry struct {
+	pc       ProcessedConn
+	tier     int
+	queuedAt time.Time
+	// position is the last position that was reported for the player
+	position int
+	// closed is closed once the player left. It is nil if the
+	// connection of the player can not be watched.
+	closed <-chan struct{}
+}
+
+// left reports if the player closed the connection while waiting
+func (e *queueEntry) left() bool {
+	select {
+	case <-e.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// joinQueue is the queue of the players that wait for a server
+type joinQueue struct {
+	srv    Server
+	policy QueuePolicy
+
+	mu      sync.Mutex
+	entries []*queueEntry
+}
+
+// push queues the player behind the players of its own and higher tiers
+// and returns its position and the size of the queue, starting at one.
+func (q *joinQueue) push(pc ProcessedConn, now time.Time) (position, size int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entry := &queueEntry{
+		pc:       pc,
+		tier:     q.policy.tier(pc),
+		queuedAt: now,
+	}
+	if w, ok := pc.(connWatcher); ok {
+		entry.closed = w.Watch()
+	}
+
+	n := len(q.entries)
+	for n > 0 && q.entries[n-1].tier > entry.tier {
+		n--
+	}
+	q.entries = append(q.entries, nil)
+	copy(q.entries[n+1:], q.entries[n:])
+	q.entries[n] = entry
+	entry.position = n + 1
+	return entry.position, len(q.entries)
+}
+
+func (q *joinQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.entries)
+}
+
+// head returns the entry of the first player of the queue.
+func (q *joinQueue) head() (*queueEntry, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.entries) == 0 {
+		return nil, false
+	}
+	return q.entries[0], true
+}
+
+// pop removes the entry from the queue. Players of higher tiers might
+// have been queued ahead of it since it was returned by head, so it is
+// looked up instead of removed from the front.
+func (q *joinQueue) pop(entry *queueEntry) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for n, e := range q.entries {
+		if e != entry {
+			continue
+		}
+		copy(q.entries[n:], q.entries[n+1:])
+		q.entries[len(q.entries)-1] = nil
+		q.entries = q.entries[:len(q.entries)-1]
+		return
+	}
+}
+
+// expire removes the players that waited for longer than the max wait
+// and returns them together with the positions that they were at.
+func (q *joinQueue) expire(now time.Time) ([]ProcessedConn, []int) {
+	return q.remove(func(entry *queueEntry) bool {
+		return now.Sub(entry.queuedAt) >= q.policy.MaxWait
+	})
+}
+
+// left removes the players that closed their connection while waiting
+// and returns them together with the positions that they were at.
+func (q *joinQueue) left() ([]ProcessedConn, []int) {
+	return q.remove((*queueEntry).left)
+}
+
+// remove removes the players whose entries match and returns them
+// together with the positions that they were at.
+func (q *joinQueue) remove(match func(entry *queueEntry) bool) ([]ProcessedConn, []int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var removed []ProcessedConn
+	var positions []int
+	entries := q.entries[:0]
+	for n, entry := range q.entries {
+		if !match(entry) {
+			entries = append(entries, entry)
+			continue
+		}
+		removed = append(removed, entry.pc)
+		positions = append(positions, n+1)
+	}
+	for n := len(entries); n < len(q.entries); n++ {
+		q.entries[n] = nil
+	}
+	q.entries = entries
+	return removed, positions
+}
+
+// moved returns the players whose position changed since the
+// last call together with their new position.
+func (q *joinQueue) moved() ([]ProcessedConn, []int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var moved []ProcessedConn
+	var positions []int
+	for n, entry := range q.entries {
+		if entry.position == n+1 {
+			continue
+		}
+		entry.position = n + 1
+		moved = append(moved, entry.pc)
+		positions = append(positions, entry.position)
+	}
+	return moved, positions
+}
+
+// executeQueueTemplate replaces the templates of the position of the
+// player in the queue and of the size of the queue.
+func executeQueueTemplate(msg string, position, size int) string {
+	msg = strings.Replace(msg, "{{queuePosition}}", strconv.Itoa(position), -1)
+	return strings.Replace(msg, "{{queueSize}}", strconv.Itoa(size), -1)
+}
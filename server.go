@@ -1,9 +1,12 @@
 package bedprox
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-logr/logr"
@@ -14,22 +17,82 @@ type Server interface {
 	GetID() string
 	GetDomains() []string
 	GetWebhookIDs() []string
+	// GetTransferTarget returns the public address that clients are
+	// transferred to instead of being proxied, if ok is true
+	GetTransferTarget() (target TransferTarget, ok bool)
+	// GetCapacity returns the number of players that
+	// the server has room for
+	GetCapacity() Capacity
+	// GetQueuePolicy returns the policy of the join queue of the server
+	GetQueuePolicy() QueuePolicy
+	// GetDialConcurrency returns the number of players that the server
+	// is dialed for at once
+	GetDialConcurrency() int
+	// GetSharedTrafficLimit returns the traffic limit of all tunnels
+	// of the server together
+	GetSharedTrafficLimit() TrafficLimit
 	ProcessConn(c net.Conn, webhooks []webhook.Webhook) (ConnTunnel, error)
 	SetLogger(log logr.Logger)
 }
 
+// TransferTarget is the public address of a server that clients
+// connect to directly after they were transferred
+type TransferTarget struct {
+	Host string
+	Port uint16
+}
+
 type ServerGateway struct {
 	GatewayIDServerIDs map[string][]string
 	// ServerNotFoundMessages maps the GatewayID to server not found message
 	ServerNotFoundMessages map[string]string
-	Servers                []Server
-	Webhooks               []webhook.Webhook
-	Log                    logr.Logger
+	// ServerNotFoundTransfers maps the GatewayID to the target that
+	// clients are transferred to if no server matches their address
+	ServerNotFoundTransfers map[string]TransferTarget
+	// UnauthenticatedPolicies maps the GatewayID to the policy
+	// for players that are not authenticated with XBOX Live
+	UnauthenticatedPolicies map[string]UnauthenticatedPolicy
+	// RejectionPolicies maps the GatewayID to the policies
+	// for players that are rejected for a reason
+	RejectionPolicies map[string]map[RejectReason]RejectionPolicy
+	// IdleTimeouts maps the GatewayID to the idle timeout of
+	// the tunnels of its players
+	IdleTimeouts map[string]time.Duration
+	// TrafficLimits maps the GatewayID to the traffic limit of
+	// the tunnels of its players
+	TrafficLimits map[string]TrafficLimit
+	// SharedTrafficLimits maps the GatewayID to the traffic limit of
+	// all tunnels of its players together
+	SharedTrafficLimits map[string]TrafficLimit
+	// Capacities maps the GatewayID to the number of players
+	// that it has room for
+	Capacities map[string]Capacity
+	// Sessions counts the active sessions that capacities are
+	// enforced against. Capacities are not enforced if it is nil.
+	Sessions SessionCounter
+	Servers  []Server
+	Webhooks []webhook.Webhook
+	Log      logr.Logger
 
 	// "GatewayID@Domain" mapped to server
 	srvs map[string]Server
+	// Server ID mapped to server
+	srvIDs map[string]Server
 	// Server ID mapped to webhooks
 	srvWhks map[string][]webhook.Webhook
+	// Server ID mapped to the join queue of servers that have one
+	queues map[string]*joinQueue
+	// Server ID mapped to the dialer of the server
+	dialers map[string]*serverDialer
+	// admitted are the players that were admitted, but whose sessions
+	// are not counted by Sessions yet
+	admitted *admissions
+	// Server ID mapped to the traffic limiter that the tunnels of the
+	// server share
+	srvLimiters map[string]*TrafficLimiter
+	// Gateway ID mapped to the traffic limiter that the tunnels of the
+	// gateway share
+	gwLimiters map[string]*TrafficLimiter
 }
 
 func (sg *ServerGateway) indexServers() error {
@@ -37,6 +100,16 @@ func (sg *ServerGateway) indexServers() error {
 	for _, srv := range sg.Servers {
 		srvs[srv.GetID()] = srv
 	}
+	sg.srvIDs = srvs
+
+	for gID, policy := range sg.UnauthenticatedPolicies {
+		if policy.Action != UnauthenticatedActionRoute {
+			continue
+		}
+		if _, ok := srvs[policy.ServerID]; !ok {
+			return fmt.Errorf("unauthenticated server of gateway %q with ID %q doesn't exist", gID, policy.ServerID)
+		}
+	}
 
 	sg.srvs = map[string]Server{}
 	for gID, sIDs := range sg.GatewayIDServerIDs {
@@ -84,6 +157,12 @@ func (sg *ServerGateway) indexWebhooks() error {
 func (sg ServerGateway) executeTemplate(msg string, pc ProcessedConn) string {
 	tmpls := map[string]string{
 		"username":      pc.Username(),
+		"xuid":          pc.XUID(),
+		"uuid":          pc.UUID(),
+		"deviceOS":      strconv.Itoa(pc.DeviceOS()),
+		"deviceModel":   pc.DeviceModel(),
+		"gameVersion":   pc.GameVersion(),
+		"languageCode":  pc.LanguageCode(),
 		"now":           time.Now().Format(time.RFC822),
 		"remoteAddress": pc.RemoteAddr().String(),
 		"localAddress":  pc.LocalAddr().String(),
@@ -98,6 +177,98 @@ func (sg ServerGateway) executeTemplate(msg string, pc ProcessedConn) string {
 	return msg
 }
 
+// route returns the server that the player should be connected to.
+// If the player was rejected, ok is false and the connection was already
+// closed. If no server matches the server address, srv is nil.
+func (sg ServerGateway) route(pc ProcessedConn) (srv Server, sgID string, ok bool) {
+	if !pc.Authenticated() {
+		policy := sg.UnauthenticatedPolicies[pc.GatewayID()]
+		switch policy.Action {
+		case UnauthenticatedActionReject:
+			sg.Log.Info("rejected unauthenticated client",
+				"username", pc.Username(),
+				"xuid", pc.XUID(),
+				"remoteAddress", pc.RemoteAddr(),
+			)
+			msg := sg.executeTemplate(policy.Message, pc)
+			_ = pc.Disconnect(msg)
+			return nil, "", false
+		case UnauthenticatedActionRoute:
+			return sg.srvIDs[policy.ServerID], policy.ServerID, true
+		}
+	}
+
+	srvAddrLower := strings.ToLower(pc.ServerAddr())
+	sgID = fmt.Sprintf("%s@%s", pc.GatewayID(), srvAddrLower)
+	return sg.srvs[sgID], sgID, true
+}
+
+// transfer sends the client to the target and closes the connection,
+// without relaying any traffic of the client. The transfer is reported
+// to the webhooks without delaying the routing of other players.
+func (sg ServerGateway) transfer(pc ProcessedConn, target TransferTarget, whks []webhook.Webhook) {
+	sg.Log.Info("transferring client",
+		"username", pc.Username(),
+		"xuid", pc.XUID(),
+		"host", target.Host,
+		"port", target.Port,
+		"remoteAddress", pc.RemoteAddr(),
+	)
+
+	if err := pc.Transfer(target.Host, target.Port); err != nil {
+		sg.Log.Error(err, "failed to transfer client")
+		return
+	}
+
+	go dispatchEvent(sg.Log, whks, webhook.EventPlayerTransfer{
+		Username:      pc.Username(),
+		XUID:          pc.XUID(),
+		RemoteAddress: pc.RemoteAddr().String(),
+		TargetAddress: net.JoinHostPort(target.Host, strconv.Itoa(int(target.Port))),
+	})
+}
+
+// reject tells the client why it was rejected, either with the native
+// login failure of the reason or with the message of the gateway's policy.
+func (sg ServerGateway) reject(pc ProcessedConn, reason RejectReason) {
+	sg.Log.Info("rejected client",
+		"reason", reason,
+		"username", pc.Username(),
+		"xuid", pc.XUID(),
+		"remoteAddress", pc.RemoteAddr(),
+	)
+
+	policy := sg.RejectionPolicies[pc.GatewayID()][reason]
+	var err error
+	switch policy.Action {
+	case RejectionActionDisconnect:
+		err = pc.Disconnect(sg.executeTemplate(policy.Message, pc))
+	default:
+		err = pc.Reject(reason)
+	}
+	if err != nil {
+		sg.Log.Error(err, "failed to reject client")
+	}
+}
+
+// admits reports if both the gateway and the server have room for the
+// player and counts it until release is called. Players that were admitted
+// before, but whose tunnels are not counted by Sessions yet, count as well.
+func (sg ServerGateway) admits(pc ProcessedConn, srv Server) bool {
+	if sg.Sessions == nil {
+		return true
+	}
+	return sg.admitted.admit(pc, srv.GetID(), srv.GetCapacity(), sg.Capacities[pc.GatewayID()], sg.Sessions)
+}
+
+// release stops to count the admitted player.
+func (sg ServerGateway) release(pc ProcessedConn, srv Server) {
+	if sg.Sessions == nil {
+		return
+	}
+	sg.admitted.release(pc.GatewayID(), srv.GetID())
+}
+
 func (sg ServerGateway) Start(srvChan <-chan ProcessedConn, poolChan chan<- ConnTunnel) error {
 	if err := sg.indexServers(); err != nil {
 		return err
@@ -107,45 +278,245 @@ func (sg ServerGateway) Start(srvChan <-chan ProcessedConn, poolChan chan<- Conn
 		return err
 	}
 
+	// The dialers hand off the tunnels of the players that are still
+	// pending once done is closed
+	var dialers sync.WaitGroup
+	defer dialers.Wait()
+	done := make(chan struct{})
+	defer close(done)
+	sg.admitted = newAdmissions()
+	sg.queues = map[string]*joinQueue{}
+	for _, srv := range sg.Servers {
+		policy := srv.GetQueuePolicy()
+		if !policy.Enabled() {
+			continue
+		}
+		q := &joinQueue{
+			srv:    srv,
+			policy: policy,
+		}
+		sg.queues[srv.GetID()] = q
+		go sg.serveQueue(q, poolChan, done)
+	}
+
+	sg.srvLimiters = map[string]*TrafficLimiter{}
+	for _, srv := range sg.Servers {
+		sg.srvLimiters[srv.GetID()] = NewTrafficLimiter(srv.GetSharedTrafficLimit())
+	}
+	sg.gwLimiters = map[string]*TrafficLimiter{}
+	for gID, limit := range sg.SharedTrafficLimits {
+		sg.gwLimiters[gID] = NewTrafficLimiter(limit)
+	}
+
+	sg.dialers = map[string]*serverDialer{}
+	for _, srv := range sg.Servers {
+		d := newServerDialer(sg, srv, sg.queues[srv.GetID()], poolChan)
+		sg.dialers[srv.GetID()] = d
+		dialers.Add(1)
+		go func() {
+			defer dialers.Done()
+			d.run(done)
+		}()
+	}
+
 	for {
 		pc, ok := <-srvChan
 		if !ok {
 			break
 		}
 
-		srvAddrLower := strings.ToLower(pc.ServerAddr())
-		sgID := fmt.Sprintf("%s@%s", pc.GatewayID(), srvAddrLower)
-		srv, ok := sg.srvs[sgID]
+		srv, sgID, ok := sg.route(pc)
 		if !ok {
+			continue
+		}
+		if srv == nil {
 			sg.Log.Info("invalid server",
 				"serverAddress", pc.ServerAddr(),
 				"remoteAddress", pc.RemoteAddr(),
 			)
+			// Transfers of unknown servers belong to no server, so
+			// every webhook can subscribe to them
+			if target, ok := sg.ServerNotFoundTransfers[pc.GatewayID()]; ok {
+				sg.transfer(pc, target, sg.Webhooks)
+				continue
+			}
 			msg := sg.ServerNotFoundMessages[pc.GatewayID()]
 			msg = sg.executeTemplate(msg, pc)
 			_ = pc.Disconnect(msg)
 			continue
 		}
 
+		if target, ok := srv.GetTransferTarget(); ok {
+			sg.transfer(pc, target, sg.srvWhks[srv.GetID()])
+			continue
+		}
+
+		q := sg.queues[srv.GetID()]
+		// Players do not skip the players that already wait for the server
+		if q != nil && q.len() > 0 {
+			sg.enqueue(q, pc)
+			continue
+		}
+
+		if !sg.admits(pc, srv) {
+			if q != nil {
+				sg.enqueue(q, pc)
+				continue
+			}
+			sg.reject(pc, RejectReasonServerFull)
+			continue
+		}
+
 		sg.Log.Info("connecting client",
 			"serverId", sgID,
+			"username", pc.Username(),
+			"xuid", pc.XUID(),
+			"deviceOS", pc.DeviceOS(),
+			"gameVersion", pc.GameVersion(),
 			"remoteAddress", pc.RemoteAddr(),
 		)
 
-		whks := sg.srvWhks[srv.GetID()]
-		ct, err := srv.ProcessConn(pc, whks)
-		if err != nil {
-			ct.Close()
-			continue
+		sg.dialers[srv.GetID()].dial(pc)
+	}
+
+	return nil
+}
+
+// connect connects the player to the server and sends the tunnel to the
+// pool. The player is still connected if the error is ErrServerUnavailable.
+func (sg ServerGateway) connect(pc ProcessedConn, srv Server, poolChan chan<- ConnTunnel) error {
+	ct, err := sg.dialServer(pc, srv)
+	if err != nil {
+		return err
+	}
+	sg.handOff(pc, ct, srv, poolChan)
+	return nil
+}
+
+// dialServer connects the player to the server. The player is still
+// connected if the error is ErrServerUnavailable and closed otherwise.
+func (sg ServerGateway) dialServer(pc ProcessedConn, srv Server) (ConnTunnel, error) {
+	ct, err := srv.ProcessConn(pc, sg.srvWhks[srv.GetID()])
+	if err != nil {
+		sg.release(pc, srv)
+		if errors.Is(err, ErrServerUnavailable) {
+			return ConnTunnel{}, err
 		}
+		var rejectErr RejectError
+		if errors.As(err, &rejectErr) {
+			sg.reject(pc, rejectErr.Reason)
+		}
+		// Servers might fail without disconnecting the client
+		_ = pc.Close()
+		return ConnTunnel{}, err
+	}
+	return ct, nil
+}
 
-		// Shallow copy webhooks to mitigate race conditions
-		whksCopy := make([]webhook.Webhook, len(whks))
-		_ = copy(whksCopy, whks)
-		ct.Webhooks = whksCopy
+// handOff sends the tunnel of the player to the pool.
+func (sg ServerGateway) handOff(pc ProcessedConn, ct ConnTunnel, srv Server, poolChan chan<- ConnTunnel) {
+	// Shallow copy webhooks to mitigate race conditions
+	whks := sg.srvWhks[srv.GetID()]
+	whksCopy := make([]webhook.Webhook, len(whks))
+	_ = copy(whksCopy, whks)
+	ct.Webhooks = whksCopy
+	ct.IdleTimeout = sg.IdleTimeouts[pc.GatewayID()]
+	ct.TrafficLimit = sg.TrafficLimits[pc.GatewayID()]
+	ct.SharedTrafficLimiters = nil
+	if l, ok := sg.srvLimiters[srv.GetID()]; ok {
+		ct.SharedTrafficLimiters = append(ct.SharedTrafficLimiters, l)
+	}
+	if l, ok := sg.gwLimiters[pc.GatewayID()]; ok {
+		ct.SharedTrafficLimiters = append(ct.SharedTrafficLimiters, l)
+	}
+	ct.ServerID = srv.GetID()
+	ct.onPooled = func() {
+		sg.release(pc, srv)
+	}
 
-		poolChan <- ct
+	poolChan <- ct
+}
+
+// enqueue lets the player wait in the queue of the server.
+func (sg ServerGateway) enqueue(q *joinQueue, pc ProcessedConn) {
+	position, size := q.push(pc, time.Now())
+	sg.Log.Info("queued client",
+		"serverId", q.srv.GetID(),
+		"username", pc.Username(),
+		"xuid", pc.XUID(),
+		"remoteAddress", pc.RemoteAddr(),
+		"position", position,
+		"queueSize", size,
+	)
+}
+
+// serveQueue lets the first players of the queue join the server once it
+// has room for them, and disconnects the players that waited for too long.
+func (sg ServerGateway) serveQueue(q *joinQueue, poolChan chan<- ConnTunnel, done <-chan struct{}) {
+	interval := q.policy.RetryInterval
+	if interval <= 0 {
+		interval = defaultQueueRetryInterval
 	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	return nil
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		left, positions := q.left()
+		for n, pc := range left {
+			sg.Log.Info("queued client left",
+				"serverId", q.srv.GetID(),
+				"username", pc.Username(),
+				"xuid", pc.XUID(),
+				"position", positions[n],
+			)
+			_ = pc.Close()
+		}
+
+		expired, positions := q.expire(time.Now())
+		for n, pc := range expired {
+			sg.Log.Info("queue timed out",
+				"serverId", q.srv.GetID(),
+				"username", pc.Username(),
+				"xuid", pc.XUID(),
+				"position", positions[n],
+			)
+			msg := executeQueueTemplate(q.policy.TimeoutMessage, positions[n], q.len())
+			_ = pc.Disconnect(sg.executeTemplate(msg, pc))
+		}
+
+		for {
+			entry, ok := q.head()
+			if !ok || !sg.admits(entry.pc, q.srv) {
+				break
+			}
+			pc := entry.pc
+
+			sg.Log.Info("connecting queued client",
+				"serverId", q.srv.GetID(),
+				"username", pc.Username(),
+				"xuid", pc.XUID(),
+				"remoteAddress", pc.RemoteAddr(),
+			)
+			// The player was already disconnected if the error is not retryable
+			if err := sg.connect(pc, q.srv, poolChan); errors.Is(err, ErrServerUnavailable) {
+				break
+			}
+			q.pop(entry)
+		}
+
+		moved, positions := q.moved()
+		for n, pc := range moved {
+			sg.Log.V(1).Info("queue position changed",
+				"serverId", q.srv.GetID(),
+				"username", pc.Username(),
+				"position", positions[n],
+			)
+		}
+	}
 }
@@ -0,0 +1,848 @@
+package bedprox_test
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	"github.com/haveachin/bedprox"
+	"github.com/haveachin/bedprox/webhook"
+)
+
+// playerConn is a processed connection of a player that joins
+// serverAddr through the gateway gw.
+type playerConn struct {
+	bedprox.ProcessedConn
+	serverAddr    string
+	username      string
+	xuid          string
+	authenticated bool
+	rejections    chan bedprox.RejectReason
+	disconnects   chan string
+	transfers     chan bedprox.TransferTarget
+}
+
+func newPlayerConn(username, xuid string, authenticated bool) playerConn {
+	return playerConn{
+		serverAddr:    "play.example.com",
+		username:      username,
+		xuid:          xuid,
+		authenticated: authenticated,
+		rejections:    make(chan bedprox.RejectReason, 1),
+		disconnects:   make(chan string, 1),
+		transfers:     make(chan bedprox.TransferTarget, 1),
+	}
+}
+
+func (pc playerConn) GatewayID() string {
+	return "gw"
+}
+
+func (pc playerConn) ServerAddr() string {
+	return pc.serverAddr
+}
+
+func (pc playerConn) Username() string {
+	return pc.username
+}
+
+func (pc playerConn) XUID() string {
+	return pc.xuid
+}
+
+func (pc playerConn) Authenticated() bool {
+	return pc.authenticated
+}
+
+func (pc playerConn) DeviceOS() int {
+	return 0
+}
+
+func (pc playerConn) GameVersion() string {
+	return "1.17.41"
+}
+
+func (pc playerConn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(203, 0, 113, 7), Port: 54321}
+}
+
+func (pc playerConn) Reject(reason bedprox.RejectReason) error {
+	pc.rejections <- reason
+	return nil
+}
+
+func (pc playerConn) Disconnect(msg string) error {
+	pc.disconnects <- msg
+	return nil
+}
+
+func (pc playerConn) Transfer(host string, port uint16) error {
+	pc.transfers <- bedprox.TransferTarget{Host: host, Port: port}
+	return nil
+}
+
+func (pc playerConn) Close() error {
+	return nil
+}
+
+func (pc playerConn) UUID() string {
+	return ""
+}
+
+func (pc playerConn) DeviceModel() string {
+	return ""
+}
+
+func (pc playerConn) LanguageCode() string {
+	return "en_US"
+}
+
+func (pc playerConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 19132}
+}
+
+// watchedPlayerConn is a player whose connection tells when it was
+// closed by the client, which is once left is closed.
+type watchedPlayerConn struct {
+	playerConn
+	left   chan struct{}
+	closes chan struct{}
+}
+
+func newWatchedPlayerConn(username string) watchedPlayerConn {
+	return watchedPlayerConn{
+		playerConn: newPlayerConn(username, "", true),
+		left:       make(chan struct{}),
+		closes:     make(chan struct{}, 1),
+	}
+}
+
+func (pc watchedPlayerConn) Watch() <-chan struct{} {
+	return pc.left
+}
+
+func (pc watchedPlayerConn) Close() error {
+	select {
+	case pc.closes <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// mockServer is the server play.example.com with the ID srv.
+type mockServer struct {
+	bedprox.Server
+	capacity bedprox.Capacity
+	queue    bedprox.QueuePolicy
+	// unavailable is the number of times that the server can not
+	// be reached before it is
+	unavailable *int32
+	// dialConcurrency is the number of players that the server is
+	// dialed for at once
+	dialConcurrency int
+	// err is returned by every dial
+	err error
+	// transfer is the target that the server transfers clients to
+	transfer   *bedprox.TransferTarget
+	webhookIDs []string
+}
+
+func (s mockServer) GetID() string {
+	return "srv"
+}
+
+func (s mockServer) GetDomains() []string {
+	return []string{"play.example.com"}
+}
+
+func (s mockServer) GetWebhookIDs() []string {
+	return s.webhookIDs
+}
+
+func (s mockServer) GetTransferTarget() (bedprox.TransferTarget, bool) {
+	if s.transfer == nil {
+		return bedprox.TransferTarget{}, false
+	}
+	return *s.transfer, true
+}
+
+func (s mockServer) GetCapacity() bedprox.Capacity {
+	return s.capacity
+}
+
+func (s mockServer) GetQueuePolicy() bedprox.QueuePolicy {
+	return s.queue
+}
+
+func (s mockServer) GetSharedTrafficLimit() bedprox.TrafficLimit {
+	return bedprox.TrafficLimit{}
+}
+
+func (s mockServer) GetDialConcurrency() int {
+	return s.dialConcurrency
+}
+
+func (s mockServer) ProcessConn(c net.Conn, webhooks []webhook.Webhook) (bedprox.ConnTunnel, error) {
+	if s.unavailable != nil && atomic.AddInt32(s.unavailable, -1) >= 0 {
+		return bedprox.ConnTunnel{}, bedprox.ErrServerUnavailable
+	}
+	if s.err != nil {
+		return bedprox.ConnTunnel{}, s.err
+	}
+	return bedprox.ConnTunnel{Conn: c.(bedprox.ProcessedConn)}, nil
+}
+
+// sessionCounts counts the same sessions for every server and gateway.
+type sessionCounts struct {
+	server  int
+	gateway int
+}
+
+func (c sessionCounts) ServerSessionCount(serverID string) int {
+	return c.server
+}
+
+func (c sessionCounts) GatewaySessionCount(gatewayID string) int {
+	return c.gateway
+}
+
+// liveSessionCounts counts the same sessions for every server and
+// gateway, but can change while the server gateway runs.
+type liveSessionCounts struct {
+	mu    sync.Mutex
+	count int
+}
+
+func (c *liveSessionCounts) set(count int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.count = count
+}
+
+func (c *liveSessionCounts) ServerSessionCount(serverID string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.count
+}
+
+func (c *liveSessionCounts) GatewaySessionCount(gatewayID string) int {
+	return c.ServerSessionCount("")
+}
+
+func TestServerGateway_Start_Capacity(t *testing.T) {
+	reserved := bedprox.PlayerSet{
+		XUIDs:     []string{"2535412345678901"},
+		Usernames: []string{"Alex"},
+	}
+
+	tt := []struct {
+		name            string
+		pc              playerConn
+		serverCapacity  bedprox.Capacity
+		gatewayCapacity bedprox.Capacity
+		sessions        sessionCounts
+		admitted        bool
+	}{
+		{
+			name:           "room left",
+			pc:             newPlayerConn("Steve", "", true),
+			serverCapacity: bedprox.Capacity{MaxPlayers: 10},
+			sessions:       sessionCounts{server: 9, gateway: 9},
+			admitted:       true,
+		},
+		{
+			name:           "no limit",
+			pc:             newPlayerConn("Steve", "", true),
+			serverCapacity: bedprox.Capacity{},
+			sessions:       sessionCounts{server: 1000, gateway: 1000},
+			admitted:       true,
+		},
+		{
+			name:           "server full",
+			pc:             newPlayerConn("Steve", "", true),
+			serverCapacity: bedprox.Capacity{MaxPlayers: 10},
+			sessions:       sessionCounts{server: 10, gateway: 10},
+		},
+		{
+			name:            "gateway full",
+			pc:              newPlayerConn("Steve", "", true),
+			serverCapacity:  bedprox.Capacity{MaxPlayers: 10},
+			gatewayCapacity: bedprox.Capacity{MaxPlayers: 5},
+			sessions:        sessionCounts{server: 5, gateway: 5},
+		},
+		{
+			name:           "reserved XUID",
+			pc:             newPlayerConn("Steve", "2535412345678901", true),
+			serverCapacity: bedprox.Capacity{MaxPlayers: 10, HardCap: 12, Reserved: reserved},
+			sessions:       sessionCounts{server: 11, gateway: 11},
+			admitted:       true,
+		},
+		{
+			name:           "reserved username",
+			pc:             newPlayerConn("alex", "", true),
+			serverCapacity: bedprox.Capacity{MaxPlayers: 10, HardCap: 12, Reserved: reserved},
+			sessions:       sessionCounts{server: 10, gateway: 10},
+			admitted:       true,
+		},
+		{
+			name:           "reserved at hard cap",
+			pc:             newPlayerConn("Steve", "2535412345678901", true),
+			serverCapacity: bedprox.Capacity{MaxPlayers: 10, HardCap: 12, Reserved: reserved},
+			sessions:       sessionCounts{server: 12, gateway: 12},
+		},
+		{
+			name:           "unauthenticated reserved username",
+			pc:             newPlayerConn("Alex", "", false),
+			serverCapacity: bedprox.Capacity{MaxPlayers: 10, HardCap: 12, Reserved: reserved},
+			sessions:       sessionCounts{server: 10, gateway: 10},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			sg := bedprox.ServerGateway{
+				GatewayIDServerIDs: map[string][]string{"gw": {"srv"}},
+				Capacities:         map[string]bedprox.Capacity{"gw": tc.gatewayCapacity},
+				Sessions:           tc.sessions,
+				Servers:            []bedprox.Server{mockServer{capacity: tc.serverCapacity}},
+				Log:                logr.Discard(),
+			}
+
+			srvChan := make(chan bedprox.ProcessedConn, 1)
+			poolChan := make(chan bedprox.ConnTunnel, 1)
+			srvChan <- tc.pc
+			close(srvChan)
+			if err := sg.Start(srvChan, poolChan); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case <-poolChan:
+				if !tc.admitted {
+					t.Error("expected the player to be rejected")
+				}
+			case reason := <-tc.pc.rejections:
+				if tc.admitted {
+					t.Errorf("expected the player to be admitted; got rejected with %q", reason)
+				} else if reason != bedprox.RejectReasonServerFull {
+					t.Errorf("expected reason %q; got %q", bedprox.RejectReasonServerFull, reason)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("player was neither admitted nor rejected")
+			}
+		})
+	}
+}
+
+func TestServerGateway_Start_Transfer(t *testing.T) {
+	target := bedprox.TransferTarget{Host: "lobby.example.com", Port: 19133}
+
+	tt := []struct {
+		name       string
+		serverAddr string
+		srv        mockServer
+		// notFound is the transfer target of the gateway for
+		// players that join an unknown server
+		notFound map[string]bedprox.TransferTarget
+	}{
+		{
+			name:       "server",
+			serverAddr: "play.example.com",
+			srv:        mockServer{transfer: &target, webhookIDs: []string{"wh"}},
+		},
+		{
+			name:       "server not found",
+			serverAddr: "unknown.example.com",
+			notFound:   map[string]bedprox.TransferTarget{"gw": target},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			httpClient := &recordingHTTPClient{}
+			sg := bedprox.ServerGateway{
+				GatewayIDServerIDs:      map[string][]string{"gw": {"srv"}},
+				ServerNotFoundTransfers: tc.notFound,
+				Servers:                 []bedprox.Server{tc.srv},
+				Webhooks: []webhook.Webhook{
+					{
+						ID:         "wh",
+						HTTPClient: httpClient,
+						EventTypes: []string{webhook.EventTypePlayerTransfer},
+					},
+				},
+				Log: logr.Discard(),
+			}
+
+			pc := newPlayerConn("Steve", "2535412345678901", true)
+			pc.serverAddr = tc.serverAddr
+			srvChan := make(chan bedprox.ProcessedConn, 1)
+			poolChan := make(chan bedprox.ConnTunnel, 1)
+			srvChan <- pc
+			close(srvChan)
+			if err := sg.Start(srvChan, poolChan); err != nil {
+				t.Fatal(err)
+			}
+
+			select {
+			case got := <-pc.transfers:
+				if got != target {
+					t.Errorf("expected transfer to %v; got %v", target, got)
+				}
+			case <-poolChan:
+				t.Fatal("expected the player to be transferred instead of proxied")
+			case <-time.After(time.Second):
+				t.Fatal("player was not transferred")
+			}
+
+			// Transfers are dispatched without blocking the routing
+			deadline := time.Now().Add(time.Second)
+			for len(httpClient.recorded()) == 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("transfer was not dispatched")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			var event webhook.EventPlayerTransfer
+			if err := json.Unmarshal(httpClient.recorded()[0], &event); err != nil {
+				t.Fatal(err)
+			}
+			if event.Username != "Steve" || event.TargetAddress != "lobby.example.com:19133" {
+				t.Errorf("expected Steve to be transferred to lobby.example.com:19133; got %+v", event)
+			}
+		})
+	}
+}
+
+func TestServerGateway_Start_Queue(t *testing.T) {
+	staff := bedprox.PlayerSet{XUIDs: []string{"2535412345678901"}}
+	queue := bedprox.QueuePolicy{
+		MaxWait:        time.Second,
+		RetryInterval:  10 * time.Millisecond,
+		Tiers:          []bedprox.PlayerSet{staff},
+		TimeoutMessage: "Sorry {{username}}, you were number {{queuePosition}}",
+	}
+
+	// startQueue starts a server gateway for a full server with a queue
+	// and returns the channel that admitted players are sent to.
+	startQueue := func(t *testing.T, srv bedprox.Server, sessions *liveSessionCounts) (chan<- bedprox.ProcessedConn, <-chan bedprox.ConnTunnel) {
+		sg := bedprox.ServerGateway{
+			GatewayIDServerIDs: map[string][]string{"gw": {"srv"}},
+			Sessions:           sessions,
+			Servers:            []bedprox.Server{srv},
+			Log:                logr.Discard(),
+		}
+
+		srvChan := make(chan bedprox.ProcessedConn)
+		poolChan := make(chan bedprox.ConnTunnel, 2)
+		go sg.Start(srvChan, poolChan)
+		t.Cleanup(func() { close(srvChan) })
+		return srvChan, poolChan
+	}
+
+	admitted := func(t *testing.T, poolChan <-chan bedprox.ConnTunnel) string {
+		select {
+		case ct := <-poolChan:
+			return ct.Conn.Username()
+		case <-time.After(time.Second):
+			t.Fatal("no player was admitted")
+			return ""
+		}
+	}
+
+	t.Run("slot opens", func(t *testing.T) {
+		sessions := &liveSessionCounts{count: 1}
+		srvChan, poolChan := startQueue(t, mockServer{
+			capacity: bedprox.Capacity{MaxPlayers: 1},
+			queue:    queue,
+		}, sessions)
+
+		srvChan <- newPlayerConn("Alex", "", true)
+		select {
+		case <-poolChan:
+			t.Fatal("expected the player to wait in the queue")
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		sessions.set(0)
+		if username := admitted(t, poolChan); username != "Alex" {
+			t.Errorf("expected Alex to be admitted; got %s", username)
+		}
+	})
+
+	t.Run("priority tier", func(t *testing.T) {
+		sessions := &liveSessionCounts{count: 2}
+		srvChan, poolChan := startQueue(t, mockServer{
+			capacity: bedprox.Capacity{MaxPlayers: 2},
+			queue:    queue,
+		}, sessions)
+
+		srvChan <- newPlayerConn("Alex", "", true)
+		srvChan <- newPlayerConn("Steve", "2535412345678901", true)
+		time.Sleep(20 * time.Millisecond)
+
+		sessions.set(0)
+		first := admitted(t, poolChan)
+		second := admitted(t, poolChan)
+		if first != "Steve" || second != "Alex" {
+			t.Errorf("expected Steve to be admitted before Alex; got %s before %s", first, second)
+		}
+	})
+
+	t.Run("priority tier while dialing", func(t *testing.T) {
+		sessions := &liveSessionCounts{count: 2}
+		srvChan, poolChan := startQueue(t, slowServer{
+			mockServer: mockServer{
+				capacity: bedprox.Capacity{MaxPlayers: 2},
+				queue:    queue,
+			},
+			id:     "srv",
+			delays: map[string]time.Duration{"Alex": 100 * time.Millisecond},
+		}, sessions)
+
+		srvChan <- newSlowPlayerConn("Alex", "srv")
+		sessions.set(1)
+		// Steve is queued ahead of Alex while Alex is dialed
+		time.Sleep(30 * time.Millisecond)
+		steve := newSlowPlayerConn("Steve", "srv")
+		steve.xuid = "2535412345678901"
+		srvChan <- steve
+
+		if username := admitted(t, poolChan); username != "Alex" {
+			t.Errorf("expected Alex to be admitted; got %s", username)
+		}
+		sessions.set(0)
+		if username := admitted(t, poolChan); username != "Steve" {
+			t.Errorf("expected Steve to be admitted; got %s", username)
+		}
+	})
+
+	t.Run("server starting", func(t *testing.T) {
+		unavailable := int32(3)
+		srvChan, poolChan := startQueue(t, mockServer{
+			queue:       queue,
+			unavailable: &unavailable,
+		}, &liveSessionCounts{})
+
+		srvChan <- newPlayerConn("Alex", "", true)
+		if username := admitted(t, poolChan); username != "Alex" {
+			t.Errorf("expected Alex to be admitted; got %s", username)
+		}
+		if n := atomic.LoadInt32(&unavailable); n >= 0 {
+			t.Errorf("expected the server to be dialed until it was reachable; %d dials left", n)
+		}
+	})
+
+	t.Run("player left", func(t *testing.T) {
+		sessions := &liveSessionCounts{count: 1}
+		srvChan, poolChan := startQueue(t, mockServer{
+			capacity: bedprox.Capacity{MaxPlayers: 1},
+			queue:    queue,
+		}, sessions)
+
+		pc := newWatchedPlayerConn("Alex")
+		srvChan <- pc
+		srvChan <- newPlayerConn("Steve", "", true)
+		close(pc.left)
+		select {
+		case <-pc.closes:
+		case <-time.After(time.Second):
+			t.Fatal("player that left was not removed from the queue")
+		}
+
+		sessions.set(0)
+		if username := admitted(t, poolChan); username != "Steve" {
+			t.Errorf("expected Steve to be admitted; got %s", username)
+		}
+	})
+
+	t.Run("server fails", func(t *testing.T) {
+		sessions := &liveSessionCounts{count: 1}
+		srvChan, poolChan := startQueue(t, mockServer{
+			capacity: bedprox.Capacity{MaxPlayers: 1},
+			queue:    queue,
+			err:      errors.New("login failed"),
+		}, sessions)
+
+		pc := newWatchedPlayerConn("Alex")
+		srvChan <- pc
+		time.Sleep(20 * time.Millisecond)
+
+		sessions.set(0)
+		select {
+		case <-pc.closes:
+		case <-poolChan:
+			t.Fatal("expected the player not to be admitted")
+		case <-time.After(time.Second):
+			t.Fatal("player was not closed")
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		timeoutQueue := queue
+		timeoutQueue.MaxWait = 50 * time.Millisecond
+		srvChan, _ := startQueue(t, mockServer{
+			capacity: bedprox.Capacity{MaxPlayers: 1},
+			queue:    timeoutQueue,
+		}, &liveSessionCounts{count: 1})
+
+		pc := newPlayerConn("Alex", "", true)
+		srvChan <- pc
+		select {
+		case msg := <-pc.disconnects:
+			if want := "Sorry Alex, you were number 1"; !strings.Contains(msg, want) {
+				t.Errorf("expected message %q; got %q", want, msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("player was not disconnected")
+		}
+	})
+}
+
+// slowServer is a server with the ID and domain id that
+// takes delay to dial, or the delay of the player if it has one.
+type slowServer struct {
+	mockServer
+	id     string
+	delay  time.Duration
+	delays map[string]time.Duration
+}
+
+func (s slowServer) GetID() string {
+	return s.id
+}
+
+func (s slowServer) GetDomains() []string {
+	return []string{s.id}
+}
+
+func (s slowServer) ProcessConn(c net.Conn, webhooks []webhook.Webhook) (bedprox.ConnTunnel, error) {
+	delay, ok := s.delays[c.(bedprox.ProcessedConn).Username()]
+	if !ok {
+		delay = s.delay
+	}
+	time.Sleep(delay)
+	return s.mockServer.ProcessConn(c, webhooks)
+}
+
+// startSlowServers starts a server gateway for the servers and returns
+// the channel that admitted players are sent to.
+func startSlowServers(servers []bedprox.Server, poolSize int) (chan<- bedprox.ProcessedConn, <-chan bedprox.ConnTunnel) {
+	var ids []string
+	for _, srv := range servers {
+		ids = append(ids, srv.GetID())
+	}
+	sg := bedprox.ServerGateway{
+		GatewayIDServerIDs: map[string][]string{"gw": ids},
+		Servers:            servers,
+		Log:                logr.Discard(),
+	}
+
+	srvChan := make(chan bedprox.ProcessedConn)
+	poolChan := make(chan bedprox.ConnTunnel, poolSize)
+	go sg.Start(srvChan, poolChan)
+	return srvChan, poolChan
+}
+
+func newSlowPlayerConn(username, serverAddr string) playerConn {
+	pc := newPlayerConn(username, "", true)
+	pc.serverAddr = serverAddr
+	return pc
+}
+
+func TestServerGateway_Start_Dial(t *testing.T) {
+	t.Run("slow server", func(t *testing.T) {
+		srvChan, poolChan := startSlowServers([]bedprox.Server{
+			slowServer{id: "slow", delay: time.Second},
+			slowServer{id: "fast"},
+		}, 2)
+		defer close(srvChan)
+
+		srvChan <- newSlowPlayerConn("Alex", "slow")
+		srvChan <- newSlowPlayerConn("Steve", "fast")
+		select {
+		case ct := <-poolChan:
+			if username := ct.Conn.Username(); username != "Steve" {
+				t.Errorf("expected Steve to be admitted first; got %s", username)
+			}
+		case <-time.After(500 * time.Millisecond):
+			t.Fatal("slow server blocked the players of other servers")
+		}
+	})
+
+	t.Run("join order", func(t *testing.T) {
+		usernames := []string{"Alex", "Steve", "Sunny", "Kai"}
+		srvChan, poolChan := startSlowServers([]bedprox.Server{
+			slowServer{
+				mockServer: mockServer{dialConcurrency: len(usernames)},
+				id:         "srv",
+				// The first players take the longest to dial
+				delays: map[string]time.Duration{
+					"Alex":  40 * time.Millisecond,
+					"Steve": 30 * time.Millisecond,
+					"Sunny": 20 * time.Millisecond,
+					"Kai":   10 * time.Millisecond,
+				},
+			},
+		}, len(usernames))
+		defer close(srvChan)
+
+		start := time.Now()
+		for _, username := range usernames {
+			srvChan <- newSlowPlayerConn(username, "srv")
+		}
+		for _, want := range usernames {
+			select {
+			case ct := <-poolChan:
+				if username := ct.Conn.Username(); username != want {
+					t.Errorf("expected %s to be admitted next; got %s", want, username)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%s was not admitted", want)
+			}
+		}
+		// Dialing one player after another would take 100ms
+		if elapsed := time.Since(start); elapsed >= 100*time.Millisecond {
+			t.Errorf("expected the players to be dialed at once; took %s", elapsed)
+		}
+	})
+}
+
+func TestServerGateway_Start_DialCapacity(t *testing.T) {
+	// startFullServer starts a server gateway for the server that
+	// counts no sessions, since no tunnel reaches a pool.
+	startFullServer := func(t *testing.T, srv bedprox.Server) (chan<- bedprox.ProcessedConn, <-chan bedprox.ConnTunnel) {
+		sg := bedprox.ServerGateway{
+			GatewayIDServerIDs: map[string][]string{"gw": {srv.GetID()}},
+			Sessions:           sessionCounts{},
+			Servers:            []bedprox.Server{srv},
+			Log:                logr.Discard(),
+		}
+
+		srvChan := make(chan bedprox.ProcessedConn)
+		poolChan := make(chan bedprox.ConnTunnel, 10)
+		go sg.Start(srvChan, poolChan)
+		t.Cleanup(func() { close(srvChan) })
+		return srvChan, poolChan
+	}
+
+	t.Run("slow server", func(t *testing.T) {
+		srvChan, poolChan := startFullServer(t, slowServer{
+			mockServer: mockServer{
+				capacity:        bedprox.Capacity{MaxPlayers: 2},
+				dialConcurrency: 4,
+			},
+			id:    "srv",
+			delay: 50 * time.Millisecond,
+		})
+
+		var players []playerConn
+		for _, username := range []string{"Alex", "Steve", "Sunny", "Kai", "Noor"} {
+			pc := newSlowPlayerConn(username, "srv")
+			players = append(players, pc)
+			srvChan <- pc
+		}
+
+		// The players that joined while the first ones were dialed
+		// exceed the capacity of the server
+		for _, pc := range players[2:] {
+			select {
+			case reason := <-pc.rejections:
+				if reason != bedprox.RejectReasonServerFull {
+					t.Errorf("expected reason %q; got %q", bedprox.RejectReasonServerFull, reason)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("expected %s to be rejected", pc.Username())
+			}
+		}
+
+		for _, pc := range players[:2] {
+			select {
+			case ct := <-poolChan:
+				if username := ct.Conn.Username(); username != pc.Username() {
+					t.Errorf("expected %s to be admitted; got %s", pc.Username(), username)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("%s was not admitted", pc.Username())
+			}
+		}
+	})
+
+	t.Run("failed dial", func(t *testing.T) {
+		unavailable := int32(1)
+		srvChan, poolChan := startFullServer(t, slowServer{
+			mockServer: mockServer{
+				capacity:    bedprox.Capacity{MaxPlayers: 1},
+				unavailable: &unavailable,
+			},
+			id: "srv",
+		})
+
+		// Alex can not reach the server, which frees the slot again
+		pc := newWatchedPlayerConn("Alex")
+		pc.serverAddr = "srv"
+		srvChan <- pc
+		select {
+		case <-pc.closes:
+		case <-time.After(time.Second):
+			t.Fatal("expected Alex to be closed")
+		}
+
+		srvChan <- newSlowPlayerConn("Steve", "srv")
+		select {
+		case ct := <-poolChan:
+			if username := ct.Conn.Username(); username != "Steve" {
+				t.Errorf("expected Steve to be admitted; got %s", username)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Steve was not admitted")
+		}
+	})
+}
+
+// BenchmarkServerGateway_Start_Dial routes players to a server that takes
+// a millisecond to dial while every other player joins an unreachable
+// server that takes 10ms to time out.
+func BenchmarkServerGateway_Start_Dial(b *testing.B) {
+	for _, concurrency := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("concurrency %d", concurrency), func(b *testing.B) {
+			unavailable := int32(math.MaxInt32)
+			srvChan, poolChan := startSlowServers([]bedprox.Server{
+				slowServer{
+					mockServer: mockServer{dialConcurrency: concurrency},
+					id:         "srv",
+					delay:      time.Millisecond,
+				},
+				slowServer{
+					mockServer: mockServer{
+						dialConcurrency: concurrency,
+						unavailable:     &unavailable,
+					},
+					id:    "down",
+					delay: 10 * time.Millisecond,
+				},
+			}, b.N)
+			defer close(srvChan)
+
+			b.ResetTimer()
+			go func() {
+				for n := 0; n < b.N; n++ {
+					srvChan <- newSlowPlayerConn("Steve", "srv")
+					srvChan <- newSlowPlayerConn("Alex", "down")
+				}
+			}()
+			for n := 0; n < b.N; n++ {
+				<-poolChan
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package bedprox
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// TrafficStats are the bytes and packets that were relayed
+// in each direction
+type TrafficStats struct {
+	ClientToServerBytes   uint64
+	ClientToServerPackets uint64
+	ServerToClientBytes   uint64
+	ServerToClientPackets uint64
+}
+
+// Add returns the sum of both stats
+func (s TrafficStats) Add(o TrafficStats) TrafficStats {
+	return TrafficStats{
+		ClientToServerBytes:   s.ClientToServerBytes + o.ClientToServerBytes,
+		ClientToServerPackets: s.ClientToServerPackets + o.ClientToServerPackets,
+		ServerToClientBytes:   s.ServerToClientBytes + o.ServerToClientBytes,
+		ServerToClientPackets: s.ServerToClientPackets + o.ServerToClientPackets,
+	}
+}
+
+// tunnelTraffic counts the traffic of a tunnel and when it last read from
+// each side. It is only accessed atomically, so that counting does not
+// add a lock to relaying.
+type tunnelTraffic struct {
+	clientBytes   uint64
+	clientPackets uint64
+	serverBytes   uint64
+	serverPackets uint64
+	// clientReadAt and serverReadAt are Unix nanoseconds
+	clientReadAt int64
+	serverReadAt int64
+}
+
+// touch marks both sides as active now
+func (t *tunnelTraffic) touch() {
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&t.clientReadAt, now)
+	atomic.StoreInt64(&t.serverReadAt, now)
+}
+
+func (t *tunnelTraffic) readAt() (clientReadAt, serverReadAt time.Time) {
+	return time.Unix(0, atomic.LoadInt64(&t.clientReadAt)),
+		time.Unix(0, atomic.LoadInt64(&t.serverReadAt))
+}
+
+func (t *tunnelTraffic) stats() TrafficStats {
+	return TrafficStats{
+		ClientToServerBytes:   atomic.LoadUint64(&t.clientBytes),
+		ClientToServerPackets: atomic.LoadUint64(&t.clientPackets),
+		ServerToClientBytes:   atomic.LoadUint64(&t.serverBytes),
+		ServerToClientPackets: atomic.LoadUint64(&t.serverPackets),
+	}
+}
+
+func (t *tunnelTraffic) clientReader(r io.Reader) io.Reader {
+	return trafficReader{
+		r:       r,
+		bytes:   &t.clientBytes,
+		packets: &t.clientPackets,
+		readAt:  &t.clientReadAt,
+	}
+}
+
+func (t *tunnelTraffic) serverReader(r io.Reader) io.Reader {
+	return trafficReader{
+		r:       r,
+		bytes:   &t.serverBytes,
+		packets: &t.serverPackets,
+		readAt:  &t.serverReadAt,
+	}
+}
+
+// trafficReader counts the bytes and packets that it reads. Connections
+// of tunnels return one packet per read.
+type trafficReader struct {
+	r       io.Reader
+	bytes   *uint64
+	packets *uint64
+	readAt  *int64
+}
+
+func (r trafficReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	if n > 0 {
+		atomic.AddUint64(r.bytes, uint64(n))
+		atomic.AddUint64(r.packets, 1)
+		atomic.StoreInt64(r.readAt, time.Now().UnixNano())
+	}
+	return n, err
+}
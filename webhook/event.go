@@ -4,6 +4,7 @@ const (
 	EventTypeError          string = "Error"
 	EventTypePlayerJoin     string = "PlayerJoin"
 	EventTypePlayerLeave    string = "PlayerLeave"
+	EventTypePlayerTransfer string = "PlayerTransfer"
 	EventTypeContainerStart string = "ContainerStart"
 	EventTypeContainerStop  string = "ContainerStop"
 )
@@ -23,6 +24,7 @@ func (event EventError) EventType() string {
 
 type EventPlayerJoin struct {
 	Username      string `json:"username"`
+	XUID          string `json:"xuid"`
 	RemoteAddress string `json:"remoteAddress"`
 	TargetAddress string `json:"targetAddress"`
 	ProxyUID      string `json:"proxyUid"`
@@ -34,15 +36,40 @@ func (event EventPlayerJoin) EventType() string {
 
 type EventPlayerLeave struct {
 	Username      string `json:"username"`
+	XUID          string `json:"xuid"`
 	RemoteAddress string `json:"remoteAddress"`
 	TargetAddress string `json:"targetAddress"`
 	ProxyUID      string `json:"proxyUid"`
+	// Reason is the reason why the session of the player was closed
+	Reason string `json:"reason"`
+	// Duration is the duration of the session in seconds
+	Duration float64 `json:"duration"`
+
+	ClientToServerBytes   uint64 `json:"clientToServerBytes"`
+	ClientToServerPackets uint64 `json:"clientToServerPackets"`
+	ServerToClientBytes   uint64 `json:"serverToClientBytes"`
+	ServerToClientPackets uint64 `json:"serverToClientPackets"`
 }
 
 func (event EventPlayerLeave) EventType() string {
 	return EventTypePlayerLeave
 }
 
+// EventPlayerTransfer is dispatched when a player is transferred
+// to the address of another server instead of being proxied
+type EventPlayerTransfer struct {
+	Username      string `json:"username"`
+	XUID          string `json:"xuid"`
+	RemoteAddress string `json:"remoteAddress"`
+	// TargetAddress is the address that the player was transferred to
+	TargetAddress string `json:"targetAddress"`
+	ProxyUID      string `json:"proxyUid"`
+}
+
+func (event EventPlayerTransfer) EventType() string {
+	return EventTypePlayerTransfer
+}
+
 type EventContainerStart struct {
 	ProxyUID string `json:"proxyUid"`
 }
@@ -23,6 +23,10 @@ func TestErrorEvent_EventType(t *testing.T) {
 			event:     webhook.EventPlayerLeave{},
 			eventType: webhook.EventTypePlayerLeave,
 		},
+		{
+			event:     webhook.EventPlayerTransfer{},
+			eventType: webhook.EventTypePlayerTransfer,
+		},
 		{
 			event:     webhook.EventContainerStart{},
 			eventType: webhook.EventTypeContainerStart,